@@ -1,25 +1,35 @@
 package beater
 
 import (
+	"context"
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
 	"github.com/e-travel/cloudwatchlogsbeat/cwl"
 
 	"github.com/elastic/beats/v7/libbeat/beat"
 	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/acker"
 	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/paths"
 )
 
 const DefaultAWSRegion = "eu-west-1"
 
 // Our cloud beat
 type Cloudwatchlogsbeat struct {
-	// Used to terminate process
-	Done chan struct{}
+	// Used to terminate process; cancelling it stops all the monitors
+	ctx    context.Context
+	cancel context.CancelFunc
 	// cwl params
 	Params *cwl.Params
 	// the monitoring manager
 	Manager *cwl.GroupManager
+	// the aws session
+	Session *cwl.AwsSession
 }
 
 // Creates a new cloudwatchlogsbeat
@@ -47,28 +57,44 @@ func New(b *beat.Beat, cfg *common.Config) (beat.Beater, error) {
 	sess := cwl.NewAwsSession(config.AWSRegion)
 
 	// Create beat registry
-	var registry cwl.Registry
-	if config.S3BucketName == "" {
-		logp.Info("Working with in-memory registry")
-		registry = cwl.NewDummyRegistry()
-	} else {
-		logp.Info("Working with s3 registry in bucket %s", config.S3BucketName)
-		registry = &cwl.S3Registry{
-			S3Client:   sess.S3Client(),
-			BucketName: config.S3BucketName,
-			KeyPrefix:  config.S3KeyPrefix,
-		}
+	registry, err := newRegistry(config, sess)
+	if err != nil {
+		return nil, err
 	}
 
-	// create beat publisher
-	beatClient, _ := b.Publisher.Connect()
+	// create beat publisher; the registry is updated only after the
+	// published events have been acknowledged by the pipeline, which is
+	// awaited on close for up to shutdown_timeout
+	beatClient, err := b.Publisher.ConnectWith(beat.ClientConfig{
+		PublishMode: beat.GuaranteedSend,
+		ACKHandler:  acker.EventPrivateReporter(cwl.AckEvents),
+		WaitClose:   config.ShutdownTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the id of the beat's own account is added to the events
+	accountId, err := sess.AccountId()
+	if err != nil {
+		logp.Warn("cloudwatchlogsbeat: failed to get the account id [%s]", err.Error())
+	}
+
+	// create a client for every other account and region of the
+	// prospectors; the requests of each client are rate limited separately
+	clients := newClients(config)
 
 	// Create instance
+	ctx, cancel := context.WithCancel(context.Background())
 	beat := &Cloudwatchlogsbeat{
-		Done: make(chan struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
+		Session: sess,
 		Params: &cwl.Params{
 			Config:    config,
-			AWSClient: sess.CloudWatchLogsClient(),
+			AWSClient: cwl.NewRateLimitedClient(sess.CloudWatchLogsClient(), config.RateLimits),
+			Clients:   clients,
+			AccountId: accountId,
 			Registry:  registry,
 			Publisher: cwl.Publisher{Client: beatClient},
 		},
@@ -77,19 +103,151 @@ func New(b *beat.Beat, cfg *common.Config) (beat.Beater, error) {
 	return beat, nil
 }
 
+// Creates the clients of the prospectors' regions other than aws_region
+// and of the accounts whose roles are assumed, by their client key
+func newClients(config *cwl.Config) map[string]cloudwatchlogsiface.CloudWatchLogsAPI {
+	clients := make(map[string]cloudwatchlogsiface.CloudWatchLogsAPI)
+	for i := range config.Prospectors {
+		prospector := &config.Prospectors[i]
+		account := prospector.AccountId()
+		for _, region := range config.ProspectorRegions(prospector) {
+			name := region
+			if region == config.AWSRegion {
+				name = ""
+			}
+			key := cwl.ClientKey(account, name)
+			if _, ok := clients[key]; ok || key == cwl.ClientKey("", "") {
+				continue
+			}
+			sess := cwl.NewAwsSession(region)
+			if prospector.RoleArn != "" {
+				sessionName := prospector.SessionName
+				if sessionName == "" {
+					sessionName = cwl.DefaultRoleSessionName
+				}
+				logp.Info("Assuming role %s in region %s", prospector.RoleArn, region)
+				sess = sess.AssumeRole(prospector.RoleArn, prospector.ExternalId, sessionName)
+			} else {
+				logp.Info("Monitoring log groups in region %s", region)
+			}
+			client := cwl.NewRateLimitedClient(sess.CloudWatchLogsClient(), config.RateLimits)
+			client.Name = strings.TrimPrefix(account+":"+region, ":")
+			clients[key] = client
+		}
+	}
+	return clients
+}
+
+// Creates the registry backend selected in the configuration; when no
+// registry is specified, s3 is used if a bucket is given, otherwise memory
+func newRegistry(config *cwl.Config, sess *cwl.AwsSession) (cwl.Registry, error) {
+	kind := config.Registry
+	if kind == "" {
+		kind = "memory"
+		if config.S3BucketName != "" {
+			kind = "s3"
+		}
+	}
+	switch kind {
+	case "s3":
+		logp.Info("Working with s3 registry in bucket %s", config.S3BucketName)
+		return &cwl.S3Registry{
+			S3Client:   sess.S3Client(),
+			BucketName: config.S3BucketName,
+			KeyPrefix:  config.S3KeyPrefix,
+		}, nil
+	case "dynamodb":
+		logp.Info("Working with dynamodb registry in table %s", config.DynamoDBTableName)
+		return cwl.NewDynamoDBRegistry(sess.DynamoDBClient(), config.DynamoDBTableName), nil
+	case "file":
+		path := config.RegistryPath
+		if path == "" {
+			path = paths.Resolve(paths.Data, "registry")
+		}
+		logp.Info("Working with file registry in %s", path)
+		return cwl.NewFileRegistry(path)
+	default:
+		logp.Info("Working with in-memory registry")
+		return cwl.NewDummyRegistry(), nil
+	}
+}
+
 // Runs continuously our cloud beat
 func (beat *Cloudwatchlogsbeat) Run(b *beat.Beat) error {
 	logp.Info("cloudwatchlogsbeat is running! Hit CTRL-C to stop it.")
 
 	beat.Manager = cwl.NewGroupManager(beat.Params)
 
-	go beat.Manager.Monitor()
-	<-beat.Done
+	var running sync.WaitGroup
+	run := func(monitor func()) {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			monitor()
+		}()
+	}
+	switch beat.Params.Config.Input {
+	case cwl.KinesisInput:
+		for _, streamName := range beat.Params.Config.KinesisStreamNames {
+			consumer := cwl.NewKinesisConsumer(streamName, beat.Session.KinesisClient(), beat.Manager)
+			run(func() { consumer.Monitor(beat.ctx) })
+		}
+	case cwl.FirehoseInput:
+		receiver := cwl.NewFirehoseReceiver(beat.Manager)
+		run(func() {
+			if err := receiver.ListenAndServe(beat.ctx); err != nil {
+				logp.Critical("firehose: %s", err.Error())
+			}
+		})
+	case cwl.S3ExportInput:
+		// the export is ingested once; the beat stops when done
+		ingester := cwl.NewExportIngester(beat.Session.S3Client(), beat.Manager)
+		err := ingester.Run(beat.ctx)
+		if err == nil {
+			beat.waitForAcks(ingester)
+		}
+		beat.Params.Publisher.Close()
+		return err
+	default:
+		run(func() { beat.Manager.Monitor(beat.ctx) })
+	}
+	<-beat.ctx.Done()
+
+	// let the monitors drain their multiline buffers for up to
+	// shutdown_timeout, then close the publisher which waits for the
+	// remaining acknowledgements so that the final registry entries are
+	// written
+	logp.Info("cloudwatchlogsbeat is stopping")
+	stopped := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(beat.Params.Config.ShutdownTimeout):
+		logp.Warn("cloudwatchlogsbeat: timed out waiting for the monitors to stop")
+	}
+	beat.Params.Publisher.Close()
 	return nil
 }
 
-// Stops beat client
+// Waits until the events of the ingested export objects have been
+// acknowledged or the beat is stopped
+func (beat *Cloudwatchlogsbeat) waitForAcks(ingester *cwl.ExportIngester) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for ingester.Pending() > 0 {
+		select {
+		case <-beat.ctx.Done():
+			logp.Warn("export: stopped with %d objects pending acknowledgement", ingester.Pending())
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stops the beat; Run returns once the monitors have drained
 func (beat *Cloudwatchlogsbeat) Stop() {
-	beat.Params.Publisher.Close()
-	close(beat.Done)
+	beat.cancel()
 }
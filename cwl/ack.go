@@ -0,0 +1,126 @@
+package cwl
+
+import (
+	"sync"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+)
+
+// An eventBatch holds the events published by a single poll of a stream
+// (or group) together with the registry item that can be committed once
+// all of them have been acknowledged by the beat pipeline
+type eventBatch struct {
+	queue     *batchQueue
+	item      interface{}
+	published int  // number of events published in the batch
+	acked     int  // number of events acknowledged so far
+	sealed    bool // true when no more events will be added to the batch
+}
+
+func (batch *eventBatch) done() bool {
+	return batch.sealed && batch.acked == batch.published
+}
+
+// Adds a single event to the batch
+func (batch *eventBatch) add() {
+	batch.queue.lock.Lock()
+	batch.published++
+	batch.queue.lock.Unlock()
+}
+
+// Acknowledges a single event of the batch and commits the queue's
+// registry item if possible
+func (batch *eventBatch) ack() {
+	queue := batch.queue
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	batch.acked++
+	if err := queue.commit(); err != nil {
+		logp.Err("registry: failed to write a checkpoint, retrying on the next commit [%s]", err.Error())
+	}
+}
+
+// A batchQueue keeps the batches whose registry items are waiting for the
+// pipeline's acknowledgement; batches are committed in the order in which
+// they have been created
+type batchQueue struct {
+	lock    sync.Mutex
+	pending []*eventBatch
+	failed  []interface{}                // items whose write failed
+	write   func(item interface{}) error // writes an item to the registry
+	// writes the item of every committed batch instead of the latest one,
+	// for queues whose items do not supersede each other
+	writeAll bool
+}
+
+func (queue *batchQueue) newBatch() *eventBatch {
+	batch := &eventBatch{queue: queue}
+	queue.lock.Lock()
+	queue.pending = append(queue.pending, batch)
+	queue.lock.Unlock()
+	return batch
+}
+
+// Marks the batch as complete; the item will be written to the registry as
+// soon as the batch and all of its predecessors have been acknowledged
+func (queue *batchQueue) seal(batch *eventBatch, item interface{}) error {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	batch.item = item
+	batch.sealed = true
+	return queue.commit()
+}
+
+// Removes all the completed batches from the head of the queue and writes
+// the registry item of the latest one (or of all of them if writeAll is
+// set). The items that fail to be written are retried by the next commit
+// that removes a batch, unless a newer item supersedes them. Must be called
+// with the lock held.
+func (queue *batchQueue) commit() error {
+	items := queue.failed
+	committed := false
+	for len(queue.pending) > 0 && queue.pending[0].done() {
+		if !queue.writeAll {
+			items = items[:0]
+		}
+		items = append(items, queue.pending[0].item)
+		queue.pending = queue.pending[1:]
+		committed = true
+	}
+	if !committed {
+		return nil
+	}
+	queue.failed = nil
+	var err error
+	for _, item := range items {
+		if item == nil {
+			continue
+		}
+		if writeErr := queue.write(item); writeErr != nil {
+			queue.failed = append(queue.failed, item)
+			if err == nil {
+				err = writeErr
+			}
+		}
+	}
+	return err
+}
+
+// Returns the number of batches whose registry item has not been committed
+// (or written)
+func (queue *batchQueue) size() int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return len(queue.pending) + len(queue.failed)
+}
+
+// Handles the acknowledgements of the beat pipeline. It is meant to be
+// used as the callback of libbeat's acker.EventPrivateReporter, given that
+// every published event carries its batch as private data.
+func AckEvents(acked int, private []interface{}) {
+	for _, data := range private {
+		if batch, ok := data.(*eventBatch); ok && batch != nil {
+			batch.ack()
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package cwl
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func stubGetLogEvents(client *MockCWLClient, token string, messages ...string) {
+	events := []*cloudwatchlogs.OutputLogEvent{}
+	for _, message := range messages {
+		events = append(events, CreateOutputLogEvent(message))
+	}
+	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).Return(
+		&cloudwatchlogs.GetLogEventsOutput{
+			Events:           events,
+			NextForwardToken: aws.String(token),
+		}, nil).Once()
+}
+
+func ackPrivate(events []*Event) []interface{} {
+	private := []interface{}{}
+	for _, event := range events {
+		private = append(private, event.batch)
+	}
+	return private
+}
+
+func Test_Ack_RegistryIsNotWritten_UntilAllEventsAreAcked(t *testing.T) {
+	registry := NewDummyRegistry().(*DummyRegistry)
+	client := &MockCWLClient{}
+	stubGetLogEvents(client, "token1", "Event 1\n", "Event 2\n")
+	publisher, events := CreateCollectingPublisher(false)
+	params := &Params{Config: &Config{}, Registry: registry, AWSClient: client, Publisher: publisher}
+	group := &Group{Name: "group", Prospector: &Prospector{}}
+	stream := NewStream("stream", group, nil, make(chan bool), params)
+	// go!
+	stream.Next()
+	// assert
+	assert.Equal(t, 2, len(*events))
+	_, ok := registry.entries["group/stream"]
+	assert.False(t, ok)
+
+	AckEvents(1, ackPrivate((*events)[:1]))
+	_, ok = registry.entries["group/stream"]
+	assert.False(t, ok)
+
+	AckEvents(1, ackPrivate((*events)[1:]))
+	item, ok := registry.entries["group/stream"]
+	assert.True(t, ok)
+	assert.Equal(t, "token1", item.NextToken)
+	assert.Equal(t, 0, stream.acks.size())
+}
+
+func Test_Ack_BatchWithoutEvents_IsCommittedAfterItsPredecessors(t *testing.T) {
+	registry := NewDummyRegistry().(*DummyRegistry)
+	client := &MockCWLClient{}
+	stubGetLogEvents(client, "token1", "line\n", "END\n")
+	// the second batch buffers its line without publishing anything
+	stubGetLogEvents(client, "token2", "partial line\n")
+	publisher, events := CreateCollectingPublisher(false)
+	params := &Params{Config: &Config{}, Registry: registry, AWSClient: client, Publisher: publisher}
+	group := &Group{Name: "group", Prospector: &Prospector{}}
+	stream := NewStream("stream", group, nil, make(chan bool), params)
+	stream.multiline = &Multiline{Pattern: "^END", Negate: true, Match: "before"}
+	stream.multiRegex = regexp.MustCompile(stream.multiline.Pattern)
+	// go!
+	stream.Next()
+	stream.Next()
+	// assert
+	assert.Equal(t, 1, len(*events))
+	assert.Equal(t, 2, stream.acks.size())
+
+	AckEvents(1, ackPrivate(*events))
+	item := registry.entries["group/stream"]
+	assert.Equal(t, "token2", item.NextToken)
+	assert.Equal(t, "partial line\n", item.Buffer)
+	assert.Equal(t, 0, stream.acks.size())
+}
+
+func Test_Ack_AckEvents_IgnoresForeignPrivateData(t *testing.T) {
+	AckEvents(3, []interface{}{nil, "whatever", (*eventBatch)(nil)})
+}
+
+func Test_Ack_FailedWrites_AreRetriedByTheNextCommit(t *testing.T) {
+	testCases := []struct {
+		writeAll bool
+		written  []interface{}
+	}{
+		// the newer item supersedes the failed one
+		{false, []interface{}{"item 2"}},
+		{true, []interface{}{"item 1", "item 2"}},
+	}
+	for _, testCase := range testCases {
+		written := []interface{}{}
+		failing := true
+		queue := &batchQueue{
+			write: func(item interface{}) error {
+				if failing {
+					return errors.New("throttled")
+				}
+				written = append(written, item)
+				return nil
+			},
+			writeAll: testCase.writeAll,
+		}
+		batch := queue.newBatch()
+		batch.add()
+		assert.Nil(t, queue.seal(batch, "item 1"))
+		// go!
+		AckEvents(1, []interface{}{batch})
+		assert.Equal(t, 1, queue.size())
+		failing = false
+		err := queue.seal(queue.newBatch(), "item 2")
+		// assert
+		assert.Nil(t, err)
+		assert.Equal(t, testCase.written, written, testCase)
+		assert.Equal(t, 0, queue.size())
+	}
+}
@@ -3,11 +3,17 @@ package cwl
 import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sts"
 )
 
 type AwsSession struct {
@@ -23,6 +29,29 @@ func NewAwsSession(awsRegion string) *AwsSession {
 	}
 }
 
+// Returns a session whose credentials are obtained by assuming the role
+// with the session's credentials; they are refreshed before they expire
+func (sess *AwsSession) AssumeRole(roleArn string, externalId string, sessionName string) *AwsSession {
+	credentials := stscreds.NewCredentials(sess.session, roleArn, func(provider *stscreds.AssumeRoleProvider) {
+		provider.RoleSessionName = sessionName
+		if externalId != "" {
+			provider.ExternalID = aws.String(externalId)
+		}
+	})
+	return &AwsSession{
+		session: sess.session.Copy(&aws.Config{Credentials: credentials}),
+	}
+}
+
+// Returns the id of the account of the session's credentials
+func (sess *AwsSession) AccountId() (string, error) {
+	output, err := sts.New(sess.session).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(output.Account), nil
+}
+
 func (sess *AwsSession) CloudWatchLogsClient() cloudwatchlogsiface.CloudWatchLogsAPI {
 	return cloudwatchlogs.New(sess.session)
 }
@@ -30,3 +59,11 @@ func (sess *AwsSession) CloudWatchLogsClient() cloudwatchlogsiface.CloudWatchLog
 func (sess *AwsSession) S3Client() s3iface.S3API {
 	return s3.New(sess.session)
 }
+
+func (sess *AwsSession) DynamoDBClient() dynamodbiface.DynamoDBAPI {
+	return dynamodb.New(sess.session)
+}
+
+func (sess *AwsSession) KinesisClient() kinesisiface.KinesisAPI {
+	return kinesis.New(sess.session)
+}
@@ -20,12 +20,63 @@ func (registry *MockRegistry) ReadStreamInfo(stream *Stream) error {
 	return err
 }
 
-func (registry *MockRegistry) WriteStreamInfo(stream *Stream) error {
+func (registry *MockRegistry) WriteStreamInfo(stream *Stream, item *RegistryItem) error {
+	args := registry.Called(stream, item)
+	err, _ := args.Get(0).(error)
+	return err
+}
+
+func (registry *MockRegistry) DeleteStreamInfo(stream *Stream) error {
 	args := registry.Called(stream)
 	err, _ := args.Get(0).(error)
 	return err
 }
 
+func (registry *MockRegistry) ReadGroupInfo(group *Group) (*GroupRegistryItem, error) {
+	args := registry.Called(group)
+	item, _ := args.Get(0).(*GroupRegistryItem)
+	err, _ := args.Get(1).(error)
+	return item, err
+}
+
+func (registry *MockRegistry) WriteGroupInfo(group *Group, item *GroupRegistryItem) error {
+	args := registry.Called(group, item)
+	err, _ := args.Get(0).(error)
+	return err
+}
+
+func (registry *MockRegistry) DeleteGroupInfo(group *Group) error {
+	args := registry.Called(group)
+	err, _ := args.Get(0).(error)
+	return err
+}
+
+func (registry *MockRegistry) ReadShardInfo(shard *Shard) (*ShardRegistryItem, error) {
+	args := registry.Called(shard)
+	item, _ := args.Get(0).(*ShardRegistryItem)
+	err, _ := args.Get(1).(error)
+	return item, err
+}
+
+func (registry *MockRegistry) WriteShardInfo(shard *Shard, item *ShardRegistryItem) error {
+	args := registry.Called(shard, item)
+	err, _ := args.Get(0).(error)
+	return err
+}
+
+func (registry *MockRegistry) ReadExportInfo(object *ExportObject) (*ExportRegistryItem, error) {
+	args := registry.Called(object)
+	item, _ := args.Get(0).(*ExportRegistryItem)
+	err, _ := args.Get(1).(error)
+	return item, err
+}
+
+func (registry *MockRegistry) WriteExportInfo(object *ExportObject, item *ExportRegistryItem) error {
+	args := registry.Called(object, item)
+	err, _ := args.Get(0).(error)
+	return err
+}
+
 // Our mock AWS CloudWatchLogs client
 type MockCWLClient struct {
 	mock.Mock
@@ -47,16 +98,62 @@ func (client *MockCWLClient) DescribeLogStreamsPages(input *cloudwatchlogs.Descr
 	return err
 }
 
+func (client *MockCWLClient) DescribeLogGroupsPages(input *cloudwatchlogs.DescribeLogGroupsInput,
+	f func(*cloudwatchlogs.DescribeLogGroupsOutput, bool) bool) error {
+
+	args := client.Called(input, f)
+	err, _ := args.Get(0).(error)
+	return err
+}
+
+func (client *MockCWLClient) ListTagsLogGroup(input *cloudwatchlogs.ListTagsLogGroupInput) (*cloudwatchlogs.ListTagsLogGroupOutput, error) {
+	args := client.Called(input)
+	output, _ := args.Get(0).(*cloudwatchlogs.ListTagsLogGroupOutput)
+	err, _ := args.Get(1).(error)
+	return output, err
+}
+
+func (client *MockCWLClient) FilterLogEventsPages(input *cloudwatchlogs.FilterLogEventsInput,
+	f func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool) error {
+
+	args := client.Called(input, f)
+	err, _ := args.Get(0).(error)
+	return err
+}
+
+func (client *MockCWLClient) DescribeExportTasks(input *cloudwatchlogs.DescribeExportTasksInput) (*cloudwatchlogs.DescribeExportTasksOutput, error) {
+	args := client.Called(input)
+	output, _ := args.Get(0).(*cloudwatchlogs.DescribeExportTasksOutput)
+	err, _ := args.Get(1).(error)
+	return output, err
+}
+
 // our mock publisher
 type MockPublisher struct {
 	mock.Mock
 	EventPublisher
 }
 
-func (publisher MockPublisher) Publish(event *Event) {
+func (publisher *MockPublisher) Publish(event *Event) {
 	publisher.Called(event)
 }
 
+// creates a publisher that collects the published events in the returned
+// slice and acknowledges them immediately if ack is true
+func CreateCollectingPublisher(ack bool) (*MockPublisher, *[]*Event) {
+	events := []*Event{}
+	publisher := &MockPublisher{}
+	publisher.On("Publish", mock.AnythingOfType("*cwl.Event")).Return().Run(
+		func(args mock.Arguments) {
+			event := args.Get(0).(*Event)
+			events = append(events, event)
+			if ack {
+				AckEvents(1, []interface{}{event.batch})
+			}
+		})
+	return publisher, &events
+}
+
 // helper function for creating Events
 func CreateOutputLogEvent(message string) *cloudwatchlogs.OutputLogEvent {
 	return CreateOutputLogEventWithTimestamp(message, time.Now().Unix())
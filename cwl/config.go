@@ -4,28 +4,195 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"strings"
 	"time"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+)
+
+// Multiline types, as in Filebeat: "pattern" (the default) groups the
+// lines by the pattern and match settings, ending the events early at
+// lines matching flush_pattern; "count" groups every count_lines lines;
+// "while_pattern" groups consecutive lines that match the pattern. Besides,
+// "key" groups the lines by the correlation key captured by key_pattern
+// (e.g. the lambda request id) until a line matches flush_pattern or the
+// timeout expires.
+const (
+	MultilinePattern      = "pattern"
+	MultilineCount        = "count"
+	MultilineWhilePattern = "while_pattern"
+	MultilineKey          = "key"
 )
 
 type Multiline struct {
-	Pattern string
-	Negate  bool
-	Match   string
+	Type         string `config:"type"`
+	Pattern      string
+	Negate       bool
+	Match        string
+	FlushPattern string `config:"flush_pattern"`
+	CountLines   int    `config:"count_lines"`
+	KeyPattern   string `config:"key_pattern"`
+	// how long after its first line an incomplete event is published as
+	// it is (zero never times out)
+	Timeout time.Duration
+	// the lines and bytes of an event beyond which it is truncated (zero
+	// is unlimited)
+	MaxLines int `config:"max_lines"`
+	MaxBytes int `config:"max_bytes"`
 }
 
+// Prospector modes: in "stream" mode (the default) every stream of a group
+// is polled separately using GetLogEvents, while in "group" mode the whole
+// group is polled using FilterLogEvents
+const (
+	StreamMode = "stream"
+	GroupMode  = "group"
+)
+
+// Start positions of the streams (and groups in group mode) that have no
+// registry entry: "beginning" reads all their events, "end" only the events
+// added after the beat started; an RFC3339 timestamp is also accepted.
+// By default, they are read from stream_event_horizon.
+const (
+	StartPositionBeginning = "beginning"
+	StartPositionEnd       = "end"
+)
+
+// Parsers: "lambda" parses the platform lines of lambda functions (START,
+// END and REPORT) into the fields of their invocations
+const LambdaParser = "lambda"
+
 type Prospector struct {
 	Id         string     `config:"id"`
 	GroupNames []string   `config:"groupnames"`
 	Multiline  *Multiline `config:"multiline"`
+	Mode       string     `config:"mode"`
+	// the groups matched by the group names that are not monitored
+	ExcludeGroupNames []string `config:"exclude_groupnames"`
+	// only the groups with all these tags are monitored; if there are no
+	// group names, all the groups of the account are looked up
+	GroupTags map[string]string `config:"group_tags"`
+	// only the streams whose names start with the prefix, match any of the
+	// include expressions (if any) and none of the exclude expressions are
+	// monitored
+	StreamPrefix  string   `config:"stream_prefix"`
+	StreamInclude []string `config:"stream_include"`
+	StreamExclude []string `config:"stream_exclude"`
+	// the regions of the log groups (default: the top-level regions)
+	Regions []string `config:"regions"`
+	// the role assumed to read the log groups of another account
+	RoleArn     string `config:"role_arn"`
+	ExternalId  string `config:"external_id"`
+	SessionName string `config:"session_name"`
+	// a CloudWatch Logs filter pattern; only matching events are published
+	FilterPattern string `config:"filter_pattern"`
+	// group mode only: how far back each poll looks for late events
+	// (default: DefaultFilterLookback)
+	FilterLookback *time.Duration `config:"filter_lookback"`
+	// where the streams without a registry entry are read from
+	StartPosition string `config:"start_position"`
+	// the parser of the events' messages into structured fields
+	Parser string `config:"parser"`
+	// overrides of the top-level horizons and refresh frequencies
+	HotStreamEventHorizon          *time.Duration `config:"hot_stream_event_horizon"`
+	HotStreamEventRefreshFrequency *time.Duration `config:"hot_stream_event_refresh_frequency"`
+	StreamEventHorizon             *time.Duration `config:"stream_event_horizon"`
+	StreamEventRefreshFrequency    *time.Duration `config:"stream_event_refresh_frequency"`
+	StreamRefreshFrequency         *time.Duration `config:"stream_refresh_frequency"`
+}
+
+// the session name of assumed roles if none is configured
+const DefaultRoleSessionName = "cloudwatchlogsbeat"
+
+// Returns the id of the account whose log groups are read by the
+// prospector, which is empty unless a role is assumed
+func (prospector *Prospector) AccountId() string {
+	if prospector.RoleArn == "" {
+		return ""
+	}
+	parsed, err := arn.Parse(prospector.RoleArn)
+	if err != nil {
+		return ""
+	}
+	return parsed.AccountID
 }
 
+// how far back each poll of group mode looks for late events if the
+// prospector has no filter_lookback
+const DefaultFilterLookback = 30 * time.Second
+
+func (prospector *Prospector) filterLookback() time.Duration {
+	if prospector.FilterLookback == nil {
+		return DefaultFilterLookback
+	}
+	return *prospector.FilterLookback
+}
+
+// when the beat started, which is the start position "end"
+var startedAt = time.Now()
+
+// Returns the time (in milliseconds since 1970) from which the streams
+// without a registry entry are read, which is zero for their beginning
+func (prospector *Prospector) startTime(horizon time.Duration) int64 {
+	switch prospector.StartPosition {
+	case StartPositionBeginning:
+		return 0
+	case StartPositionEnd:
+		return startedAt.UnixNano() / 1e6
+	case "":
+		return time.Now().UTC().Add(-horizon).UnixNano() / 1e6
+	}
+	// validated by Config.Validate
+	startTime, _ := time.Parse(time.RFC3339, prospector.StartPosition)
+	return startTime.UnixNano() / 1e6
+}
+
+// Inputs: the beat either polls the log groups using the CloudWatch Logs
+// API, consumes the events delivered by subscription filters or ingests
+// the objects of S3 export tasks once
+const (
+	CloudWatchLogsInput = "cloudwatchlogs"
+	KinesisInput        = "kinesis"
+	FirehoseInput       = "firehose"
+	S3ExportInput       = "s3export"
+)
+
 type Config struct {
-	S3BucketName           string        `config:"s3_bucket_name"`
-	S3KeyPrefix            string        `config:"s3_key_prefix"`
-	GroupRefreshFrequency  time.Duration `config:"group_refresh_frequency"`
-	StreamRefreshFrequency time.Duration `config:"stream_refresh_frequency"`
-	ReportFrequency        time.Duration `config:"report_frequency"`
-	AWSRegion              string        `config:"aws_region"`
+	Input                     string        `config:"input"`
+	Registry                  string        `config:"registry"`
+	RegistryPath              string        `config:"registry_path"`
+	S3BucketName              string        `config:"s3_bucket_name"`
+	S3KeyPrefix               string        `config:"s3_key_prefix"`
+	DynamoDBTableName         string        `config:"dynamodb_table_name"`
+	CleanupRegistry           bool          `config:"cleanup_registry"`
+	GroupRefreshFrequency     time.Duration `config:"group_refresh_frequency"`
+	StreamRefreshFrequency    time.Duration `config:"stream_refresh_frequency"`
+	GroupTagsRefreshFrequency time.Duration `config:"group_tags_refresh_frequency"`
+	ReportFrequency           time.Duration `config:"report_frequency"`
+	StreamWorkers             int           `config:"stream_workers"`
+	ShutdownTimeout           time.Duration `config:"shutdown_timeout"`
+	RetryInitialBackoff       time.Duration `config:"retry_initial_backoff"`
+	RetryMaxBackoff           time.Duration `config:"retry_max_backoff"`
+	AWSRegion                 string        `config:"aws_region"`
+	// the regions of the prospectors' log groups (default: aws_region)
+	Regions []string `config:"regions"`
+
+	// the rate limits of the CloudWatch Logs APIs by API
+	RateLimits map[string]*RateLimit `config:"rate_limits"`
+
+	KinesisStreamNames           []string      `config:"kinesis_stream_names"`
+	KinesisRefreshFrequency      time.Duration `config:"kinesis_refresh_frequency"`
+	KinesisShardRefreshFrequency time.Duration `config:"kinesis_shard_refresh_frequency"`
+
+	FirehoseAddress        string        `config:"firehose_address"`
+	FirehoseAccessKey      string        `config:"firehose_access_key"`
+	FirehoseAckTimeout     time.Duration `config:"firehose_ack_timeout"`
+	FirehoseSSLCertificate string        `config:"firehose_ssl_certificate"`
+	FirehoseSSLKey         string        `config:"firehose_ssl_key"`
+
+	ExportBucketName string `config:"export_bucket_name"`
+	ExportPrefix     string `config:"export_prefix"`
+	ExportGroupName  string `config:"export_group_name"`
 
 	HotStreamEventHorizon          time.Duration `config:"hot_stream_event_horizon"`
 	HotStreamEventRefreshFrequency time.Duration `config:"hot_stream_event_refresh_frequency"`
@@ -39,41 +206,281 @@ type Config struct {
 func DefaultConfig(awsRegion string) *Config {
 	return &Config{
 		GroupRefreshFrequency:       1 * time.Minute,
+		GroupTagsRefreshFrequency:   10 * time.Minute,
 		StreamRefreshFrequency:      20 * time.Second,
 		ReportFrequency:             1 * time.Minute,
+		StreamWorkers:               50,
+		ShutdownTimeout:             10 * time.Second,
+		RetryInitialBackoff:         1 * time.Second,
+		RetryMaxBackoff:             2 * time.Minute,
 		AWSRegion:                   awsRegion,
 		StreamEventHorizon:          10 * time.Minute,
 		StreamEventRefreshFrequency: 5 * time.Second,
+
+		KinesisRefreshFrequency:      1 * time.Second,
+		KinesisShardRefreshFrequency: 1 * time.Minute,
+
+		FirehoseAddress:    ":8080",
+		FirehoseAckTimeout: 30 * time.Second,
+
+		RateLimits: map[string]*RateLimit{
+			DescribeLogGroupsAPI:  {Rate: 5, Burst: 5},
+			DescribeLogStreamsAPI: {Rate: 5, Burst: 10},
+			GetLogEventsAPI:       {Rate: 10, Burst: 20},
+			FilterLogEventsAPI:    {Rate: 5, Burst: 10},
+			ListTagsLogGroupAPI:   {Rate: 5, Burst: 5},
+		},
 	}
 }
 
-func (config *Config) Validate() error {
+// Returns the effective config of a prospector, i.e. the config with the
+// prospector's horizons and refresh frequencies (if any) applied
+func (config *Config) ProspectorConfig(prospector *Prospector) *Config {
+	effective := *config
+	overrides := []struct {
+		value    *time.Duration
+		override *time.Duration
+	}{
+		{&effective.HotStreamEventHorizon, prospector.HotStreamEventHorizon},
+		{&effective.HotStreamEventRefreshFrequency, prospector.HotStreamEventRefreshFrequency},
+		{&effective.StreamEventHorizon, prospector.StreamEventHorizon},
+		{&effective.StreamEventRefreshFrequency, prospector.StreamEventRefreshFrequency},
+		{&effective.StreamRefreshFrequency, prospector.StreamRefreshFrequency},
+	}
+	for _, override := range overrides {
+		if override.override != nil {
+			*override.value = *override.override
+		}
+	}
+	return &effective
+}
+
+// Validates the horizons and the hot stream refresh frequency of a config
+// or of a prospector's effective config
+func (config *Config) validatePolling() error {
 	// validate host stream settings
 	if config.HotStreamEventHorizon > 0 && config.HotStreamEventRefreshFrequency == 0 {
 		return errors.New(
 			fmt.Sprintf("HotStreamEventRefreshFrequency can not be zero while HotStreamEventHorizon=%v", config.HotStreamEventHorizon))
 	}
+	if config.HotStreamEventHorizon < 0 || config.StreamEventHorizon < 0 {
+		return errors.New("Configuration: event horizons can not be negative")
+	}
+	if config.HotStreamEventRefreshFrequency < 0 {
+		return errors.New("Configuration: hot_stream_event_refresh_frequency can not be negative")
+	}
+	return nil
+}
+
+func (config *Config) Validate() error {
+	if err := config.validatePolling(); err != nil {
+		return err
+	}
+	// validate the prospectors' overrides against their effective configs
+	for i := range config.Prospectors {
+		prospector := &config.Prospectors[i]
+		for name, frequency := range map[string]*time.Duration{
+			"stream_event_refresh_frequency": prospector.StreamEventRefreshFrequency,
+			"stream_refresh_frequency":       prospector.StreamRefreshFrequency,
+		} {
+			if frequency != nil && *frequency <= 0 {
+				return errors.New(
+					fmt.Sprintf("Configuration: %s of prospector %s must be positive", name, prospector.Id))
+			}
+		}
+		if prospector.filterLookback() < 0 {
+			return errors.New(
+				fmt.Sprintf("Configuration: filter_lookback of prospector %s can not be negative", prospector.Id))
+		}
+		if err := config.ProspectorConfig(prospector).validatePolling(); err != nil {
+			return errors.New(fmt.Sprintf("Configuration: prospector %s: %s", prospector.Id, err.Error()))
+		}
+	}
+	if config.StreamWorkers < 0 {
+		return errors.New("Configuration: stream_workers can not be negative")
+	}
+	// validate the retry settings
+	if config.RetryInitialBackoff <= 0 {
+		return errors.New("Configuration: retry_initial_backoff must be positive")
+	}
+	if config.RetryInitialBackoff > config.RetryMaxBackoff {
+		return errors.New(
+			fmt.Sprintf("Configuration: retry_initial_backoff=%v can not exceed retry_max_backoff=%v",
+				config.RetryInitialBackoff, config.RetryMaxBackoff))
+	}
+	// validate the rate limits
+	for api, limit := range config.RateLimits {
+		switch api {
+		case DescribeLogGroupsAPI, DescribeLogStreamsAPI, GetLogEventsAPI, FilterLogEventsAPI, ListTagsLogGroupAPI:
+		default:
+			return errors.New("Configuration: Invalid rate limited api: " + api)
+		}
+		if limit != nil && (limit.Rate < 0 || limit.Burst < 0) {
+			return errors.New("Configuration: rate limits can not be negative: " + api)
+		}
+	}
+	// validate the regions
+	regions := config.Regions
+	for _, prospector := range config.Prospectors {
+		regions = append(regions[:len(regions):len(regions)], prospector.Regions...)
+	}
+	for _, region := range regions {
+		if region == "" {
+			return errors.New("Configuration: regions can not be empty")
+		}
+	}
+	if len(regions) > 0 && config.Input != "" && config.Input != CloudWatchLogsInput {
+		return errors.New("Configuration: regions are only supported by the cloudwatchlogs input")
+	}
+	// validate the assumed roles
+	for _, prospector := range config.Prospectors {
+		if prospector.RoleArn == "" {
+			if prospector.ExternalId != "" || prospector.SessionName != "" {
+				return errors.New("Configuration: external_id and session_name require role_arn")
+			}
+			continue
+		}
+		parsed, err := arn.Parse(prospector.RoleArn)
+		if err != nil || parsed.Service != "iam" || parsed.AccountID == "" || !strings.HasPrefix(parsed.Resource, "role/") {
+			return errors.New("Configuration: Invalid role_arn: " + prospector.RoleArn)
+		}
+		if config.Input != "" && config.Input != CloudWatchLogsInput {
+			return errors.New("Configuration: role_arn is only supported by the cloudwatchlogs input")
+		}
+	}
+	// validate the input settings
+	switch config.Input {
+	case "", CloudWatchLogsInput:
+	case KinesisInput:
+		if len(config.KinesisStreamNames) == 0 {
+			return errors.New("Configuration: kinesis_stream_names is required for the kinesis input")
+		}
+	case FirehoseInput:
+		if (config.FirehoseSSLCertificate == "") != (config.FirehoseSSLKey == "") {
+			return errors.New("Configuration: firehose_ssl_certificate and firehose_ssl_key must be set together")
+		}
+		// the firehose input keeps no state, so incomplete multiline
+		// events would be lost once their deliveries are acknowledged
+		for _, prospector := range config.Prospectors {
+			if prospector.Multiline != nil {
+				return errors.New("Configuration: multiline is not supported by the firehose input")
+			}
+		}
+	case S3ExportInput:
+		if config.ExportBucketName == "" {
+			return errors.New("Configuration: export_bucket_name is required for the s3export input")
+		}
+	default:
+		return errors.New("Configuration: Invalid input: " + config.Input)
+	}
+	// validate the registry settings
+	switch config.Registry {
+	case "", "memory", "file":
+	case "s3":
+		if config.S3BucketName == "" {
+			return errors.New("Configuration: s3_bucket_name is required for the s3 registry")
+		}
+	case "dynamodb":
+		if config.DynamoDBTableName == "" {
+			return errors.New("Configuration: dynamodb_table_name is required for the dynamodb registry")
+		}
+	default:
+		return errors.New("Configuration: Invalid registry type: " + config.Registry)
+	}
 	for _, prospector := range config.Prospectors {
 		err := ValidateMultiline(prospector.Multiline)
 		if err != nil {
 			return err
 		}
+		for _, patterns := range [][]string{prospector.GroupNames, prospector.ExcludeGroupNames} {
+			for _, pattern := range patterns {
+				if _, err := CompileGroupNamePattern(pattern); err != nil {
+					return err
+				}
+			}
+		}
+		for _, expressions := range [][]string{prospector.StreamInclude, prospector.StreamExclude} {
+			if _, err := compileRegexes(expressions); err != nil {
+				return errors.New("Configuration: Invalid stream filter: " + err.Error())
+			}
+		}
+		switch prospector.Mode {
+		case "", StreamMode, GroupMode:
+		default:
+			return errors.New("Configuration: Invalid prospector mode: " + prospector.Mode)
+		}
+		switch prospector.Parser {
+		case "", LambdaParser:
+		default:
+			return errors.New("Configuration: Invalid prospector parser: " + prospector.Parser)
+		}
+		switch prospector.StartPosition {
+		case "", StartPositionBeginning, StartPositionEnd:
+		default:
+			if _, err := time.Parse(time.RFC3339, prospector.StartPosition); err != nil {
+				return errors.New("Configuration: Invalid start_position: " + prospector.StartPosition)
+			}
+		}
+		// the pattern may be evaluated by CloudWatch Logs instead
+		if prospector.FilterPattern != "" && !config.pushesDownFilter(&prospector) {
+			if _, err := CompileFilterPattern(prospector.FilterPattern); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
+// Returns true if the events of the prospector's groups are fetched using
+// FilterLogEvents, which evaluates the filter pattern itself; the events
+// of the other inputs and modes are filtered locally
+func (config *Config) pushesDownFilter(prospector *Prospector) bool {
+	return prospector.Mode == GroupMode && (config.Input == "" || config.Input == CloudWatchLogsInput)
+}
+
+// Returns the regions of the prospector's log groups
+func (config *Config) ProspectorRegions(prospector *Prospector) []string {
+	if len(prospector.Regions) > 0 {
+		return prospector.Regions
+	}
+	if len(config.Regions) > 0 {
+		return config.Regions
+	}
+	return []string{config.AWSRegion}
+}
+
 func (config *Config) String() string {
 	return "settings: " +
-		fmt.Sprintf("s3_bucket_name=%s", config.S3BucketName) +
+		fmt.Sprintf("input=%s", config.Input) +
+		fmt.Sprintf("|registry=%s", config.Registry) +
+		fmt.Sprintf("|registry_path=%s", config.RegistryPath) +
+		fmt.Sprintf("|s3_bucket_name=%s", config.S3BucketName) +
 		fmt.Sprintf("|s3_key_prefix=%s", config.S3KeyPrefix) +
+		fmt.Sprintf("|dynamodb_table_name=%s", config.DynamoDBTableName) +
+		fmt.Sprintf("|cleanup_registry=%v", config.CleanupRegistry) +
 		fmt.Sprintf("|aws_region=%v", config.AWSRegion) +
+		fmt.Sprintf("|regions=%v", config.Regions) +
 		fmt.Sprintf("|group_refresh_frequency=%v", config.GroupRefreshFrequency) +
 		fmt.Sprintf("|stream_refresh_frequency=%v", config.StreamRefreshFrequency) +
+		fmt.Sprintf("|group_tags_refresh_frequency=%v", config.GroupTagsRefreshFrequency) +
 		fmt.Sprintf("|report_frequency=%v", config.ReportFrequency) +
+		fmt.Sprintf("|stream_workers=%d", config.StreamWorkers) +
+		fmt.Sprintf("|shutdown_timeout=%v", config.ShutdownTimeout) +
+		fmt.Sprintf("|retry_initial_backoff=%v", config.RetryInitialBackoff) +
+		fmt.Sprintf("|retry_max_backoff=%v", config.RetryMaxBackoff) +
+		fmt.Sprintf("|rate_limits=%v", config.RateLimits) +
 		fmt.Sprintf("|stream_event_horizon=%v", config.StreamEventHorizon) +
 		fmt.Sprintf("|stream_event_refresh_frequency=%v", config.StreamEventRefreshFrequency) +
 		fmt.Sprintf("|hot_stream_event_horizon=%v", config.HotStreamEventHorizon) +
-		fmt.Sprintf("|hot_stream_event_refresh_frequency=%v", config.HotStreamEventRefreshFrequency)
+		fmt.Sprintf("|hot_stream_event_refresh_frequency=%v", config.HotStreamEventRefreshFrequency) +
+		fmt.Sprintf("|kinesis_stream_names=%v", config.KinesisStreamNames) +
+		fmt.Sprintf("|kinesis_refresh_frequency=%v", config.KinesisRefreshFrequency) +
+		fmt.Sprintf("|kinesis_shard_refresh_frequency=%v", config.KinesisShardRefreshFrequency) +
+		fmt.Sprintf("|firehose_address=%s", config.FirehoseAddress) +
+		fmt.Sprintf("|firehose_ack_timeout=%v", config.FirehoseAckTimeout) +
+		fmt.Sprintf("|export_bucket_name=%s", config.ExportBucketName) +
+		fmt.Sprintf("|export_prefix=%s", config.ExportPrefix) +
+		fmt.Sprintf("|export_group_name=%s", config.ExportGroupName)
 }
 
 // Validates a multiline configuration section
@@ -82,19 +489,58 @@ func ValidateMultiline(multiline *Multiline) error {
 		return nil
 	}
 
-	// Check if valid regular expression for multiline
-	_, err := regexp.Compile(multiline.Pattern)
-	if err != nil {
-		return err
-	}
-
-	// Check match mode
-	match := multiline.Match
-	switch match {
-	case "after":
-	case "before":
+	switch multiline.Type {
+	case "", MultilinePattern:
+		// Check if valid regular expression for multiline
+		if _, err := regexp.Compile(multiline.Pattern); err != nil {
+			return err
+		}
+		if _, err := regexp.Compile(multiline.FlushPattern); err != nil {
+			return err
+		}
+		// Check match mode
+		match := multiline.Match
+		switch match {
+		case "after":
+		case "before":
+		default:
+			return errors.New("Configuration: Invalid match type in multiline mode: " + match)
+		}
+	case MultilineCount:
+		if multiline.CountLines <= 0 {
+			return errors.New("Configuration: multiline count_lines must be positive")
+		}
+	case MultilineWhilePattern:
+		if multiline.Pattern == "" {
+			return errors.New("Configuration: multiline pattern is required by while_pattern")
+		}
+		if _, err := regexp.Compile(multiline.Pattern); err != nil {
+			return err
+		}
+	case MultilineKey:
+		regex, err := regexp.Compile(multiline.KeyPattern)
+		if err != nil {
+			return err
+		}
+		if regex.NumSubexp() == 0 {
+			return errors.New("Configuration: multiline key_pattern must capture the key in a group")
+		}
+		// keys whose flush line never comes would stay buffered (and
+		// recorded in the registry) forever
+		if multiline.Timeout <= 0 {
+			return errors.New("Configuration: multiline timeout is required by the key type")
+		}
+		if _, err := regexp.Compile(multiline.FlushPattern); err != nil {
+			return err
+		}
 	default:
-		return errors.New("Configuration: Invalid match type in multiline mode: " + match)
+		return errors.New("Configuration: Invalid multiline type: " + multiline.Type)
+	}
+	if multiline.Timeout < 0 {
+		return errors.New("Configuration: multiline timeout can not be negative")
+	}
+	if multiline.MaxLines < 0 || multiline.MaxBytes < 0 {
+		return errors.New("Configuration: multiline max_lines and max_bytes can not be negative")
 	}
 	return nil
 }
@@ -8,6 +8,13 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// sets the retry backoffs of a test config, which are required
+func withRetryBackoff(config *Config) *Config {
+	config.RetryInitialBackoff = time.Second
+	config.RetryMaxBackoff = time.Minute
+	return config
+}
+
 func Test_Config_TopLevel_Full(t *testing.T) {
 	content :=
 		`
@@ -20,8 +27,8 @@ aws_region: the-aws-region
 `
 	cfg, _ := common.NewConfigWithYAML([]byte(content), "test")
 
-	config := Config{}
-	cfg.Unpack(&config)
+	config := withRetryBackoff(&Config{})
+	cfg.Unpack(config)
 	assert.Equal(t, "the-bucket-name", config.S3BucketName)
 	assert.Equal(t, "testprefix/", config.S3KeyPrefix)
 	assert.Equal(t, time.Second, config.GroupRefreshFrequency)
@@ -29,3 +36,371 @@ aws_region: the-aws-region
 	assert.Equal(t, 1*time.Minute, config.ReportFrequency)
 	assert.Equal(t, "the-aws-region", config.AWSRegion)
 }
+
+func Test_Config_Validate_Registry(t *testing.T) {
+	testCases := []struct {
+		registry string
+		bucket   string
+		valid    bool
+	}{
+		{"", "", true},
+		{"memory", "", true},
+		{"file", "", true},
+		{"s3", "the-bucket-name", true},
+		{"s3", "", false},
+		{"dynamodb", "", false},
+		{"redis", "", false},
+	}
+
+	for _, testCase := range testCases {
+		config := withRetryBackoff(&Config{Registry: testCase.registry, S3BucketName: testCase.bucket})
+		assert.Equal(t, testCase.valid, config.Validate() == nil, testCase.registry)
+	}
+}
+
+func Test_Config_Validate_ProspectorMode(t *testing.T) {
+	testCases := []struct {
+		mode  string
+		valid bool
+	}{
+		{"", true},
+		{"stream", true},
+		{"group", true},
+		{"whatever", false},
+	}
+
+	for _, testCase := range testCases {
+		config := withRetryBackoff(&Config{Prospectors: []Prospector{{Mode: testCase.mode}}})
+		assert.Equal(t, testCase.valid, config.Validate() == nil, testCase.mode)
+	}
+}
+
+func Test_Config_Validate_FilterPattern(t *testing.T) {
+	testCases := []struct {
+		mode    string
+		pattern string
+		valid   bool
+	}{
+		{"", "?ERROR ?WARN", true},
+		{"", `{ $.level = "ERROR" }`, true},
+		{"", "[ip, user, ...]", false},
+		{"group", "[ip, user, ...]", true},
+	}
+
+	for _, testCase := range testCases {
+		config := withRetryBackoff(&Config{Prospectors: []Prospector{{Mode: testCase.mode, FilterPattern: testCase.pattern}}})
+		assert.Equal(t, testCase.valid, config.Validate() == nil, testCase.pattern)
+	}
+}
+
+func Test_Config_Validate_Input(t *testing.T) {
+	testCases := []struct {
+		input   string
+		streams []string
+		valid   bool
+	}{
+		{"", nil, true},
+		{"cloudwatchlogs", nil, true},
+		{"kinesis", []string{"the-stream"}, true},
+		{"kinesis", nil, false},
+		{"firehose", nil, true},
+		{"s3export", nil, false},
+		{"whatever", nil, false},
+	}
+
+	for _, testCase := range testCases {
+		config := withRetryBackoff(&Config{Input: testCase.input, KinesisStreamNames: testCase.streams})
+		assert.Equal(t, testCase.valid, config.Validate() == nil, testCase.input)
+	}
+}
+
+func Test_Config_Validate_FirehoseSSL(t *testing.T) {
+	testCases := []struct {
+		certificate string
+		key         string
+		valid       bool
+	}{
+		{"", "", true},
+		{"cert.pem", "key.pem", true},
+		{"cert.pem", "", false},
+		{"", "key.pem", false},
+	}
+
+	for _, testCase := range testCases {
+		config := withRetryBackoff(&Config{
+			Input:                  "firehose",
+			FirehoseSSLCertificate: testCase.certificate,
+			FirehoseSSLKey:         testCase.key,
+		})
+		assert.Equal(t, testCase.valid, config.Validate() == nil, testCase.certificate+"|"+testCase.key)
+	}
+}
+
+func Test_Config_Validate_FirehoseMultiline(t *testing.T) {
+	config := withRetryBackoff(&Config{
+		Input:       "firehose",
+		Prospectors: []Prospector{{Id: "multiline", Multiline: &Multiline{Pattern: "^[^ ]", Match: "after"}}},
+	})
+	assert.NotNil(t, config.Validate())
+	config.Input = "kinesis"
+	config.KinesisStreamNames = []string{"the_stream"}
+	assert.Nil(t, config.Validate())
+}
+
+func Test_Config_Validate_RetryBackoff(t *testing.T) {
+	config := DefaultConfig("eu-west-1")
+	assert.Nil(t, config.Validate())
+	config.RetryInitialBackoff = 5 * time.Minute
+	assert.NotNil(t, config.Validate())
+	config.RetryInitialBackoff = 0
+	assert.NotNil(t, config.Validate())
+}
+
+func Test_Config_Validate_StreamWorkers(t *testing.T) {
+	config := DefaultConfig("eu-west-1")
+	config.StreamWorkers = 0
+	assert.Nil(t, config.Validate())
+	config.StreamWorkers = -1
+	assert.NotNil(t, config.Validate())
+}
+
+func Test_Config_Validate_GroupNamePatterns(t *testing.T) {
+	testCases := []struct {
+		groupNames []string
+		excluded   []string
+		valid      bool
+	}{
+		{[]string{"/aws/lambda/*-prod-*"}, []string{"*-debug"}, true},
+		{[]string{"regex:^/aws/lambda/(api|web)$"}, nil, true},
+		{[]string{"regex:^/aws/(lambda"}, nil, false},
+		{[]string{"/aws/lambda/*"}, []string{"/aws/lambda/[debug"}, false},
+	}
+
+	for _, testCase := range testCases {
+		config := withRetryBackoff(&Config{Prospectors: []Prospector{{GroupNames: testCase.groupNames, ExcludeGroupNames: testCase.excluded}}})
+		assert.Equal(t, testCase.valid, config.Validate() == nil, testCase.groupNames)
+	}
+}
+
+func Test_Config_Validate_StreamFilters(t *testing.T) {
+	testCases := []struct {
+		include []string
+		exclude []string
+		valid   bool
+	}{
+		{[]string{`\[\$LATEST\]`}, []string{"debug"}, true},
+		{[]string{"[unterminated"}, nil, false},
+		{nil, []string{"(unterminated"}, false},
+	}
+
+	for _, testCase := range testCases {
+		config := withRetryBackoff(&Config{Prospectors: []Prospector{{StreamInclude: testCase.include, StreamExclude: testCase.exclude}}})
+		assert.Equal(t, testCase.valid, config.Validate() == nil, testCase)
+	}
+}
+
+func Test_Config_ProspectorRegions(t *testing.T) {
+	config := &Config{
+		AWSRegion: "eu-west-1",
+		Prospectors: []Prospector{
+			{Id: "default"},
+			{Id: "regional", Regions: []string{"us-east-1", "eu-west-1"}},
+		},
+	}
+	assert.Equal(t, []string{"eu-west-1"}, config.ProspectorRegions(&config.Prospectors[0]))
+	assert.Equal(t, []string{"us-east-1", "eu-west-1"}, config.ProspectorRegions(&config.Prospectors[1]))
+	config.Regions = []string{"ap-southeast-2"}
+	assert.Equal(t, []string{"ap-southeast-2"}, config.ProspectorRegions(&config.Prospectors[0]))
+}
+
+func Test_Config_Validate_Regions(t *testing.T) {
+	testCases := []struct {
+		input   string
+		regions []string
+		valid   bool
+	}{
+		{"", []string{"us-east-1"}, true},
+		{"cloudwatchlogs", []string{"us-east-1"}, true},
+		{"", []string{""}, false},
+		{"firehose", []string{"us-east-1"}, false},
+		{"firehose", nil, true},
+	}
+
+	for _, testCase := range testCases {
+		config := withRetryBackoff(&Config{Input: testCase.input, Prospectors: []Prospector{{Regions: testCase.regions}}})
+		assert.Equal(t, testCase.valid, config.Validate() == nil, testCase)
+	}
+}
+
+func Test_Prospector_AccountId(t *testing.T) {
+	assert.Equal(t, "", (&Prospector{}).AccountId())
+	assert.Equal(t, "123456789012", (&Prospector{RoleArn: "arn:aws:iam::123456789012:role/reader"}).AccountId())
+}
+
+func Test_Config_Validate_RoleArn(t *testing.T) {
+	testCases := []struct {
+		input      string
+		roleArn    string
+		externalId string
+		valid      bool
+	}{
+		{"", "arn:aws:iam::123456789012:role/reader", "", true},
+		{"", "arn:aws:iam::123456789012:role/path/reader", "secret", true},
+		{"", "", "secret", false},
+		{"", "arn:aws:iam::123456789012:user/reader", "", false},
+		{"", "arn:aws:iam:::role/reader", "", false},
+		{"", "reader", "", false},
+		{"firehose", "arn:aws:iam::123456789012:role/reader", "", false},
+	}
+
+	for _, testCase := range testCases {
+		config := withRetryBackoff(&Config{Input: testCase.input, Prospectors: []Prospector{{RoleArn: testCase.roleArn, ExternalId: testCase.externalId}}})
+		assert.Equal(t, testCase.valid, config.Validate() == nil, testCase)
+	}
+}
+
+func Test_Config_Validate_StartPosition(t *testing.T) {
+	testCases := []struct {
+		startPosition string
+		valid         bool
+	}{
+		{"", true},
+		{"beginning", true},
+		{"end", true},
+		{"2020-01-01T00:00:00Z", true},
+		{"2020-01-01T00:00:00+02:00", true},
+		{"2020-01-01", false},
+		{"now", false},
+	}
+
+	for _, testCase := range testCases {
+		config := withRetryBackoff(&Config{Prospectors: []Prospector{{StartPosition: testCase.startPosition}}})
+		assert.Equal(t, testCase.valid, config.Validate() == nil, testCase)
+	}
+}
+
+func Test_Prospector_StartTime(t *testing.T) {
+	assert.Equal(t, int64(0), (&Prospector{StartPosition: "beginning"}).startTime(time.Hour))
+	assert.Equal(t, startedAt.UnixNano()/1e6, (&Prospector{StartPosition: "end"}).startTime(time.Hour))
+	assert.Equal(t, int64(1577836800000), (&Prospector{StartPosition: "2020-01-01T00:00:00Z"}).startTime(time.Hour))
+	startTime := (&Prospector{}).startTime(time.Hour)
+	assert.InDelta(t, TimeBeforeNowInMilliseconds(time.Hour), startTime, 1000)
+}
+
+func Test_Config_ProspectorConfig_AppliesTheOverrides(t *testing.T) {
+	content :=
+		`
+stream_event_horizon: 1h
+stream_event_refresh_frequency: 10s
+hot_stream_event_horizon: 5m
+hot_stream_event_refresh_frequency: 1s
+prospectors:
+  - id: audit
+    stream_event_horizon: 168h
+    hot_stream_event_horizon: 0s
+  - id: lambda
+    hot_stream_event_refresh_frequency: 500ms
+    stream_refresh_frequency: 5s
+`
+	cfg, _ := common.NewConfigWithYAML([]byte(content), "test")
+
+	config := DefaultConfig("eu-west-1")
+	assert.Nil(t, cfg.Unpack(config))
+	assert.Nil(t, config.Validate())
+	audit := config.ProspectorConfig(&config.Prospectors[0])
+	assert.Equal(t, 168*time.Hour, audit.StreamEventHorizon)
+	assert.Equal(t, time.Duration(0), audit.HotStreamEventHorizon)
+	assert.Equal(t, 10*time.Second, audit.StreamEventRefreshFrequency)
+	lambda := config.ProspectorConfig(&config.Prospectors[1])
+	assert.Equal(t, time.Hour, lambda.StreamEventHorizon)
+	assert.Equal(t, 500*time.Millisecond, lambda.HotStreamEventRefreshFrequency)
+	assert.Equal(t, 5*time.Second, lambda.StreamRefreshFrequency)
+	// the top-level config is not modified
+	assert.Equal(t, time.Hour, config.StreamEventHorizon)
+	assert.Equal(t, 20*time.Second, config.StreamRefreshFrequency)
+}
+
+func Test_Config_Validate_ProspectorOverrides(t *testing.T) {
+	duration := func(d time.Duration) *time.Duration { return &d }
+	testCases := []struct {
+		prospector Prospector
+		valid      bool
+	}{
+		{Prospector{}, true},
+		{Prospector{StreamEventHorizon: duration(168 * time.Hour)}, true},
+		{Prospector{StreamEventHorizon: duration(-time.Hour)}, false},
+		{Prospector{HotStreamEventHorizon: duration(time.Minute)}, false},
+		{Prospector{HotStreamEventHorizon: duration(time.Minute), HotStreamEventRefreshFrequency: duration(time.Second)}, true},
+		{Prospector{StreamEventRefreshFrequency: duration(0)}, false},
+		{Prospector{StreamRefreshFrequency: duration(-time.Second)}, false},
+		{Prospector{StreamRefreshFrequency: duration(time.Second)}, true},
+		{Prospector{FilterLookback: duration(0)}, true},
+		{Prospector{FilterLookback: duration(-time.Second)}, false},
+	}
+
+	for _, testCase := range testCases {
+		config := withRetryBackoff(&Config{Prospectors: []Prospector{testCase.prospector}})
+		assert.Equal(t, testCase.valid, config.Validate() == nil, testCase)
+	}
+}
+
+func Test_Config_Validate_MultilineTypes(t *testing.T) {
+	testCases := []struct {
+		multiline Multiline
+		valid     bool
+	}{
+		{Multiline{Pattern: "^START", Match: "after"}, true},
+		{Multiline{Type: "pattern", Pattern: "^START", Match: "whatever"}, false},
+		{Multiline{Pattern: "^BEGIN", Match: "after", FlushPattern: "^END"}, true},
+		{Multiline{Pattern: "^BEGIN", Match: "after", FlushPattern: "(END"}, false},
+		{Multiline{Type: "count", CountLines: 3}, true},
+		{Multiline{Type: "count"}, false},
+		{Multiline{Type: "while_pattern", Pattern: `^\s`}, true},
+		{Multiline{Type: "while_pattern"}, false},
+		{Multiline{Type: "while_pattern", Pattern: "(at"}, false},
+		{Multiline{Type: "whatever"}, false},
+	}
+
+	for _, testCase := range testCases {
+		multiline := testCase.multiline
+		config := withRetryBackoff(&Config{Prospectors: []Prospector{{Multiline: &multiline}}})
+		assert.Equal(t, testCase.valid, config.Validate() == nil, testCase)
+	}
+}
+
+func Test_Config_Validate_MultilineKey(t *testing.T) {
+	testCases := []struct {
+		multiline Multiline
+		valid     bool
+	}{
+		{Multiline{Type: "key", KeyPattern: `RequestId: (\S+)`, FlushPattern: "^REPORT", Timeout: time.Minute}, true},
+		{Multiline{Type: "key", KeyPattern: `RequestId: (\S+)`, Timeout: time.Minute}, true},
+		{Multiline{Type: "key", KeyPattern: `RequestId: (\S+)`, FlushPattern: "^REPORT"}, false},
+		{Multiline{Type: "key", KeyPattern: `RequestId: (\S+)`}, false},
+		{Multiline{Type: "key", KeyPattern: `RequestId: \S+`, Timeout: time.Minute}, false},
+		{Multiline{Type: "key", KeyPattern: `RequestId: (\S+`, Timeout: time.Minute}, false},
+		{Multiline{Type: "key", KeyPattern: `RequestId: (\S+)`, FlushPattern: "(REPORT", Timeout: time.Minute}, false},
+	}
+
+	for _, testCase := range testCases {
+		multiline := testCase.multiline
+		config := withRetryBackoff(&Config{Prospectors: []Prospector{{Multiline: &multiline}}})
+		assert.Equal(t, testCase.valid, config.Validate() == nil, testCase)
+	}
+}
+
+func Test_Config_Validate_Parser(t *testing.T) {
+	testCases := []struct {
+		parser string
+		valid  bool
+	}{
+		{"", true},
+		{"lambda", true},
+		{"grok", false},
+	}
+
+	for _, testCase := range testCases {
+		config := withRetryBackoff(&Config{Prospectors: []Prospector{{Parser: testCase.parser}}})
+		assert.Equal(t, testCase.valid, config.Validate() == nil, testCase.parser)
+	}
+}
@@ -4,12 +4,18 @@ import "sync"
 
 type DummyRegistry struct {
 	entries     map[string]*RegistryItem
+	groups      map[string]*GroupRegistryItem
+	shards      map[string]*ShardRegistryItem
+	exports     map[string]*ExportRegistryItem
 	entriesLock *sync.RWMutex
 }
 
 func NewDummyRegistry() Registry {
 	return &DummyRegistry{
 		entries:     make(map[string]*RegistryItem),
+		groups:      make(map[string]*GroupRegistryItem),
+		shards:      make(map[string]*ShardRegistryItem),
+		exports:     make(map[string]*ExportRegistryItem),
 		entriesLock: &sync.RWMutex{},
 	}
 }
@@ -20,21 +26,79 @@ func (registry *DummyRegistry) ReadStreamInfo(stream *Stream) error {
 	item, ok := registry.entries[key]
 	registry.entriesLock.RUnlock()
 	if ok {
-		stream.queryParams.NextToken = &item.NextToken
-		stream.buffer.Reset()
-		stream.buffer.WriteString(item.Buffer)
+		stream.restore(item)
 	}
 	return nil
 }
 
-func (registry *DummyRegistry) WriteStreamInfo(stream *Stream) error {
-	item := RegistryItem{
-		NextToken: *stream.queryParams.NextToken,
-		Buffer:    stream.buffer.String(),
-	}
+func (registry *DummyRegistry) WriteStreamInfo(stream *Stream, item *RegistryItem) error {
+	key := generateKey(stream)
+	registry.entriesLock.Lock()
+	registry.entries[key] = item
+	registry.entriesLock.Unlock()
+	return nil
+}
+
+func (registry *DummyRegistry) DeleteStreamInfo(stream *Stream) error {
 	key := generateKey(stream)
 	registry.entriesLock.Lock()
-	registry.entries[key] = &item
+	delete(registry.entries, key)
+	registry.entriesLock.Unlock()
+	return nil
+}
+
+func (registry *DummyRegistry) ReadGroupInfo(group *Group) (*GroupRegistryItem, error) {
+	key := generateGroupKey(group)
+	registry.entriesLock.RLock()
+	item := registry.groups[key]
+	registry.entriesLock.RUnlock()
+	return item, nil
+}
+
+func (registry *DummyRegistry) WriteGroupInfo(group *Group, item *GroupRegistryItem) error {
+	key := generateGroupKey(group)
+	registry.entriesLock.Lock()
+	registry.groups[key] = item
+	registry.entriesLock.Unlock()
+	return nil
+}
+
+func (registry *DummyRegistry) DeleteGroupInfo(group *Group) error {
+	key := generateGroupKey(group)
+	registry.entriesLock.Lock()
+	delete(registry.groups, key)
+	registry.entriesLock.Unlock()
+	return nil
+}
+
+func (registry *DummyRegistry) ReadShardInfo(shard *Shard) (*ShardRegistryItem, error) {
+	key := generateShardKey(shard)
+	registry.entriesLock.RLock()
+	item := registry.shards[key]
+	registry.entriesLock.RUnlock()
+	return item, nil
+}
+
+func (registry *DummyRegistry) WriteShardInfo(shard *Shard, item *ShardRegistryItem) error {
+	key := generateShardKey(shard)
+	registry.entriesLock.Lock()
+	registry.shards[key] = item
+	registry.entriesLock.Unlock()
+	return nil
+}
+
+func (registry *DummyRegistry) ReadExportInfo(object *ExportObject) (*ExportRegistryItem, error) {
+	key := generateExportKey(object)
+	registry.entriesLock.RLock()
+	item := registry.exports[key]
+	registry.entriesLock.RUnlock()
+	return item, nil
+}
+
+func (registry *DummyRegistry) WriteExportInfo(object *ExportObject, item *ExportRegistryItem) error {
+	key := generateExportKey(object)
+	registry.entriesLock.Lock()
+	registry.exports[key] = item
 	registry.entriesLock.Unlock()
 	return nil
 }
@@ -22,7 +22,7 @@ func Test_Dummy_ReadStreamInfo_WhenObjectFound_UpdatesStream(t *testing.T) {
 		buffer: *bytes.NewBufferString("This is the buffer"),
 	}
 	// persist the stream
-	registry.WriteStreamInfo(stream)
+	registry.WriteStreamInfo(stream, stream.checkpoint())
 	// reset the stream
 	stream = &Stream{
 		Name: "stream_name",
@@ -65,7 +65,7 @@ func Test_Dummy_WriteStreamInfo_AddsItemToRegistry(t *testing.T) {
 		buffer: *bytes.NewBufferString("This is the buffer"),
 	}
 	// persist the stream
-	registry.WriteStreamInfo(stream)
+	registry.WriteStreamInfo(stream, stream.checkpoint())
 	// read the stream from the internal registry
 	item, ok := registry.entries[generateKey(stream)]
 	// assert
@@ -0,0 +1,204 @@
+package cwl
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/elastic/beats/v7/libbeat/logp"
+)
+
+// DynamoDBRegistry stores one item per stream (or group) in a DynamoDB table whose hash
+// key is the string attribute "Key". Every item carries a Version attribute
+// which is checked on write, so that two beat instances monitoring the same
+// stream can not silently overwrite each other's NextToken.
+type DynamoDBRegistry struct {
+	DynamoDBClient dynamodbiface.DynamoDBAPI
+	TableName      string
+
+	versions     map[string]int64 // the last version read or written per key
+	versionsLock sync.Mutex
+}
+
+func NewDynamoDBRegistry(client dynamodbiface.DynamoDBAPI, tableName string) *DynamoDBRegistry {
+	return &DynamoDBRegistry{
+		DynamoDBClient: client,
+		TableName:      tableName,
+		versions:       make(map[string]int64),
+	}
+}
+
+func (registry *DynamoDBRegistry) ReadStreamInfo(stream *Stream) error {
+	var item RegistryItem
+	found, err := registry.readItem(generateKey(stream), &item)
+	if err != nil || !found {
+		return err
+	}
+	stream.restore(&item)
+	return nil
+}
+
+func (registry *DynamoDBRegistry) WriteStreamInfo(stream *Stream, item *RegistryItem) error {
+	return registry.writeItem(generateKey(stream), item)
+}
+
+func (registry *DynamoDBRegistry) DeleteStreamInfo(stream *Stream) error {
+	return registry.deleteItem(generateKey(stream))
+}
+
+func (registry *DynamoDBRegistry) ReadGroupInfo(group *Group) (*GroupRegistryItem, error) {
+	var item GroupRegistryItem
+	found, err := registry.readItem(generateGroupKey(group), &item)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func (registry *DynamoDBRegistry) WriteGroupInfo(group *Group, item *GroupRegistryItem) error {
+	return registry.writeItem(generateGroupKey(group), item)
+}
+
+func (registry *DynamoDBRegistry) DeleteGroupInfo(group *Group) error {
+	return registry.deleteItem(generateGroupKey(group))
+}
+
+func (registry *DynamoDBRegistry) ReadShardInfo(shard *Shard) (*ShardRegistryItem, error) {
+	var item ShardRegistryItem
+	found, err := registry.readItem(generateShardKey(shard), &item)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func (registry *DynamoDBRegistry) WriteShardInfo(shard *Shard, item *ShardRegistryItem) error {
+	return registry.writeItem(generateShardKey(shard), item)
+}
+
+func (registry *DynamoDBRegistry) ReadExportInfo(object *ExportObject) (*ExportRegistryItem, error) {
+	var item ExportRegistryItem
+	found, err := registry.readItem(generateExportKey(object), &item)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func (registry *DynamoDBRegistry) WriteExportInfo(object *ExportObject, item *ExportRegistryItem) error {
+	return registry.writeItem(generateExportKey(object), item)
+}
+
+// Reads the table item under key into item and remembers its version;
+// returns false if the item does not exist
+func (registry *DynamoDBRegistry) readItem(key string, item interface{}) (bool, error) {
+	logp.Info("Fetching registry info for %s", key)
+	result, err := registry.DynamoDBClient.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(registry.TableName),
+		Key:            map[string]*dynamodb.AttributeValue{"Key": {S: aws.String(key)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		logp.Warn(fmt.Sprintf("dynamodb: failed to read key=%s [message=%s]", key, err.Error()))
+		return false, err
+	}
+	// a missing item is a normal condition when the program
+	// starts monitoring a new stream
+	if len(result.Item) == 0 {
+		registry.setVersion(key, 0)
+		return false, nil
+	}
+	var version int64
+	if value, ok := result.Item["Version"]; ok {
+		version, err = strconv.ParseInt(aws.StringValue(value.N), 10, 64)
+	}
+	if err == nil {
+		err = dynamodbattribute.UnmarshalMap(result.Item, item)
+	}
+	if err != nil {
+		logp.Warn(fmt.Sprintf("dynamodb: failed to read key=%s [message=%s]", key, err.Error()))
+		return false, err
+	}
+	registry.setVersion(key, version)
+	return true, nil
+}
+
+// Writes item under key, on condition that the stored version is the
+// one last read or written by this registry
+func (registry *DynamoDBRegistry) writeItem(key string, item interface{}) error {
+	attributes, err := dynamodbattribute.MarshalMap(item)
+	if err != nil {
+		return err
+	}
+	version := registry.getVersion(key)
+	attributes["Key"] = &dynamodb.AttributeValue{S: aws.String(key)}
+	attributes["Version"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(version+1, 10))}
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(registry.TableName),
+		Item:      attributes,
+	}
+	if version == 0 {
+		input.ConditionExpression = aws.String("attribute_not_exists(#key)")
+		input.ExpressionAttributeNames = map[string]*string{"#key": aws.String("Key")}
+	} else {
+		input.ConditionExpression = aws.String("#version = :version")
+		input.ExpressionAttributeNames = map[string]*string{"#version": aws.String("Version")}
+		input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+			":version": {N: aws.String(strconv.FormatInt(version, 10))},
+		}
+	}
+	_, err = registry.DynamoDBClient.PutItem(input)
+	if err != nil {
+		if awserr, ok := err.(awserr.Error); ok && awserr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			// the key is owned by the other instance now, so it is
+			// never overwritten by this one
+			logp.Err(fmt.Sprintf("dynamodb: key=%s was updated by another instance (version=%d)", key, version))
+		} else {
+			logp.Warn(fmt.Sprintf("dynamodb: failed to write key=%s [message=%s]", key, err.Error()))
+		}
+		return err
+	}
+	registry.setVersion(key, version+1)
+	return nil
+}
+
+// Deletes the table item under key, on condition that the stored version
+// is the one last read or written by this registry
+func (registry *DynamoDBRegistry) deleteItem(key string) error {
+	version := registry.getVersion(key)
+	input := &dynamodb.DeleteItemInput{
+		TableName:                aws.String(registry.TableName),
+		Key:                      map[string]*dynamodb.AttributeValue{"Key": {S: aws.String(key)}},
+		ConditionExpression:      aws.String("attribute_not_exists(#key) OR #version = :version"),
+		ExpressionAttributeNames: map[string]*string{"#key": aws.String("Key"), "#version": aws.String("Version")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":version": {N: aws.String(strconv.FormatInt(version, 10))},
+		},
+	}
+	_, err := registry.DynamoDBClient.DeleteItem(input)
+	if err != nil {
+		logp.Warn(fmt.Sprintf("dynamodb: failed to delete key=%s [message=%s]", key, err.Error()))
+		return err
+	}
+	registry.versionsLock.Lock()
+	delete(registry.versions, key)
+	registry.versionsLock.Unlock()
+	return nil
+}
+
+func (registry *DynamoDBRegistry) getVersion(key string) int64 {
+	registry.versionsLock.Lock()
+	defer registry.versionsLock.Unlock()
+	return registry.versions[key]
+}
+
+func (registry *DynamoDBRegistry) setVersion(key string, version int64) {
+	registry.versionsLock.Lock()
+	defer registry.versionsLock.Unlock()
+	registry.versions[key] = version
+}
@@ -0,0 +1,186 @@
+package cwl
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/stretchr/testify/assert"
+)
+
+// this is our mock DynamoDB client
+type MockDynamoDBClient struct {
+	dynamodbiface.DynamoDBAPI
+	GetItemStub func(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error)
+	PutItemStub func(*dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error)
+
+	DeleteItemStub func(*dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error)
+}
+
+// stub GetItem
+func (client *MockDynamoDBClient) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return client.GetItemStub(input)
+}
+
+// stub PutItem
+func (client *MockDynamoDBClient) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	return client.PutItemStub(input)
+}
+
+// stub DeleteItem
+func (client *MockDynamoDBClient) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	return client.DeleteItemStub(input)
+}
+
+func Test_DynamoDB_ReadStreamInfo_WhenItemNotFound_ReturnsNil(t *testing.T) {
+	client := &MockDynamoDBClient{
+		GetItemStub: func(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+			assert.Equal(t, "the_table_name", *input.TableName)
+			assert.Equal(t, "group/stream", *input.Key["Key"].S)
+			return &dynamodb.GetItemOutput{}, nil
+		},
+	}
+	registry := NewDynamoDBRegistry(client, "the_table_name")
+	stream := &Stream{Name: "stream", Group: &Group{Name: "group"}, queryParams: &cloudwatchlogs.GetLogEventsInput{}}
+	err := registry.ReadStreamInfo(stream)
+	assert.Nil(t, err)
+	assert.Nil(t, stream.queryParams.NextToken)
+}
+
+func Test_DynamoDB_ReadStreamInfo_WhenTableDoesNotExist_ReturnsError(t *testing.T) {
+	client := &MockDynamoDBClient{
+		GetItemStub: func(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+			return nil, awserr.New(dynamodb.ErrCodeResourceNotFoundException, "Does not exist", nil)
+		},
+	}
+	registry := NewDynamoDBRegistry(client, "the_table_name")
+	err := registry.ReadStreamInfo(&Stream{Name: "stream", Group: &Group{Name: "group"}, queryParams: &cloudwatchlogs.GetLogEventsInput{}}).(awserr.Error)
+	assert.Equal(t, dynamodb.ErrCodeResourceNotFoundException, err.Code())
+}
+
+func Test_DynamoDB_ReadStreamInfo_WhenItemExists_ShouldUpdateStream(t *testing.T) {
+	client := &MockDynamoDBClient{
+		GetItemStub: func(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+			return &dynamodb.GetItemOutput{
+				Item: map[string]*dynamodb.AttributeValue{
+					"Key":       {S: aws.String("group/stream")},
+					"NextToken": {S: aws.String("abcde")},
+					"Buffer":    {S: aws.String("This is the buffer")},
+					"Version":   {N: aws.String("3")},
+				},
+			}, nil
+		},
+	}
+	registry := NewDynamoDBRegistry(client, "the_table_name")
+	stream := &Stream{Name: "stream", Group: &Group{Name: "group"}, queryParams: &cloudwatchlogs.GetLogEventsInput{}}
+	err := registry.ReadStreamInfo(stream)
+	assert.Nil(t, err)
+	assert.Equal(t, "abcde", *stream.queryParams.NextToken)
+	assert.Equal(t, "This is the buffer", stream.buffer.String())
+	assert.Equal(t, int64(3), registry.getVersion("group/stream"))
+}
+
+func Test_DynamoDB_WriteStreamInfo_ForNewItem_RequiresItemNotToExist(t *testing.T) {
+	client := &MockDynamoDBClient{
+		PutItemStub: func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+			assert.Equal(t, "the_table_name", *input.TableName)
+			assert.Equal(t, "group/stream", *input.Item["Key"].S)
+			assert.Equal(t, "abcde", *input.Item["NextToken"].S)
+			assert.Equal(t, "This is the buffer", *input.Item["Buffer"].S)
+			assert.Equal(t, "1", *input.Item["Version"].N)
+			assert.Equal(t, "attribute_not_exists(#key)", *input.ConditionExpression)
+			return &dynamodb.PutItemOutput{}, nil
+		},
+	}
+	registry := NewDynamoDBRegistry(client, "the_table_name")
+	stream := &Stream{Name: "stream", Group: &Group{Name: "group"}, queryParams: &cloudwatchlogs.GetLogEventsInput{}}
+	stream.queryParams.NextToken = aws.String("abcde")
+	stream.buffer = *bytes.NewBufferString("This is the buffer")
+	err := registry.WriteStreamInfo(stream, stream.checkpoint())
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), registry.getVersion("group/stream"))
+}
+
+func Test_DynamoDB_WriteStreamInfo_ForExistingItem_RequiresSameVersion(t *testing.T) {
+	client := &MockDynamoDBClient{
+		PutItemStub: func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+			assert.Equal(t, "5", *input.Item["Version"].N)
+			assert.Equal(t, "#version = :version", *input.ConditionExpression)
+			assert.Equal(t, "4", *input.ExpressionAttributeValues[":version"].N)
+			_, ok := input.Item["Buffer"]
+			assert.False(t, ok)
+			return &dynamodb.PutItemOutput{}, nil
+		},
+	}
+	registry := NewDynamoDBRegistry(client, "the_table_name")
+	registry.setVersion("group/stream", 4)
+	stream := &Stream{Name: "stream", Group: &Group{Name: "group"}, queryParams: &cloudwatchlogs.GetLogEventsInput{}}
+	stream.queryParams.NextToken = aws.String("abcde")
+	err := registry.WriteStreamInfo(stream, stream.checkpoint())
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), registry.getVersion("group/stream"))
+}
+
+func Test_DynamoDB_WriteStreamInfo_OfTwoInstances_FailsForTheSecondWriter(t *testing.T) {
+	// a table that evaluates the conditions on the stored version
+	var stored string
+	client := &MockDynamoDBClient{
+		GetItemStub: func(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+			if stored == "" {
+				return &dynamodb.GetItemOutput{}, nil
+			}
+			return &dynamodb.GetItemOutput{
+				Item: map[string]*dynamodb.AttributeValue{"Version": {N: aws.String(stored)}},
+			}, nil
+		},
+		PutItemStub: func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+			expected := ""
+			if value, ok := input.ExpressionAttributeValues[":version"]; ok {
+				expected = *value.N
+			}
+			if expected != stored {
+				return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "Conflict", nil)
+			}
+			stored = *input.Item["Version"].N
+			return &dynamodb.PutItemOutput{}, nil
+		},
+	}
+	first := NewDynamoDBRegistry(client, "the_table_name")
+	second := NewDynamoDBRegistry(client, "the_table_name")
+	stream := &Stream{Name: "stream", Group: &Group{Name: "group"}, queryParams: &cloudwatchlogs.GetLogEventsInput{}}
+	assert.Nil(t, first.ReadStreamInfo(stream))
+	assert.Nil(t, second.ReadStreamInfo(stream))
+	stream.queryParams.NextToken = aws.String("abcde")
+
+	// go!
+	assert.Nil(t, first.WriteStreamInfo(stream, stream.checkpoint()))
+	err := second.WriteStreamInfo(stream, stream.checkpoint())
+	// assert
+	assert.Equal(t, ConflictError, classifyError(err))
+	// the second instance never overwrites the first one's state
+	assert.Equal(t, ConflictError, classifyError(second.WriteStreamInfo(stream, stream.checkpoint())))
+	assert.Equal(t, "1", stored)
+	assert.Nil(t, first.WriteStreamInfo(stream, stream.checkpoint()))
+	assert.Equal(t, "2", stored)
+}
+
+func Test_DynamoDB_DeleteStreamInfo_RequiresSameVersion_AndForgetsIt(t *testing.T) {
+	client := &MockDynamoDBClient{
+		DeleteItemStub: func(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+			assert.Equal(t, "the_table_name", *input.TableName)
+			assert.Equal(t, "group/stream", *input.Key["Key"].S)
+			assert.Equal(t, "attribute_not_exists(#key) OR #version = :version", *input.ConditionExpression)
+			assert.Equal(t, "4", *input.ExpressionAttributeValues[":version"].N)
+			return &dynamodb.DeleteItemOutput{}, nil
+		},
+	}
+	registry := NewDynamoDBRegistry(client, "the_table_name")
+	registry.setVersion("group/stream", 4)
+	err := registry.DeleteStreamInfo(&Stream{Name: "stream", Group: &Group{Name: "group"}, queryParams: &cloudwatchlogs.GetLogEventsInput{}})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), registry.getVersion("group/stream"))
+}
@@ -9,6 +9,11 @@ type Event struct {
 	Stream    *Stream
 	Message   string
 	Timestamp int64
+	Partial   bool          // true for multiline events published before they were complete
+	Truncated bool          // true for multiline events that exceeded max_lines or max_bytes
+	Fields    common.MapStr // the fields parsed from the message, if any
+
+	batch *eventBatch // the batch to acknowledge once the event is shipped
 }
 
 type EventPublisher interface {
@@ -21,15 +26,44 @@ type Publisher struct {
 }
 
 func (publisher Publisher) Publish(event *Event) {
+	group := event.Stream.Group
+	account := group.Account
+	if account == "" {
+		account = event.Stream.Params.AccountId
+	}
+	fields := common.MapStr{
+		"prospector": group.Prospector.Id,
+		"type":       group.Prospector.Id,
+		"message":    event.Message,
+		"group":      group.Name,
+		"stream":     event.Stream.Name,
+	}
+	// the region of the groups of subscription messages is unknown
+	if !group.subscribed {
+		region := group.Region
+		if region == "" {
+			region = event.Stream.Params.Config.AWSRegion
+		}
+		fields["region"] = region
+	}
+	if account != "" {
+		fields["aws"] = common.MapStr{"account_id": account}
+	}
+	fields.Update(event.Fields)
+	if event.Partial || event.Truncated {
+		flags := []string{"multiline"}
+		if event.Partial {
+			flags = append(flags, "partial")
+		}
+		if event.Truncated {
+			flags = append(flags, "truncated")
+		}
+		fields["log"] = common.MapStr{"flags": flags}
+	}
 	publisher.Client.Publish(beat.Event{
 		Timestamp: ToTime(event.Timestamp),
-		Fields: common.MapStr{
-			"prospector": event.Stream.Group.Prospector.Id,
-			"type":       event.Stream.Group.Prospector.Id,
-			"message":    event.Message,
-			"group":      event.Stream.Group.Name,
-			"stream":     event.Stream.Name,
-		},
+		Private:   event.batch,
+		Fields:    fields,
 	})
 }
 
@@ -0,0 +1,315 @@
+package cwl
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/elastic/beats/v7/libbeat/logp"
+)
+
+// the maximum size of a log event is 256KB; exported lines may be longer
+// than that only because of the timestamp
+const exportMaxLineSize = 1 << 20
+
+// ExportIngester ingests the objects written to S3 by CloudWatch Logs
+// export tasks (CreateExportTask). Exports are laid out as
+// <prefix>/<taskId>/<stream>/000000.gz and every line of an object is in
+// the `timestamp message` format. The events are published using the
+// streams of the GroupManager, so the prospectors (and their multiline
+// settings) apply to them as if the groups were polled. Ingested objects
+// are recorded in the registry, so that an interrupted ingestion resumes
+// where it left off.
+type ExportIngester struct {
+	BucketName string
+	Prefix     string
+	Client     s3iface.S3API
+	Manager    *GroupManager
+	Params     *Params
+
+	groupNames map[string]string       // the group name per export task id
+	acks       map[*Stream]*batchQueue // the objects waiting for acknowledgement per stream
+}
+
+// An S3 object written by an export task
+type ExportObject struct {
+	Bucket     string
+	Key        string
+	TaskId     string
+	StreamName string
+}
+
+// The item committed once all the events of an export object have been
+// acknowledged
+type exportCheckpoint struct {
+	object *ExportObject
+	item   *ExportRegistryItem
+}
+
+func NewExportIngester(client s3iface.S3API, manager *GroupManager) *ExportIngester {
+	config := manager.Params.Config
+	return &ExportIngester{
+		BucketName: config.ExportBucketName,
+		Prefix:     config.ExportPrefix,
+		Client:     client,
+		Manager:    manager,
+		Params:     manager.Params,
+		groupNames: make(map[string]string),
+		acks:       make(map[*Stream]*batchQueue),
+	}
+}
+
+// Lists the objects of the export prefix, grouped by task and stream in
+// the order in which they have been written
+func (ingester *ExportIngester) listObjects() ([][]*ExportObject, error) {
+	prefix := ingester.Prefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	var streams [][]*ExportObject
+	var last *ExportObject
+	err := ingester.Client.ListObjectsV2Pages(
+		&s3.ListObjectsV2Input{
+			Bucket: aws.String(ingester.BucketName),
+			Prefix: aws.String(prefix),
+		},
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, s3Object := range page.Contents {
+				object := parseExportKey(ingester.BucketName, prefix, aws.StringValue(s3Object.Key))
+				if object == nil {
+					continue
+				}
+				// keys are listed in lexicographical order, so the objects
+				// of a stream are consecutive and ordered by sequence
+				if last == nil || last.TaskId != object.TaskId || last.StreamName != object.StreamName {
+					streams = append(streams, nil)
+				}
+				streams[len(streams)-1] = append(streams[len(streams)-1], object)
+				last = object
+			}
+			return true
+		},
+	)
+	return streams, err
+}
+
+// Parses the key of an export object; returns nil for keys that are not
+// export objects (e.g. the aws-logs-write-test object of export tasks)
+func parseExportKey(bucket string, prefix string, key string) *ExportObject {
+	if !strings.HasPrefix(key, prefix) || !strings.HasSuffix(key, ".gz") {
+		return nil
+	}
+	parts := strings.Split(key[len(prefix):], "/")
+	// stream names may contain slashes (e.g. lambda streams)
+	if len(parts) < 3 {
+		return nil
+	}
+	return &ExportObject{
+		Bucket:     bucket,
+		Key:        key,
+		TaskId:     parts[0],
+		StreamName: strings.Join(parts[1:len(parts)-1], "/"),
+	}
+}
+
+// Returns the name of the group exported by the task: the configured
+// export_group_name or, if not set, the group of the export task
+func (ingester *ExportIngester) groupName(taskId string) (string, error) {
+	if name := ingester.Params.Config.ExportGroupName; name != "" {
+		return name, nil
+	}
+	if name, ok := ingester.groupNames[taskId]; ok {
+		return name, nil
+	}
+	output, err := ingester.Params.AWSClient.DescribeExportTasks(&cloudwatchlogs.DescribeExportTasksInput{
+		TaskId: aws.String(taskId),
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(output.ExportTasks) == 0 {
+		return "", errors.New("export task not found: " + taskId)
+	}
+	name := aws.StringValue(output.ExportTasks[0].LogGroupName)
+	ingester.groupNames[taskId] = name
+	return name, nil
+}
+
+// Ingests all the export objects that have not been ingested already.
+// Returns once all the events have been published, or as soon as the
+// current object is ingested if the context is cancelled; use Pending to
+// find out whether they have been acknowledged.
+func (ingester *ExportIngester) Run(ctx context.Context) error {
+	logp.Info("[export] ingesting s3://%s/%s", ingester.BucketName, ingester.Prefix)
+	streams, err := ingester.listObjects()
+	if err != nil {
+		return err
+	}
+	for _, objects := range streams {
+		if err := ingester.ingestStream(ctx, objects); err != nil {
+			logp.Err("export: failed to ingest %s/%s [%s]",
+				objects[0].TaskId, objects[0].StreamName, err.Error())
+		}
+	}
+	if ctx.Err() != nil {
+		logp.Info("[export] s3://%s/%s interrupted", ingester.BucketName, ingester.Prefix)
+		return nil
+	}
+	logp.Info("[export] s3://%s/%s ingested", ingester.BucketName, ingester.Prefix)
+	return nil
+}
+
+// Ingests the objects of a single exported stream in order
+func (ingester *ExportIngester) ingestStream(ctx context.Context, objects []*ExportObject) error {
+	groupName, err := ingester.groupName(objects[0].TaskId)
+	if err != nil {
+		return err
+	}
+	manager := ingester.Manager
+	manager.dispatchLock.Lock()
+	stream := manager.dispatchStream("", groupName, objects[0].StreamName, false)
+	manager.dispatchLock.Unlock()
+	if stream == nil {
+		return nil
+	}
+	queue, ok := ingester.acks[stream]
+	if !ok {
+		queue = &batchQueue{
+			write: func(item interface{}) error {
+				checkpoint := item.(*exportCheckpoint)
+				return ingester.Params.Registry.WriteExportInfo(checkpoint.object, checkpoint.item)
+			},
+			// every object has a registry item of its own
+			writeAll: true,
+		}
+		ingester.acks[stream] = queue
+	}
+	for i, object := range objects {
+		if ctx.Err() != nil {
+			return nil
+		}
+		item, err := ingester.Params.Registry.ReadExportInfo(object)
+		if err != nil {
+			return err
+		}
+		if item != nil && item.Completed {
+			// resume with the multiline buffers left by the object
+			manager.dispatchLock.Lock()
+			stream.restoreBuffer(item.Buffer, item.BufferTimestamp)
+			stream.restoreKeyed(item.KeyedBuffers)
+			manager.dispatchLock.Unlock()
+			continue
+		}
+		if err = ingester.ingestObject(object, stream, queue, i == len(objects)-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Digests the events of an export object into the stream; the buffer of
+// the stream is flushed after the last object of the stream
+func (ingester *ExportIngester) ingestObject(object *ExportObject, stream *Stream, queue *batchQueue, last bool) error {
+	logp.Debug("export", "ingesting s3://%s/%s", object.Bucket, object.Key)
+	output, err := ingester.Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(object.Bucket),
+		Key:    aws.String(object.Key),
+	})
+	if err != nil {
+		return err
+	}
+	defer output.Body.Close()
+	reader, err := gzip.NewReader(output.Body)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	manager := ingester.Manager
+	manager.dispatchLock.Lock()
+	defer manager.dispatchLock.Unlock()
+	batch := queue.newBatch()
+	stream.batch = batch
+	defer func() { stream.batch = nil }()
+
+	digest := func(timestamp int64, message string) {
+		stream.digest(&cloudwatchlogs.OutputLogEvent{
+			Message:   aws.String(message),
+			Timestamp: aws.Int64(timestamp),
+		})
+		stream.LastEventTimestamp = timestamp
+	}
+	var message strings.Builder
+	var timestamp int64
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), exportMaxLineSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if lineTimestamp, lineMessage, ok := parseExportLine(line); ok {
+			if message.Len() > 0 {
+				digest(timestamp, message.String())
+				message.Reset()
+			}
+			timestamp = lineTimestamp
+			message.WriteString(lineMessage)
+			continue
+		}
+		// lines without a timestamp belong to a message with newlines
+		if message.Len() > 0 {
+			message.WriteString("\n")
+		}
+		message.WriteString(line)
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read s3://%s/%s [%s]", object.Bucket, object.Key, err.Error())
+	}
+	if message.Len() > 0 {
+		digest(timestamp, message.String())
+	}
+	if last {
+		stream.flush()
+		stream.flushKeyed()
+	}
+	item := &ExportRegistryItem{
+		Completed:    true,
+		Buffer:       stream.buffer.String(),
+		KeyedBuffers: stream.keyedCheckpoint(),
+	}
+	if stream.buffer.Len() > 0 {
+		item.BufferTimestamp = stream.bufferStart
+	}
+	return queue.seal(batch, &exportCheckpoint{object: object, item: item})
+}
+
+// Splits an exported line into its timestamp (in milliseconds since 1970)
+// and its message; returns false if the line does not start with a
+// timestamp
+func parseExportLine(line string) (int64, string, bool) {
+	index := strings.IndexByte(line, ' ')
+	if index < 0 {
+		return 0, "", false
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, line[:index])
+	if err != nil {
+		return 0, "", false
+	}
+	return timestamp.UnixNano() / 1e6, line[index+1:], true
+}
+
+// Returns the number of ingested objects that are waiting for the
+// acknowledgement of their events
+func (ingester *ExportIngester) Pending() int {
+	pending := 0
+	for _, queue := range ingester.acks {
+		pending += queue.size()
+	}
+	return pending
+}
@@ -0,0 +1,330 @@
+package cwl
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// creates a fake S3 client that serves the given objects gzipped;
+// the keys of the requested objects are appended to fetched
+func CreateExportS3Client(objects map[string]string, keys []string, fetched *[]string) *MockS3Client {
+	return &MockS3Client{
+		ListObjectsV2PagesStub: func(input *s3.ListObjectsV2Input, f func(*s3.ListObjectsV2Output, bool) bool) error {
+			output := &s3.ListObjectsV2Output{}
+			for _, key := range keys {
+				output.Contents = append(output.Contents, &s3.Object{Key: aws.String(key)})
+			}
+			f(output, true)
+			return nil
+		},
+		GetObjectStub: func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+			key := aws.StringValue(input.Key)
+			*fetched = append(*fetched, key)
+			var body bytes.Buffer
+			writer := gzip.NewWriter(&body)
+			writer.Write([]byte(objects[key]))
+			writer.Close()
+			return &s3.GetObjectOutput{Body: S3ItemBody{&body}}, nil
+		},
+	}
+}
+
+// stubs DescribeExportTasks to list a single task of the named group
+func stubDescribeExportTasks(client *MockCWLClient, groupName string) {
+	client.On("DescribeExportTasks", mock.AnythingOfType("*cloudwatchlogs.DescribeExportTasksInput")).Return(
+		&cloudwatchlogs.DescribeExportTasksOutput{
+			ExportTasks: []*cloudwatchlogs.ExportTask{{LogGroupName: aws.String(groupName)}},
+		}, nil)
+}
+
+func Test_ParseExportKey(t *testing.T) {
+	testCases := []struct {
+		key    string
+		task   string
+		stream string
+	}{
+		{"exports/task/stream/000000.gz", "task", "stream"},
+		{"exports/task/2020/01/01/[$LATEST]abcd/000001.gz", "task", "2020/01/01/[$LATEST]abcd"},
+		{"exports/aws-logs-write-test", "", ""},
+		{"exports/task/000000.gz", "", ""},
+		{"others/task/stream/000000.gz", "", ""},
+	}
+	for _, testCase := range testCases {
+		object := parseExportKey("the-bucket", "exports/", testCase.key)
+		if testCase.task == "" {
+			assert.Nil(t, object, testCase.key)
+			continue
+		}
+		assert.Equal(t, "the-bucket", object.Bucket)
+		assert.Equal(t, testCase.key, object.Key)
+		assert.Equal(t, testCase.task, object.TaskId)
+		assert.Equal(t, testCase.stream, object.StreamName)
+	}
+}
+
+func Test_ParseExportLine(t *testing.T) {
+	timestamp, message, ok := parseExportLine("2020-01-03T22:35:01.599Z START RequestId: aaa")
+	assert.True(t, ok)
+	assert.Equal(t, int64(1578090901599), timestamp)
+	assert.Equal(t, "START RequestId: aaa", message)
+
+	_, _, ok = parseExportLine("    at com.example.Main(Main.java:10)")
+	assert.False(t, ok)
+	_, _, ok = parseExportLine("")
+	assert.False(t, ok)
+}
+
+func Test_Export_IngestsObjects_AndRecordsThemInRegistry(t *testing.T) {
+	keys := []string{
+		"exports/aws-logs-write-test",
+		"exports/task/stream-a/000000.gz",
+		"exports/task/stream-a/000001.gz",
+		"exports/task/stream-b/000000.gz",
+	}
+	objects := map[string]string{
+		"exports/task/stream-a/000000.gz": "2020-01-03T22:35:01.599Z Event 1\n2020-01-03T22:35:02.000Z Event 2\n",
+		"exports/task/stream-a/000001.gz": "2020-01-03T22:35:03.000Z Event 3\nwith a second line\n",
+		"exports/task/stream-b/000000.gz": "2020-01-03T22:35:04.000Z Event 4\n",
+	}
+	fetched := []string{}
+	registry := NewDummyRegistry()
+	publisher, events := CreateCollectingPublisher(true)
+	client := &MockCWLClient{}
+	stubDescribeExportTasks(client, "/aws/lambda/function")
+	params := &Params{
+		Config: &Config{
+			ExportBucketName: "the-bucket",
+			ExportPrefix:     "exports",
+			Prospectors:      []Prospector{{Id: "lambda", GroupNames: []string{"/aws/lambda/*"}}},
+		},
+		AWSClient: client,
+		Registry:  registry,
+		Publisher: publisher,
+	}
+	ingester := NewExportIngester(CreateExportS3Client(objects, keys, &fetched), NewGroupManager(params))
+	// go!
+	assert.Nil(t, ingester.Run(context.Background()))
+	// assert
+	assert.Equal(t, 0, ingester.Pending())
+	assert.Equal(t, keys[1:], fetched)
+	assert.Equal(t, 4, len(*events))
+	messages := []string{}
+	for _, event := range *events {
+		messages = append(messages, event.Message)
+	}
+	assert.Equal(t, []string{"Event 1", "Event 2", "Event 3\nwith a second line", "Event 4"}, messages)
+	assert.Equal(t, int64(1578090901599), (*events)[0].Timestamp)
+	assert.Equal(t, "/aws/lambda/function", (*events)[0].Stream.Group.Name)
+	assert.Equal(t, "stream-a", (*events)[0].Stream.Name)
+	assert.Equal(t, "stream-b", (*events)[3].Stream.Name)
+	for _, key := range keys[1:] {
+		item, _ := registry.ReadExportInfo(parseExportKey("the-bucket", "exports/", key))
+		assert.True(t, item.Completed, key)
+	}
+}
+
+func Test_Export_SkipsCompletedObjects_AndRestoresTheirBuffer(t *testing.T) {
+	keys := []string{
+		"exports/task/stream/000000.gz",
+		"exports/task/stream/000001.gz",
+	}
+	objects := map[string]string{
+		"exports/task/stream/000001.gz": "2020-01-03T22:35:03.000Z REPORT RequestId: aaa\n",
+	}
+	registry := NewDummyRegistry()
+	registry.WriteExportInfo(parseExportKey("the-bucket", "exports/", keys[0]),
+		&ExportRegistryItem{Completed: true, Buffer: "START RequestId: aaa", BufferTimestamp: 1578090901000})
+	fetched := []string{}
+	publisher, events := CreateCollectingPublisher(true)
+	prospector := Prospector{
+		Id:         "lambda",
+		GroupNames: []string{"/aws/lambda/*"},
+		Multiline:  &Multiline{Pattern: "^REPORT", Negate: true, Match: "before"},
+	}
+	client := &MockCWLClient{}
+	stubDescribeExportTasks(client, "/aws/lambda/function")
+	params := &Params{
+		Config: &Config{
+			ExportBucketName: "the-bucket",
+			ExportPrefix:     "exports",
+			Prospectors:      []Prospector{prospector},
+		},
+		AWSClient: client,
+		Registry:  registry,
+		Publisher: publisher,
+	}
+	ingester := NewExportIngester(CreateExportS3Client(objects, keys, &fetched), NewGroupManager(params))
+	// go!
+	assert.Nil(t, ingester.Run(context.Background()))
+	// assert
+	assert.Equal(t, keys[1:], fetched)
+	assert.Equal(t, 1, len(*events))
+	assert.Equal(t, "START RequestId: aaaREPORT RequestId: aaa", (*events)[0].Message)
+	assert.Equal(t, int64(1578090901000), (*events)[0].Stream.bufferStart)
+}
+
+func Test_Export_RecordsAndRestoresTheKeyedBuffers(t *testing.T) {
+	keys := []string{
+		"exports/task/stream/000000.gz",
+		"exports/task/stream/000001.gz",
+	}
+	objects := map[string]string{
+		"exports/task/stream/000000.gz": "2020-01-03T22:35:01.000Z START RequestId: aaa\n",
+		"exports/task/stream/000001.gz": "2020-01-03T22:35:03.000Z REPORT RequestId: aaa\n",
+	}
+	prospector := Prospector{
+		Id:         "lambda",
+		GroupNames: []string{"/aws/lambda/*"},
+		Multiline: &Multiline{
+			Type:         "key",
+			KeyPattern:   `RequestId: (\S+)`,
+			FlushPattern: "^REPORT",
+		},
+	}
+	registry := NewDummyRegistry()
+	fetched := []string{}
+	publisher, events := CreateCollectingPublisher(true)
+	client := &MockCWLClient{}
+	stubDescribeExportTasks(client, "/aws/lambda/function")
+	params := &Params{
+		Config: &Config{
+			ExportBucketName: "the-bucket",
+			ExportPrefix:     "exports",
+			Prospectors:      []Prospector{prospector},
+		},
+		AWSClient: client,
+		Registry:  registry,
+		Publisher: publisher,
+	}
+	ingester := NewExportIngester(CreateExportS3Client(objects, keys, &fetched), NewGroupManager(params))
+	// go!
+	assert.Nil(t, ingester.Run(context.Background()))
+	// assert
+	assert.Equal(t, 1, len(*events))
+	assert.Equal(t, "START RequestId: aaaREPORT RequestId: aaa", (*events)[0].Message)
+	item, _ := registry.ReadExportInfo(parseExportKey("the-bucket", "exports/", keys[0]))
+	assert.Equal(t, []KeyedBuffer{{Key: "aaa", Buffer: "START RequestId: aaa", Timestamp: 1578090901000}}, item.KeyedBuffers)
+
+	// the last object is ingested again, resuming with the keyed buffers
+	registry.WriteExportInfo(parseExportKey("the-bucket", "exports/", keys[1]), &ExportRegistryItem{})
+	fetched = []string{}
+	params.Publisher, events = CreateCollectingPublisher(true)
+	ingester = NewExportIngester(CreateExportS3Client(objects, keys, &fetched), NewGroupManager(params))
+	assert.Nil(t, ingester.Run(context.Background()))
+	assert.Equal(t, keys[1:], fetched)
+	assert.Equal(t, 1, len(*events))
+	assert.Equal(t, "START RequestId: aaaREPORT RequestId: aaa", (*events)[0].Message)
+}
+
+func Test_Export_FlushesTheBuffer_AfterTheLastObjectOfStream(t *testing.T) {
+	keys := []string{"exports/task/stream/000000.gz"}
+	objects := map[string]string{
+		"exports/task/stream/000000.gz": "2020-01-03T22:35:01.000Z START\n2020-01-03T22:35:02.000Z END\n",
+	}
+	registry := NewDummyRegistry()
+	fetched := []string{}
+	publisher, events := CreateCollectingPublisher(true)
+	prospector := Prospector{
+		Id:         "lambda",
+		GroupNames: []string{"/aws/lambda/*"},
+		Multiline:  &Multiline{Pattern: "^START", Negate: true, Match: "after"},
+	}
+	client := &MockCWLClient{}
+	stubDescribeExportTasks(client, "/aws/lambda/function")
+	params := &Params{
+		Config: &Config{
+			ExportBucketName: "the-bucket",
+			ExportPrefix:     "exports",
+			Prospectors:      []Prospector{prospector},
+		},
+		AWSClient: client,
+		Registry:  registry,
+		Publisher: publisher,
+	}
+	ingester := NewExportIngester(CreateExportS3Client(objects, keys, &fetched), NewGroupManager(params))
+	// go!
+	assert.Nil(t, ingester.Run(context.Background()))
+	// assert
+	assert.Equal(t, 1, len(*events))
+	assert.Equal(t, "STARTEND", (*events)[0].Message)
+	item, _ := registry.ReadExportInfo(parseExportKey("the-bucket", "exports/", keys[0]))
+	assert.Equal(t, "", item.Buffer)
+}
+
+func Test_Export_DoesNotRecordObjects_UntilAcknowledged(t *testing.T) {
+	keys := []string{"exports/task/stream/000000.gz"}
+	objects := map[string]string{
+		"exports/task/stream/000000.gz": "2020-01-03T22:35:01.000Z Event 1\n",
+	}
+	registry := NewDummyRegistry()
+	fetched := []string{}
+	// the events are not acknowledged
+	publisher, _ := CreateCollectingPublisher(false)
+	client := &MockCWLClient{}
+	stubDescribeExportTasks(client, "/aws/lambda/function")
+	params := &Params{
+		Config: &Config{
+			ExportBucketName: "the-bucket",
+			ExportPrefix:     "exports",
+			Prospectors:      []Prospector{{Id: "lambda", GroupNames: []string{"/aws/lambda/*"}}},
+		},
+		AWSClient: client,
+		Registry:  registry,
+		Publisher: publisher,
+	}
+	ingester := NewExportIngester(CreateExportS3Client(objects, keys, &fetched), NewGroupManager(params))
+	// go!
+	assert.Nil(t, ingester.Run(context.Background()))
+	// assert
+	assert.Equal(t, 1, ingester.Pending())
+	item, _ := registry.ReadExportInfo(parseExportKey("the-bucket", "exports/", keys[0]))
+	assert.Nil(t, item)
+}
+
+func Test_Export_RecordsEveryObject_WhenAcknowledgedLater(t *testing.T) {
+	keys := []string{
+		"exports/task/stream/000000.gz",
+		"exports/task/stream/000001.gz",
+		"exports/task/stream/000002.gz",
+	}
+	// the second object has no events to publish
+	objects := map[string]string{
+		"exports/task/stream/000000.gz": "2020-01-03T22:35:01.000Z keep 1\n",
+		"exports/task/stream/000001.gz": "2020-01-03T22:35:02.000Z drop\n",
+		"exports/task/stream/000002.gz": "2020-01-03T22:35:03.000Z keep 2\n",
+	}
+	registry := NewDummyRegistry()
+	fetched := []string{}
+	publisher, events := CreateCollectingPublisher(false)
+	client := &MockCWLClient{}
+	stubDescribeExportTasks(client, "/aws/lambda/function")
+	params := &Params{
+		Config: &Config{
+			ExportBucketName: "the-bucket",
+			ExportPrefix:     "exports",
+			Prospectors:      []Prospector{{Id: "lambda", GroupNames: []string{"/aws/lambda/*"}, FilterPattern: "keep"}},
+		},
+		AWSClient: client,
+		Registry:  registry,
+		Publisher: publisher,
+	}
+	ingester := NewExportIngester(CreateExportS3Client(objects, keys, &fetched), NewGroupManager(params))
+	// go!
+	assert.Nil(t, ingester.Run(context.Background()))
+	AckEvents(len(*events), ackPrivate(*events))
+	// assert
+	assert.Equal(t, 2, len(*events))
+	assert.Equal(t, 0, ingester.Pending())
+	for _, key := range keys {
+		item, _ := registry.ReadExportInfo(parseExportKey("the-bucket", "exports/", key))
+		assert.True(t, item != nil && item.Completed, key)
+	}
+}
@@ -0,0 +1,186 @@
+package cwl
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+)
+
+// FileRegistry persists the registry items on the local filesystem,
+// one json file per stream under Directory
+type FileRegistry struct {
+	Directory string
+}
+
+func NewFileRegistry(directory string) (Registry, error) {
+	if err := os.MkdirAll(directory, 0750); err != nil {
+		return nil, err
+	}
+	return &FileRegistry{Directory: directory}, nil
+}
+
+func (registry *FileRegistry) ReadStreamInfo(stream *Stream) error {
+	var item RegistryItem
+	found, err := registry.readItem(registry.GetPathForStream(stream), &item)
+	if err != nil || !found {
+		return err
+	}
+	stream.restore(&item)
+	return nil
+}
+
+func (registry *FileRegistry) WriteStreamInfo(stream *Stream, item *RegistryItem) error {
+	return registry.writeItem(registry.GetPathForStream(stream), item)
+}
+
+func (registry *FileRegistry) DeleteStreamInfo(stream *Stream) error {
+	return registry.deleteItem(registry.GetPathForStream(stream))
+}
+
+func (registry *FileRegistry) ReadGroupInfo(group *Group) (*GroupRegistryItem, error) {
+	var item GroupRegistryItem
+	found, err := registry.readItem(registry.getPath(generateGroupKey(group)), &item)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func (registry *FileRegistry) WriteGroupInfo(group *Group, item *GroupRegistryItem) error {
+	return registry.writeItem(registry.getPath(generateGroupKey(group)), item)
+}
+
+func (registry *FileRegistry) DeleteGroupInfo(group *Group) error {
+	return registry.deleteItem(registry.getPath(generateGroupKey(group)))
+}
+
+func (registry *FileRegistry) ReadShardInfo(shard *Shard) (*ShardRegistryItem, error) {
+	var item ShardRegistryItem
+	found, err := registry.readItem(registry.getPath(generateShardKey(shard)), &item)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func (registry *FileRegistry) WriteShardInfo(shard *Shard, item *ShardRegistryItem) error {
+	return registry.writeItem(registry.getPath(generateShardKey(shard)), item)
+}
+
+func (registry *FileRegistry) ReadExportInfo(object *ExportObject) (*ExportRegistryItem, error) {
+	var item ExportRegistryItem
+	found, err := registry.readItem(registry.getPath(generateExportKey(object)), &item)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func (registry *FileRegistry) WriteExportInfo(object *ExportObject, item *ExportRegistryItem) error {
+	return registry.writeItem(registry.getPath(generateExportKey(object)), item)
+}
+
+// Returns the file path in which the stream's registry item is stored
+func (registry *FileRegistry) GetPathForStream(stream *Stream) string {
+	return registry.getPath(generateKey(stream))
+}
+
+// the maximum length of file names on most filesystems (NAME_MAX)
+const maxFileNameLength = 255
+
+// The key is escaped so that every key maps to a single file in Directory.
+// Keys whose escaped names are too long are truncated and suffixed with
+// their hash, which keeps them unique.
+func (registry *FileRegistry) getPath(key string) string {
+	name := url.PathEscape(key)
+	if len(name)+len(".json") > maxFileNameLength {
+		hash := sha256.Sum256([]byte(key))
+		suffix := "-" + hex.EncodeToString(hash[:])
+		name = name[:maxFileNameLength-len(".json")-len(suffix)] + suffix
+	}
+	return filepath.Join(registry.Directory, name+".json")
+}
+
+// Reads the file at path into item; returns false if the file does
+// not exist
+func (registry *FileRegistry) readItem(path string, item interface{}) (bool, error) {
+	logp.Info("Fetching registry info for %s", path)
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// this is a normal condition when the program
+			// starts monitoring a new stream
+			return false, nil
+		}
+		logp.Warn(fmt.Sprintf("file: failed to read path=%s [message=%s]", path, err.Error()))
+		return false, err
+	}
+	err = json.Unmarshal(body, item)
+	if err != nil {
+		logp.Warn(fmt.Sprintf("file: failed to read path=%s [message=%s]", path, err.Error()))
+		return false, err
+	}
+	return true, nil
+}
+
+func (registry *FileRegistry) writeItem(path string, item interface{}) error {
+	body, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomically(path, body)
+	if err != nil {
+		logp.Warn(fmt.Sprintf("file: failed to write path=%s [message=%s]", path, err.Error()))
+	}
+	return err
+}
+
+func (registry *FileRegistry) deleteItem(path string) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		logp.Warn(fmt.Sprintf("file: failed to delete path=%s [message=%s]", path, err.Error()))
+		return err
+	}
+	return nil
+}
+
+// Writes the contents to a temporary file in the same directory, syncs it
+// and renames it over path so that readers never see a partial file
+func writeFileAtomically(path string, body []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	// cleanup in case of failure (no-op after a successful rename)
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	// sync the directory so that the rename itself is persisted
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
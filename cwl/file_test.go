@@ -0,0 +1,151 @@
+package cwl
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_File_ReadStreamInfo_WhenFileNotFound_ReturnsNil(t *testing.T) {
+	registry, _ := NewFileRegistry(t.TempDir())
+	stream := &Stream{
+		Name:        "stream_name",
+		Group:       &Group{Name: "group_name"},
+		queryParams: &cloudwatchlogs.GetLogEventsInput{},
+	}
+	err := registry.ReadStreamInfo(stream)
+	assert.Nil(t, err)
+	assert.Nil(t, stream.queryParams.NextToken)
+}
+
+func Test_File_ReadStreamInfo_WhenFileIsCorrupt_ReturnsError(t *testing.T) {
+	registry := &FileRegistry{Directory: t.TempDir()}
+	stream := &Stream{
+		Name:        "stream_name",
+		Group:       &Group{Name: "group_name"},
+		queryParams: &cloudwatchlogs.GetLogEventsInput{},
+	}
+	ioutil.WriteFile(registry.GetPathForStream(stream), []byte("not json"), 0640)
+	err := registry.ReadStreamInfo(stream)
+	assert.NotNil(t, err)
+}
+
+func Test_File_WriteStreamInfo_ThenReadStreamInfo_RestoresStream(t *testing.T) {
+	registry, _ := NewFileRegistry(t.TempDir())
+	stream := &Stream{
+		Name:  "2017/06/12/[$LATEST]abcde",
+		Group: &Group{Name: "/aws/lambda/function"},
+		queryParams: &cloudwatchlogs.GetLogEventsInput{
+			NextToken: aws.String("token"),
+		},
+		buffer: *bytes.NewBufferString("This is the buffer"),
+	}
+	err := registry.WriteStreamInfo(stream, stream.checkpoint())
+	assert.Nil(t, err)
+	// reset the stream
+	stream = &Stream{
+		Name:        "2017/06/12/[$LATEST]abcde",
+		Group:       &Group{Name: "/aws/lambda/function"},
+		queryParams: &cloudwatchlogs.GetLogEventsInput{},
+	}
+	err = registry.ReadStreamInfo(stream)
+	assert.Nil(t, err)
+	assert.Equal(t, "token", *stream.queryParams.NextToken)
+	assert.Equal(t, "This is the buffer", stream.buffer.String())
+}
+
+func Test_File_WriteStreamInfo_LeavesNoTemporaryFiles(t *testing.T) {
+	dir := t.TempDir()
+	registry, _ := NewFileRegistry(dir)
+	stream := &Stream{
+		Name:  "stream_name",
+		Group: &Group{Name: "group_name"},
+		queryParams: &cloudwatchlogs.GetLogEventsInput{
+			NextToken: aws.String("token"),
+		},
+	}
+	registry.WriteStreamInfo(stream, stream.checkpoint())
+	registry.WriteStreamInfo(stream, stream.checkpoint())
+	files, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, 1, len(files))
+	assert.Equal(t, "group_name%2Fstream_name.json", files[0].Name())
+}
+
+func Test_File_GetPathForStream_StaysWithinDirectory(t *testing.T) {
+	registry := &FileRegistry{Directory: "/registry"}
+	stream := &Stream{Name: "../../etc", Group: &Group{Name: ".."}}
+	path := registry.GetPathForStream(stream)
+	assert.Equal(t, "/registry", filepath.Dir(path))
+}
+
+func Test_File_WriteStreamInfo_ForLongKeys_HashesTheFileName(t *testing.T) {
+	dir := t.TempDir()
+	registry := &FileRegistry{Directory: dir}
+	group := &Group{Name: "/aws/lambda/" + strings.Repeat("function", 20)}
+	stream := &Stream{Name: strings.Repeat("stream/", 20) + "a", Group: group, queryParams: &cloudwatchlogs.GetLogEventsInput{}}
+	other := &Stream{Name: strings.Repeat("stream/", 20) + "b", Group: group, queryParams: &cloudwatchlogs.GetLogEventsInput{}}
+	stream.queryParams.NextToken = aws.String("token-a")
+	other.queryParams.NextToken = aws.String("token-b")
+	// go!
+	assert.Nil(t, registry.WriteStreamInfo(stream, stream.checkpoint()))
+	assert.Nil(t, registry.WriteStreamInfo(other, other.checkpoint()))
+	// assert
+	files, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, 2, len(files))
+	for _, file := range files {
+		assert.True(t, len(file.Name()) <= maxFileNameLength, file.Name())
+	}
+	stream.queryParams.NextToken = nil
+	assert.Nil(t, registry.ReadStreamInfo(stream))
+	assert.Equal(t, "token-a", aws.StringValue(stream.queryParams.NextToken))
+}
+
+func Test_NewFileRegistry_CreatesDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "nested", "registry")
+	_, err := NewFileRegistry(dir)
+	assert.Nil(t, err)
+	info, err := os.Stat(dir)
+	assert.Nil(t, err)
+	assert.True(t, info.IsDir())
+}
+
+func Test_File_WriteGroupInfo_ThenReadGroupInfo_RestoresItem(t *testing.T) {
+	registry, _ := NewFileRegistry(t.TempDir())
+	group := &Group{Name: "/aws/lambda/function"}
+	item, err := registry.ReadGroupInfo(group)
+	assert.Nil(t, err)
+	assert.Nil(t, item)
+
+	written := &GroupRegistryItem{
+		Timestamp: 12345,
+		EventIds:  []string{"1", "2"},
+		Buffers:   map[string]string{"stream": "This is the buffer"},
+	}
+	err = registry.WriteGroupInfo(group, written)
+	assert.Nil(t, err)
+	item, err = registry.ReadGroupInfo(group)
+	assert.Nil(t, err)
+	assert.Equal(t, written, item)
+}
+
+func Test_File_DeleteStreamInfo_RemovesFile(t *testing.T) {
+	registry, _ := NewFileRegistry(t.TempDir())
+	stream := &Stream{
+		Name:        "stream_name",
+		Group:       &Group{Name: "group_name"},
+		queryParams: &cloudwatchlogs.GetLogEventsInput{NextToken: aws.String("token")},
+	}
+	registry.WriteStreamInfo(stream, stream.checkpoint())
+	assert.Nil(t, registry.DeleteStreamInfo(stream))
+	_, err := os.Stat(registry.(*FileRegistry).GetPathForStream(stream))
+	assert.True(t, os.IsNotExist(err))
+	// deleting a missing item is not an error
+	assert.Nil(t, registry.DeleteStreamInfo(stream))
+}
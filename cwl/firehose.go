@@ -0,0 +1,179 @@
+package cwl
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+)
+
+// the maximum accepted size of a firehose request body
+const firehoseMaxBodySize = 64 << 20
+
+// FirehoseReceiver implements the Kinesis Data Firehose HTTP endpoint
+// delivery protocol for delivery streams into which CloudWatch Logs
+// subscription filters deliver log events. Requests are answered
+// successfully only once all of their events have been acknowledged by the
+// beat pipeline, so that firehose retries the delivery otherwise.
+type FirehoseReceiver struct {
+	Manager *GroupManager
+	Params  *Params
+}
+
+type firehoseRequest struct {
+	RequestId string `json:"requestId"`
+	Timestamp int64  `json:"timestamp"`
+	Records   []struct {
+		Data string `json:"data"`
+	} `json:"records"`
+}
+
+// Counts the bytes read from a request body
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (counter *countingReader) Read(p []byte) (int, error) {
+	n, err := counter.reader.Read(p)
+	counter.count += int64(n)
+	return n, err
+}
+
+type firehoseResponse struct {
+	RequestId    string `json:"requestId"`
+	Timestamp    int64  `json:"timestamp"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+}
+
+func NewFirehoseReceiver(manager *GroupManager) *FirehoseReceiver {
+	return &FirehoseReceiver{
+		Manager: manager,
+		Params:  manager.Params,
+	}
+}
+
+// Serves firehose requests on the configured address (with TLS, if a
+// certificate is configured) until an error occurs or the context is
+// cancelled; in the latter case, the pending requests are completed (for
+// up to shutdown_timeout) and the multiline buffers are published
+func (receiver *FirehoseReceiver) ListenAndServe(ctx context.Context) error {
+	config := receiver.Params.Config
+	server := &http.Server{Addr: config.FirehoseAddress, Handler: receiver}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logp.Warn("firehose: failed to shut down gracefully [%s]", err.Error())
+		}
+	}()
+	logp.Info("[firehose] listening on %s", config.FirehoseAddress)
+	var err error
+	if config.FirehoseSSLCertificate != "" {
+		err = server.ListenAndServeTLS(config.FirehoseSSLCertificate, config.FirehoseSSLKey)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	<-stopped
+	receiver.Manager.flush()
+	logp.Info("[firehose] stopped")
+	return nil
+}
+
+func (receiver *FirehoseReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestId := r.Header.Get("X-Amz-Firehose-Request-Id")
+	if r.Method != http.MethodPost {
+		receiver.respond(w, requestId, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	accessKey := receiver.Params.Config.FirehoseAccessKey
+	if accessKey != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Amz-Firehose-Access-Key")), []byte(accessKey)) != 1 {
+		receiver.respond(w, requestId, http.StatusUnauthorized, "invalid access key")
+		return
+	}
+
+	if r.ContentLength > firehoseMaxBodySize {
+		receiver.respond(w, requestId, http.StatusRequestEntityTooLarge, "request body too large")
+		return
+	}
+	// a byte beyond the limit is read to tell whether the body exceeds it
+	limited := &countingReader{reader: io.LimitReader(r.Body, firehoseMaxBodySize+1)}
+	var body io.Reader = limited
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(body)
+		if err != nil {
+			receiver.respond(w, requestId, http.StatusBadRequest, err.Error())
+			return
+		}
+		defer reader.Close()
+		body = reader
+	}
+	var request firehoseRequest
+	if err := json.NewDecoder(body).Decode(&request); err != nil {
+		if limited.count > firehoseMaxBodySize {
+			receiver.respond(w, requestId, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		receiver.respond(w, requestId, http.StatusBadRequest, err.Error())
+		return
+	}
+	if request.RequestId != "" {
+		requestId = request.RequestId
+	}
+
+	// the batch is committed once all the published events are acknowledged
+	acked := make(chan struct{})
+	queue := &batchQueue{
+		write: func(item interface{}) error {
+			close(acked)
+			return nil
+		},
+	}
+	batch := queue.newBatch()
+	for _, record := range request.Records {
+		data, err := base64.StdEncoding.DecodeString(record.Data)
+		if err == nil {
+			var message *SubscriptionMessage
+			if message, err = DecodeSubscriptionMessage(data); err == nil {
+				receiver.Manager.digestSubscriptionMessage(message, batch)
+			}
+		}
+		if err != nil {
+			logp.Warn("firehose: failed to decode record of request %s [%s]", requestId, err.Error())
+		}
+	}
+	queue.seal(batch, true)
+
+	select {
+	case <-acked:
+		receiver.respond(w, requestId, http.StatusOK, "")
+	case <-time.After(receiver.Params.Config.FirehoseAckTimeout):
+		receiver.respond(w, requestId, http.StatusServiceUnavailable, "timed out waiting for the events to be acknowledged")
+	}
+}
+
+func (receiver *FirehoseReceiver) respond(w http.ResponseWriter, requestId string, status int, errorMessage string) {
+	if errorMessage != "" {
+		logp.Warn("firehose: request %s failed with status %d [%s]", requestId, status, errorMessage)
+	}
+	body, _ := json.Marshal(firehoseResponse{
+		RequestId:    requestId,
+		Timestamp:    time.Now().UnixNano() / 1e6,
+		ErrorMessage: errorMessage,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
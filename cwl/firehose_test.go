@@ -0,0 +1,213 @@
+package cwl
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newFirehoseTestRequest(accessKey string, messages ...*SubscriptionMessage) *http.Request {
+	records := []map[string]string{}
+	for _, message := range messages {
+		data := base64.StdEncoding.EncodeToString(CreateSubscriptionPayload(message))
+		records = append(records, map[string]string{"data": data})
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"requestId": "the-request-id",
+		"timestamp": 1578090901599,
+		"records":   records,
+	})
+	request := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	request.Header.Set("X-Amz-Firehose-Request-Id", "the-request-id")
+	request.Header.Set("X-Amz-Firehose-Access-Key", accessKey)
+	request.Header.Set("Content-Type", "application/json")
+	return request
+}
+
+func decodeFirehoseResponse(recorder *httptest.ResponseRecorder) firehoseResponse {
+	var response firehoseResponse
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	return response
+}
+
+func Test_Firehose_PublishesRecords_AndRespondsOnceAcked(t *testing.T) {
+	publisher, events := CreateCollectingPublisher(true)
+	params := &Params{
+		Config: &Config{
+			FirehoseAccessKey:  "the-access-key",
+			FirehoseAckTimeout: 100 * time.Millisecond,
+			Prospectors:        []Prospector{{Id: "lambda", GroupNames: []string{"/aws/lambda/*"}}},
+		},
+		Publisher: publisher,
+	}
+	receiver := NewFirehoseReceiver(NewGroupManager(params))
+	request := newFirehoseTestRequest("the-access-key",
+		CreateSubscriptionMessage("/aws/lambda/function", "stream", "Event 1\n", "Event 2\n"),
+		CreateSubscriptionMessage("/aws/ecs/service", "stream", "Event 3\n"),
+	)
+	recorder := httptest.NewRecorder()
+	// go!
+	receiver.ServeHTTP(recorder, request)
+	// assert
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	response := decodeFirehoseResponse(recorder)
+	assert.Equal(t, "the-request-id", response.RequestId)
+	assert.True(t, response.Timestamp > 0)
+	assert.Equal(t, "", response.ErrorMessage)
+	assert.Equal(t, 2, len(*events))
+	assert.Equal(t, "lambda", (*events)[0].Stream.Group.Prospector.Id)
+}
+
+func Test_Firehose_RespondsWithError_WhenEventsAreNotAcked(t *testing.T) {
+	publisher, events := CreateCollectingPublisher(false)
+	params := &Params{
+		Config: &Config{
+			FirehoseAccessKey:  "the-access-key",
+			FirehoseAckTimeout: 100 * time.Millisecond,
+			Prospectors:        []Prospector{{Id: "lambda", GroupNames: []string{"/aws/lambda/*"}}},
+		},
+		Publisher: publisher,
+	}
+	receiver := NewFirehoseReceiver(NewGroupManager(params))
+	request := newFirehoseTestRequest("the-access-key",
+		CreateSubscriptionMessage("/aws/lambda/function", "stream", "Event 1\n"),
+	)
+	recorder := httptest.NewRecorder()
+	// go!
+	receiver.ServeHTTP(recorder, request)
+	// assert
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.NotEqual(t, "", decodeFirehoseResponse(recorder).ErrorMessage)
+	assert.Equal(t, 1, len(*events))
+}
+
+func Test_Firehose_RespondsImmediately_WhenNothingIsPublished(t *testing.T) {
+	publisher, _ := CreateCollectingPublisher(false)
+	params := &Params{
+		Config: &Config{
+			FirehoseAccessKey:  "the-access-key",
+			FirehoseAckTimeout: 100 * time.Millisecond,
+			Prospectors:        []Prospector{{Id: "lambda", GroupNames: []string{"/aws/lambda/*"}}},
+		},
+		Publisher: publisher,
+	}
+	receiver := NewFirehoseReceiver(NewGroupManager(params))
+	request := newFirehoseTestRequest("the-access-key",
+		CreateSubscriptionMessage("/aws/ecs/service", "stream", "Event 1\n"),
+	)
+	recorder := httptest.NewRecorder()
+	// go!
+	receiver.ServeHTTP(recorder, request)
+	// assert
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func Test_Firehose_RejectsInvalidAccessKey(t *testing.T) {
+	publisher, events := CreateCollectingPublisher(true)
+	params := &Params{
+		Config: &Config{
+			FirehoseAccessKey:  "the-access-key",
+			FirehoseAckTimeout: 100 * time.Millisecond,
+			Prospectors:        []Prospector{{Id: "lambda", GroupNames: []string{"/aws/lambda/*"}}},
+		},
+		Publisher: publisher,
+	}
+	receiver := NewFirehoseReceiver(NewGroupManager(params))
+	request := newFirehoseTestRequest("wrong-key",
+		CreateSubscriptionMessage("/aws/lambda/function", "stream", "Event 1\n"),
+	)
+	recorder := httptest.NewRecorder()
+	// go!
+	receiver.ServeHTTP(recorder, request)
+	// assert
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Equal(t, "the-request-id", decodeFirehoseResponse(recorder).RequestId)
+	assert.Equal(t, 0, len(*events))
+}
+
+func Test_Firehose_RejectsInvalidRequests(t *testing.T) {
+	publisher, _ := CreateCollectingPublisher(true)
+	params := &Params{
+		Config: &Config{
+			FirehoseAccessKey:  "the-access-key",
+			FirehoseAckTimeout: 100 * time.Millisecond,
+			Prospectors:        []Prospector{{Id: "lambda", GroupNames: []string{"/aws/lambda/*"}}},
+		},
+		Publisher: publisher,
+	}
+	receiver := NewFirehoseReceiver(NewGroupManager(params))
+	request := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString("not json"))
+	request.Header.Set("X-Amz-Firehose-Access-Key", "the-access-key")
+	recorder := httptest.NewRecorder()
+	receiver.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	request = httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder = httptest.NewRecorder()
+	receiver.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+}
+
+func Test_Firehose_ServesOverHTTP(t *testing.T) {
+	publisher, events := CreateCollectingPublisher(true)
+	params := &Params{
+		Config: &Config{
+			FirehoseAccessKey:  "the-access-key",
+			FirehoseAckTimeout: 100 * time.Millisecond,
+			Prospectors:        []Prospector{{Id: "lambda", GroupNames: []string{"/aws/lambda/*"}}},
+		},
+		Publisher: publisher,
+	}
+	receiver := NewFirehoseReceiver(NewGroupManager(params))
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	request := newFirehoseTestRequest("the-access-key",
+		CreateSubscriptionMessage("/aws/lambda/function", "stream", "Event 1\n"),
+	)
+	request.RequestURI = ""
+	request.URL, _ = request.URL.Parse(server.URL)
+	// go!
+	response, err := http.DefaultClient.Do(request)
+	// assert
+	assert.Nil(t, err)
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, 1, len(*events))
+}
+
+// an endless body of whitespace
+type whitespaceReader struct{}
+
+func (whitespaceReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = ' '
+	}
+	return len(p), nil
+}
+
+func Test_Firehose_RejectsTooLargeBodies(t *testing.T) {
+	params := &Params{Config: &Config{}}
+	receiver := NewFirehoseReceiver(NewGroupManager(params))
+	// the body's length is unknown
+	request := httptest.NewRequest(http.MethodPost, "/", io.MultiReader(bytes.NewBufferString("{"), whitespaceReader{}))
+	recorder := httptest.NewRecorder()
+	// go!
+	receiver.ServeHTTP(recorder, request)
+	// assert
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+
+	// the body's length is declared
+	request = httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString("{}"))
+	request.ContentLength = firehoseMaxBodySize + 1
+	recorder = httptest.NewRecorder()
+	receiver.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+}
@@ -1,42 +1,95 @@
 package cwl
 
 import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
 	"github.com/elastic/beats/v7/libbeat/logp"
 )
 
 type Group struct {
 	Name           string
+	Region         string // empty for the groups of aws_region
+	Account        string // empty for the groups of the beat's own account
+	subscribed     bool   // true for the groups of subscription messages, whose region is unknown
 	Prospector     *Prospector
 	Params         *Params
+	config         *Config // the effective config of the prospector
 	streams        map[string]*Stream
 	mutex          *sync.RWMutex // synchronize access to the Streams map
 	newStreams     int
 	removedStreams int
+
+	// the prospector's stream name filters
+	includeStreams []*regexp.Regexp
+	excludeStreams []*regexp.Regexp
+
+	ctx     context.Context // cancelled when the group's streams must stop
+	running sync.WaitGroup  // the streams being monitored
+
+	// lifecycle state, set by the manager that monitors the group
+	stop     context.CancelFunc // stops monitoring the group
+	finished chan<- *Group      // channel for the group to signal that it does not exist anymore
+	removed  bool               // true if the group is stopped because it was removed
+
+	// group mode state
+	cursor   int64            // the start of the next time window (milliseconds since 1970)
+	seen     map[string]int64 // timestamps of the events seen in the lookback window by id
+	restored bool             // true once the state has been read from the registry
+	acks     *batchQueue
 }
 
 func NewGroup(name string, prospector *Prospector, params *Params) *Group {
-	return &Group{
+	group := &Group{
 		Name:       name,
 		Prospector: prospector,
 		Params:     params,
+		config:     params.Config.ProspectorConfig(prospector),
 		streams:    make(map[string]*Stream),
 		mutex:      &sync.RWMutex{},
+		seen:       make(map[string]int64),
+		ctx:        context.Background(),
 	}
+	var err error
+	group.includeStreams, err = compileRegexes(prospector.StreamInclude)
+	Fatal(err)
+	group.excludeStreams, err = compileRegexes(prospector.StreamExclude)
+	Fatal(err)
+	group.acks = &batchQueue{
+		write: func(item interface{}) error {
+			if _, ok := item.(registryDeletion); ok {
+				return group.Params.Registry.DeleteGroupInfo(group)
+			}
+			return group.Params.Registry.WriteGroupInfo(group, item.(*GroupRegistryItem))
+		},
+	}
+	return group
 }
 
-func (group *Group) RefreshStreams() {
+// Adds the group's new streams that are not expired; returns the error
+// (if any) otherwise nil
+func (group *Group) RefreshStreams() error {
 	params := &cloudwatchlogs.DescribeLogStreamsInput{
 		LogGroupName: aws.String(group.Name),
 		Descending:   aws.Bool(true),
 		OrderBy:      aws.String("LastEventTime"),
 	}
+	// the streams can not be ordered by their last event when a prefix is used
+	if group.Prospector.StreamPrefix != "" {
+		params = &cloudwatchlogs.DescribeLogStreamsInput{
+			LogGroupName:        aws.String(group.Name),
+			LogStreamNamePrefix: aws.String(group.Prospector.StreamPrefix),
+		}
+	}
 
-	err := group.Params.AWSClient.DescribeLogStreamsPages(
+	err := group.client().DescribeLogStreamsPages(
 		params,
 		func(page *cloudwatchlogs.DescribeLogStreamsOutput, lastPage bool) bool {
 			for _, logStream := range page.LogStreams {
@@ -45,13 +98,17 @@ func (group *Group) RefreshStreams() {
 				group.mutex.RLock()
 				_, ok := group.streams[name]
 				group.mutex.RUnlock()
+				// is the stream filtered out?
+				if !ok && !group.matchStreamName(name) {
+					continue
+				}
 				// is this an empty stream?
 				if logStream.LastEventTimestamp == nil {
 					logp.Debug("GROUP", "%s/%s has a nil timestamp", group.Name, name)
 					continue
 				}
 				// is the stream expired?
-				expired := IsBefore(group.Params.Config.StreamEventHorizon,
+				expired := IsBefore(group.config.StreamEventHorizon,
 					*logStream.LastEventTimestamp)
 				// is this a stream that we're not monitoring and it is not expired?
 				if !ok && !expired {
@@ -60,9 +117,42 @@ func (group *Group) RefreshStreams() {
 			}
 			return true
 		})
-	if err != nil {
-		logp.Err("%s %s", group.Name, err.Error())
+	return err
+}
+
+func (group *Group) client() cloudwatchlogsiface.CloudWatchLogsAPI {
+	return group.Params.Client(group.Account, group.Region)
+}
+
+// Returns the key of the group, which is its name for the groups of the
+// beat's own account in aws_region, so that their registry keys are not
+// affected by other accounts and regions
+func (group *Group) key() string {
+	return groupKey(group.Account, group.Region, group.Name)
+}
+
+// group names can not contain colons, so the keys of groups in other
+// accounts or regions never collide with the names of groups in
+// aws_region; account ids are numeric, so they are never mistaken for
+// regions
+func groupKey(account string, region string, name string) string {
+	key := name
+	if region != "" {
+		key = region + ":" + key
+	}
+	if account != "" {
+		key = account + ":" + key
 	}
+	return key
+}
+
+// Splits the key of a group without a region into its account and name;
+// group names can not contain colons
+func splitGroupKey(key string) (string, string) {
+	if index := strings.Index(key, ":"); index >= 0 {
+		return key[:index], key[index+1:]
+	}
+	return "", key
 }
 
 func (group *Group) removeStream(stream *Stream) {
@@ -74,13 +164,27 @@ func (group *Group) removeStream(stream *Stream) {
 }
 
 func (group *Group) addNewStream(name string) {
+	if scheduler := group.Params.Scheduler; scheduler != nil {
+		stream := NewStream(name, group, group.Prospector.Multiline, nil, group.Params)
+		logp.Info("Start monitoring stream %s for group %s", stream.Name, group.Name)
+		group.mutex.Lock()
+		group.streams[name] = stream
+		group.mutex.Unlock()
+		scheduler.Add(stream)
+		group.newStreams++
+		return
+	}
 	finished := make(chan bool)
 	stream := NewStream(name, group, group.Prospector.Multiline, finished, group.Params)
 	logp.Info("Start monitoring stream %s for group %s", stream.Name, group.Name)
 	group.mutex.Lock()
 	group.streams[name] = stream
 	group.mutex.Unlock()
-	go stream.Monitor()
+	group.running.Add(1)
+	go func() {
+		defer group.running.Done()
+		stream.Monitor(group.ctx)
+	}()
 	go func() {
 		<-finished
 		group.removeStream(stream)
@@ -88,23 +192,286 @@ func (group *Group) addNewStream(name string) {
 	group.newStreams++
 }
 
-func (group *Group) Monitor() {
+// Reads the group mode state from the registry. Streams that were
+// buffering multiline events are recreated with their buffers.
+func (group *Group) restore() error {
+	item, err := group.Params.Registry.ReadGroupInfo(group)
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		group.cursor = group.Prospector.startTime(group.config.StreamEventHorizon)
+	} else {
+		group.cursor = item.Timestamp
+		for _, id := range item.EventIds {
+			group.seen[id] = item.Timestamp
+		}
+		for name, buffer := range item.Buffers {
+			group.dispatchStream(name).restoreBuffer(buffer, item.BufferTimestamps[name])
+		}
+		for name, buffers := range item.KeyedBuffers {
+			group.dispatchStream(name).restoreKeyed(buffers)
+		}
+	}
+	group.restored = true
+	return nil
+}
+
+// Fetches the events of the whole group since the last poll using
+// FilterLogEvents and dispatches them to their streams. Events already
+// seen in the lookback window are skipped.
+func (group *Group) Filter() error {
+	if !group.restored {
+		if err := group.restore(); err != nil {
+			return err
+		}
+	}
+	lookback := group.Prospector.filterLookback().Nanoseconds() / 1e6
+	// FilterLogEvents rejects negative start times, e.g. of the groups
+	// read from the beginning
+	startTime := group.cursor - lookback
+	if startTime < 0 {
+		startTime = 0
+	}
+	params := &cloudwatchlogs.FilterLogEventsInput{
+		LogGroupName: aws.String(group.Name),
+		StartTime:    aws.Int64(startTime),
+	}
+	if group.Prospector.FilterPattern != "" {
+		params.FilterPattern = aws.String(group.Prospector.FilterPattern)
+	}
+	if group.Prospector.StreamPrefix != "" {
+		params.LogStreamNamePrefix = aws.String(group.Prospector.StreamPrefix)
+	}
+	batch := group.acks.newBatch()
+	latest := group.cursor
+	err := group.client().FilterLogEventsPages(
+		params,
+		func(page *cloudwatchlogs.FilterLogEventsOutput, lastPage bool) bool {
+			for _, event := range page.Events {
+				id := aws.StringValue(event.EventId)
+				if _, ok := group.seen[id]; ok {
+					continue
+				}
+				timestamp := aws.Int64Value(event.Timestamp)
+				group.seen[id] = timestamp
+				if timestamp > latest {
+					latest = timestamp
+				}
+				if !group.matchStreamName(aws.StringValue(event.LogStreamName)) {
+					continue
+				}
+				stream := group.dispatchStream(aws.StringValue(event.LogStreamName))
+				stream.batch = batch
+				stream.digest(&cloudwatchlogs.OutputLogEvent{
+					Message:       event.Message,
+					Timestamp:     event.Timestamp,
+					IngestionTime: event.IngestionTime,
+				})
+				stream.batch = nil
+				stream.LastEventTimestamp = timestamp
+			}
+			return true
+		})
+	group.cursor = latest
+	// forget the events that have fallen out of the lookback window
+	for id, timestamp := range group.seen {
+		if timestamp < latest-lookback {
+			delete(group.seen, id)
+		}
+	}
+	group.flushTimedOutStreams(batch)
+	group.removeExpiredStreams()
+	if sealErr := group.acks.seal(batch, group.checkpoint()); err == nil {
+		err = sealErr
+	}
+	return err
+}
+
+// Returns the stream that holds the multiline state of the named stream
+// in group mode; such streams are not monitored on their own
+func (group *Group) dispatchStream(name string) *Stream {
+	group.mutex.RLock()
+	stream, ok := group.streams[name]
+	group.mutex.RUnlock()
+	if !ok {
+		stream = NewStream(name, group, group.Prospector.Multiline, nil, group.Params)
+		group.mutex.Lock()
+		group.streams[name] = stream
+		group.mutex.Unlock()
+		group.newStreams++
+	}
+	return stream
+}
+
+// Returns true if the stream name is not filtered out by the prospector's
+// stream prefix, include or exclude expressions
+func (group *Group) matchStreamName(name string) bool {
+	if !strings.HasPrefix(name, group.Prospector.StreamPrefix) {
+		return false
+	}
+	for _, regex := range group.excludeStreams {
+		if regex.MatchString(name) {
+			return false
+		}
+	}
+	if len(group.includeStreams) == 0 {
+		return true
+	}
+	for _, regex := range group.includeStreams {
+		if regex.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Publishes the incomplete multiline events of the group mode streams
+// that have timed out; the group's events are always polled up to now
+func (group *Group) flushTimedOutStreams(batch *eventBatch) {
+	now := time.Now().UnixNano() / 1e6
+	group.mutex.RLock()
+	defer group.mutex.RUnlock()
+	for _, stream := range group.streams {
+		if stream.timedOut(now) {
+			stream.batch = batch
+			stream.flushTimedOut(now)
+			stream.batch = nil
+		}
+	}
+}
+
+// Forgets the group mode streams that have no buffered content and
+// whose last event is before the horizon
+func (group *Group) removeExpiredStreams() {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	for name, stream := range group.streams {
+		if !stream.hasBuffer() &&
+			IsBefore(group.config.StreamEventHorizon, stream.LastEventTimestamp) {
+			delete(group.streams, name)
+			group.removedStreams++
+		}
+	}
+}
+
+// the maximum number of event ids in the registry item of a group, which
+// keeps the item below the size limit of DynamoDB items (400KB)
+const maxCheckpointEventIds = 4000
+
+// Returns the registry item that represents the group mode state
+func (group *Group) checkpoint() *GroupRegistryItem {
+	item := &GroupRegistryItem{
+		Timestamp: group.cursor,
+		EventIds:  make([]string, 0, len(group.seen)),
+		Buffers:   make(map[string]string),
+
+		BufferTimestamps: make(map[string]int64),
+		KeyedBuffers:     make(map[string][]KeyedBuffer),
+	}
+	for id := range group.seen {
+		item.EventIds = append(item.EventIds, id)
+	}
+	// only the ids of the latest events are kept; the older ones may be
+	// published again if the beat is restarted
+	if len(item.EventIds) > maxCheckpointEventIds {
+		sort.Slice(item.EventIds, func(i, j int) bool {
+			return group.seen[item.EventIds[i]] > group.seen[item.EventIds[j]]
+		})
+		item.EventIds = item.EventIds[:maxCheckpointEventIds]
+	}
+	sort.Strings(item.EventIds)
+	group.mutex.RLock()
+	for name, stream := range group.streams {
+		if stream.buffer.Len() > 0 {
+			item.Buffers[name] = stream.buffer.String()
+			item.BufferTimestamps[name] = stream.bufferStart
+		}
+		if len(stream.keyed) > 0 {
+			item.KeyedBuffers[name] = stream.keyedCheckpoint()
+		}
+	}
+	group.mutex.RUnlock()
+	return item
+}
+
+// Continuously monitors the group until the context is cancelled, in
+// which case the group is drained before monitoring stops. If the group
+// does not exist anymore, it sends itself to the finished channel for the
+// manager to stop it.
+func (group *Group) Monitor(ctx context.Context) {
 	logp.Info("[group] %s started", group.Name)
 	defer logp.Info("[group] %s stopped", group.Name)
+	group.ctx = ctx
 	reportTicker := time.NewTicker(group.Params.Config.ReportFrequency)
 	defer reportTicker.Stop()
-	streamRefreshTicker := time.NewTicker(group.Params.Config.StreamRefreshFrequency)
-	defer streamRefreshTicker.Stop()
+	// in group mode, the group's events are polled instead of its streams
+	refresh := group.RefreshStreams
+	refreshFrequency := group.config.StreamRefreshFrequency
+	if group.Prospector.Mode == GroupMode {
+		refresh = group.Filter
+		refreshFrequency = group.config.StreamEventRefreshFrequency
+	}
+	refreshTicker := time.NewTicker(refreshFrequency)
+	defer refreshTicker.Stop()
 	for {
 		select {
-		case <-streamRefreshTicker.C:
-			group.RefreshStreams()
+		case <-ctx.Done():
+			group.drain()
+			return
+		case <-refreshTicker.C:
+			err := refresh()
+			if err == nil {
+				continue
+			}
+			logp.Err("%s %s", group.Name, err.Error())
+			if classifyError(err) == NotFoundError && group.finished != nil {
+				select {
+				case group.finished <- group:
+				case <-ctx.Done():
+				}
+			}
 		case <-reportTicker.C:
 			group.report()
 		}
 	}
 }
 
+// Waits for the monitored streams to drain or, in group mode, publishes
+// the multiline buffers of the streams and commits the group's final
+// state once their events are acknowledged. The registry items of a
+// removed group are deleted afterwards if cleanup_registry is enabled.
+func (group *Group) drain() {
+	if group.Prospector.Mode != GroupMode {
+		if scheduler := group.Params.Scheduler; scheduler != nil {
+			for _, stream := range scheduler.remove(group) {
+				stream.stop()
+			}
+		}
+		group.running.Wait()
+		return
+	}
+	batch := group.acks.newBatch()
+	group.mutex.RLock()
+	for _, stream := range group.streams {
+		stream.batch = batch
+		stream.flushPartial()
+		if group.removed {
+			stream.flushKeyed()
+		}
+		stream.batch = nil
+	}
+	group.mutex.RUnlock()
+	if err := group.acks.seal(batch, group.checkpoint()); err != nil {
+		logp.Err("%s %s", group.Name, err.Error())
+	}
+	if group.removed && group.Params.Config.CleanupRegistry {
+		if err := group.acks.seal(group.acks.newBatch(), registryDeletion{}); err != nil {
+			logp.Err("%s %s", group.Name, err.Error())
+		}
+	}
+}
+
 func (group *Group) report() {
 	n := len(group.streams)
 	logp.Info("report[group] %d %d %d %s %s", n, group.newStreams, group.removedStreams, group.Name, group.Params.Config.ReportFrequency)
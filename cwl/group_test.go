@@ -1,6 +1,8 @@
 package cwl
 
 import (
+	"context"
+	"strconv"
 	"testing"
 	"time"
 
@@ -17,7 +19,7 @@ func Test_Group_WillAdd_NewStream(t *testing.T) {
 	client := &MockCWLClient{}
 	registry := &MockRegistry{}
 	registry.On("ReadStreamInfo", mock.AnythingOfType("*cwl.Stream")).Return(nil)
-	registry.On("WriteStreamInfo", mock.AnythingOfType("*cwl.Stream")).Return(nil)
+	registry.On("WriteStreamInfo", mock.AnythingOfType("*cwl.Stream"), mock.AnythingOfType("*cwl.RegistryItem")).Return(nil)
 	config := &Config{
 		StreamEventHorizon: horizon,
 		ReportFrequency:    1 * time.Minute,
@@ -67,7 +69,7 @@ func Test_Group_WillNotAdd_NewExpiredStream(t *testing.T) {
 	client := &MockCWLClient{}
 	registry := &MockRegistry{}
 	registry.On("ReadStreamInfo", mock.AnythingOfType("*cwl.Stream")).Return(nil)
-	registry.On("WriteStreamInfo", mock.AnythingOfType("*cwl.Stream")).Return(nil)
+	registry.On("WriteStreamInfo", mock.AnythingOfType("*cwl.Stream"), mock.AnythingOfType("*cwl.RegistryItem")).Return(nil)
 	config := &Config{
 		StreamEventHorizon: horizon,
 		ReportFrequency:    1 * time.Minute,
@@ -114,7 +116,7 @@ func Test_Group_WillSkip_StreamWithNoLastEventTimestamp(t *testing.T) {
 	eventTimestamp := TimeBeforeNowInMilliseconds(1 * time.Hour)
 	registry := &MockRegistry{}
 	registry.On("ReadStreamInfo", mock.AnythingOfType("*cwl.Stream")).Return(nil)
-	registry.On("WriteStreamInfo", mock.AnythingOfType("*cwl.Stream")).Return(nil)
+	registry.On("WriteStreamInfo", mock.AnythingOfType("*cwl.Stream"), mock.AnythingOfType("*cwl.RegistryItem")).Return(nil)
 
 	client := &MockCWLClient{}
 	config := &Config{
@@ -163,3 +165,325 @@ func Test_Group_WillSkip_StreamWithNoLastEventTimestamp(t *testing.T) {
 	_, ok := group.streams["problematic_stream"]
 	assert.False(t, ok)
 }
+
+func CreateFilteredLogEvent(id string, stream string, message string, timestamp int64) *cloudwatchlogs.FilteredLogEvent {
+	return &cloudwatchlogs.FilteredLogEvent{
+		EventId:       aws.String(id),
+		LogStreamName: aws.String(stream),
+		Message:       aws.String(message),
+		Timestamp:     aws.Int64(timestamp),
+	}
+}
+
+// stubs FilterLogEventsPages to return the events after the input's start
+// time and to capture its input
+func stubFilterLogEventsPages(client *MockCWLClient, inputs *[]*cloudwatchlogs.FilterLogEventsInput,
+	events ...*cloudwatchlogs.FilteredLogEvent) {
+
+	client.On(
+		"FilterLogEventsPages",
+		mock.AnythingOfType("*cloudwatchlogs.FilterLogEventsInput"),
+		mock.AnythingOfType("func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool"),
+	).Return(nil).Run(
+		func(args mock.Arguments) {
+			input := args.Get(0).(*cloudwatchlogs.FilterLogEventsInput)
+			*inputs = append(*inputs, input)
+			output := &cloudwatchlogs.FilterLogEventsOutput{}
+			for _, event := range events {
+				if *event.Timestamp >= *input.StartTime {
+					output.Events = append(output.Events, event)
+				}
+			}
+			f := args.Get(1).(func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool)
+			f(output, true)
+		},
+	)
+}
+
+func Test_Group_Filter_DispatchesEventsToStreams_AndSkipsSeenEvents(t *testing.T) {
+	timestamp := TimeBeforeNowInMilliseconds(5 * time.Minute)
+	client := &MockCWLClient{}
+	inputs := []*cloudwatchlogs.FilterLogEventsInput{}
+	stubFilterLogEventsPages(client, &inputs,
+		CreateFilteredLogEvent("1", "stream_a", "Event 1\n", timestamp),
+		CreateFilteredLogEvent("2", "stream_b", "Event 2\n", timestamp+1000),
+	)
+	publisher, events := CreateCollectingPublisher(false)
+	params := &Params{
+		Config:    &Config{StreamEventHorizon: time.Hour},
+		Registry:  NewDummyRegistry(),
+		AWSClient: client,
+		Publisher: publisher,
+	}
+	// without a lookback, the events older than the cursor are forgotten
+	var lookback time.Duration
+	group := NewGroup("group", &Prospector{Mode: GroupMode, FilterLookback: &lookback}, params)
+
+	// go!
+	assert.Nil(t, group.Filter())
+	assert.Nil(t, group.Filter())
+	// assert
+	assert.Equal(t, 2, len(*events))
+	assert.Equal(t, "stream_a", (*events)[0].Stream.Name)
+	assert.Equal(t, "stream_b", (*events)[1].Stream.Name)
+	assert.Equal(t, 2, len(group.streams))
+	assert.Equal(t, timestamp+1000, *inputs[1].StartTime)
+	assert.Equal(t, timestamp+1000, group.cursor)
+	// the first event is older than the cursor and has been forgotten
+	assert.Equal(t, map[string]int64{"2": timestamp + 1000}, group.seen)
+}
+
+func Test_Group_Filter_WritesCheckpoint_WhenEventsAreAcked(t *testing.T) {
+	timestamp := TimeBeforeNowInMilliseconds(5 * time.Minute)
+	client := &MockCWLClient{}
+	inputs := []*cloudwatchlogs.FilterLogEventsInput{}
+	stubFilterLogEventsPages(client, &inputs,
+		CreateFilteredLogEvent("1", "stream_a", "line\n", timestamp),
+		CreateFilteredLogEvent("2", "stream_a", "END\n", timestamp),
+		CreateFilteredLogEvent("3", "stream_b", "partial\n", timestamp),
+	)
+	publisher, events := CreateCollectingPublisher(false)
+	registry := NewDummyRegistry()
+	params := &Params{
+		Config:    &Config{StreamEventHorizon: time.Hour},
+		Registry:  registry,
+		AWSClient: client,
+		Publisher: publisher,
+	}
+	prospector := &Prospector{
+		Mode:      GroupMode,
+		Multiline: &Multiline{Pattern: "^END", Negate: true, Match: "before"},
+	}
+	group := NewGroup("group", prospector, params)
+
+	// go!
+	group.Filter()
+	item, _ := registry.ReadGroupInfo(group)
+	assert.Nil(t, item)
+	AckEvents(1, []interface{}{(*events)[0].batch})
+	// assert
+	item, _ = registry.ReadGroupInfo(group)
+	assert.Equal(t, 1, len(*events))
+	assert.Equal(t, "line\nEND\n", (*events)[0].Message)
+	assert.Equal(t, timestamp, item.Timestamp)
+	assert.Equal(t, []string{"1", "2", "3"}, item.EventIds)
+	assert.Equal(t, map[string]string{"stream_b": "partial\n"}, item.Buffers)
+}
+
+func Test_Group_Filter_FromTheBeginning_StartsAtZero(t *testing.T) {
+	client := &MockCWLClient{}
+	inputs := []*cloudwatchlogs.FilterLogEventsInput{}
+	stubFilterLogEventsPages(client, &inputs)
+	params := &Params{
+		Config:    &Config{StreamEventHorizon: time.Hour},
+		Registry:  NewDummyRegistry(),
+		AWSClient: client,
+	}
+	group := NewGroup("group", &Prospector{Mode: GroupMode, StartPosition: StartPositionBeginning}, params)
+
+	// go!
+	assert.Nil(t, group.Filter())
+	// assert
+	assert.Equal(t, int64(0), *inputs[0].StartTime)
+}
+
+func Test_Group_Checkpoint_KeepsTheIdsOfTheLatestEvents(t *testing.T) {
+	params := &Params{Config: &Config{StreamEventHorizon: time.Hour}}
+	group := NewGroup("group", &Prospector{Mode: GroupMode}, params)
+	timestamp := TimeBeforeNowInMilliseconds(time.Minute)
+	group.seen["oldest"] = timestamp - 1
+	for i := 0; i < maxCheckpointEventIds; i++ {
+		group.seen[strconv.Itoa(i)] = timestamp
+	}
+
+	// go!
+	item := group.checkpoint()
+	// assert
+	assert.Equal(t, maxCheckpointEventIds, len(item.EventIds))
+	assert.NotContains(t, item.EventIds, "oldest")
+}
+
+func Test_Group_Filter_RestoresStateFromRegistry(t *testing.T) {
+	timestamp := TimeBeforeNowInMilliseconds(5 * time.Minute)
+	client := &MockCWLClient{}
+	inputs := []*cloudwatchlogs.FilterLogEventsInput{}
+	stubFilterLogEventsPages(client, &inputs)
+	registry := &MockRegistry{}
+	registry.On("ReadGroupInfo", mock.AnythingOfType("*cwl.Group")).Return(
+		&GroupRegistryItem{
+			Timestamp: timestamp,
+			EventIds:  []string{"1"},
+			Buffers:   map[string]string{"stream_b": "partial\n"},
+		}, nil)
+	registry.On("WriteGroupInfo", mock.AnythingOfType("*cwl.Group"), mock.AnythingOfType("*cwl.GroupRegistryItem")).Return(nil)
+	params := &Params{
+		Config:    &Config{StreamEventHorizon: time.Hour},
+		Registry:  registry,
+		AWSClient: client,
+	}
+	lookback := time.Minute
+	prospector := &Prospector{Mode: GroupMode, FilterLookback: &lookback}
+	group := NewGroup("group", prospector, params)
+
+	// go!
+	group.Filter()
+	// assert
+	assert.Equal(t, timestamp-60000, *inputs[0].StartTime)
+	assert.Equal(t, "partial\n", group.streams["stream_b"].buffer.String())
+	_, ok := group.seen["1"]
+	assert.True(t, ok)
+}
+
+func Test_Group_Monitor_DrainsTheBuffers_WhenCancelled(t *testing.T) {
+	timestamp := TimeBeforeNowInMilliseconds(5 * time.Minute)
+	client := &MockCWLClient{}
+	inputs := []*cloudwatchlogs.FilterLogEventsInput{}
+	stubFilterLogEventsPages(client, &inputs,
+		CreateFilteredLogEvent("1", "stream_a", "partial\n", timestamp),
+	)
+	publisher, events := CreateCollectingPublisher(true)
+	registry := NewDummyRegistry()
+	params := &Params{
+		Config: &Config{
+			StreamEventHorizon:          time.Hour,
+			StreamEventRefreshFrequency: time.Hour,
+			ReportFrequency:             time.Hour,
+		},
+		Registry:  registry,
+		AWSClient: client,
+		Publisher: publisher,
+	}
+	prospector := &Prospector{
+		Mode:      GroupMode,
+		Multiline: &Multiline{Pattern: "^END", Negate: true, Match: "before"},
+	}
+	group := NewGroup("group", prospector, params)
+	group.Filter()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// go!
+	group.Monitor(ctx)
+	// assert
+	assert.Equal(t, 1, len(*events))
+	assert.Equal(t, "partial\n", (*events)[0].Message)
+	assert.True(t, (*events)[0].Partial)
+	item, _ := registry.ReadGroupInfo(group)
+	assert.Equal(t, timestamp, item.Timestamp)
+	assert.Equal(t, map[string]string{}, item.Buffers)
+}
+
+func Test_Group_MatchStreamName(t *testing.T) {
+	testCases := []struct {
+		prospector *Prospector
+		name       string
+		match      bool
+	}{
+		{&Prospector{}, "2020/01/01/[$LATEST]abcde", true},
+		{&Prospector{StreamInclude: []string{`\[\$LATEST\]`}}, "2020/01/01/[$LATEST]abcde", true},
+		{&Prospector{StreamInclude: []string{`\[\$LATEST\]`}}, "2020/01/01/[12]abcde", false},
+		{&Prospector{StreamExclude: []string{`\[12\]`}}, "2020/01/01/[12]abcde", false},
+		{&Prospector{StreamInclude: []string{"^ecs/"}, StreamExclude: []string{"/debug/"}}, "ecs/api/1234", true},
+		{&Prospector{StreamInclude: []string{"^ecs/"}, StreamExclude: []string{"/debug/"}}, "ecs/debug/1234", false},
+		{&Prospector{StreamPrefix: "ecs/api/"}, "ecs/api/1234", true},
+		{&Prospector{StreamPrefix: "ecs/api/"}, "ecs/web/1234", false},
+	}
+
+	for _, testCase := range testCases {
+		group := NewGroup("group", testCase.prospector, &Params{Config: &Config{}})
+		assert.Equal(t, testCase.match, group.matchStreamName(testCase.name), testCase.name)
+	}
+}
+
+func Test_Group_RefreshStreams_WithStreamFilters(t *testing.T) {
+	client := &MockCWLClient{}
+	inputs := []*cloudwatchlogs.DescribeLogStreamsInput{}
+	timestamp := TimeBeforeNowInMilliseconds(5 * time.Minute)
+	client.On(
+		"DescribeLogStreamsPages",
+		mock.AnythingOfType("*cloudwatchlogs.DescribeLogStreamsInput"),
+		mock.AnythingOfType("func(*cloudwatchlogs.DescribeLogStreamsOutput, bool) bool"),
+	).Return(nil).Run(
+		func(args mock.Arguments) {
+			inputs = append(inputs, args.Get(0).(*cloudwatchlogs.DescribeLogStreamsInput))
+			output := &cloudwatchlogs.DescribeLogStreamsOutput{}
+			for _, name := range []string{"ecs/api/1", "ecs/api/2-debug"} {
+				output.LogStreams = append(output.LogStreams, &cloudwatchlogs.LogStream{
+					LogStreamName:      aws.String(name),
+					LastEventTimestamp: aws.Int64(timestamp),
+				})
+			}
+			f := args.Get(1).(func(*cloudwatchlogs.DescribeLogStreamsOutput, bool) bool)
+			f(output, true)
+		},
+	)
+	params := &Params{
+		Config:    &Config{StreamEventHorizon: time.Hour},
+		AWSClient: client,
+		Scheduler: NewScheduler(1),
+	}
+	group := NewGroup("group", &Prospector{StreamPrefix: "ecs/api/", StreamExclude: []string{"-debug$"}}, params)
+
+	// go!
+	assert.Nil(t, group.RefreshStreams())
+	// assert
+	assert.Equal(t, "ecs/api/", aws.StringValue(inputs[0].LogStreamNamePrefix))
+	assert.Nil(t, inputs[0].OrderBy)
+	assert.Equal(t, 1, len(group.streams))
+	assert.NotNil(t, group.streams["ecs/api/1"])
+}
+
+func Test_Group_Filter_SkipsFilteredStreams(t *testing.T) {
+	timestamp := TimeBeforeNowInMilliseconds(5 * time.Minute)
+	client := &MockCWLClient{}
+	inputs := []*cloudwatchlogs.FilterLogEventsInput{}
+	stubFilterLogEventsPages(client, &inputs,
+		CreateFilteredLogEvent("1", "2020/01/01/[$LATEST]abcde", "Event 1\n", timestamp),
+		CreateFilteredLogEvent("2", "2020/01/01/[12]abcde", "Event 2\n", timestamp),
+	)
+	publisher, events := CreateCollectingPublisher(false)
+	params := &Params{
+		Config:    &Config{StreamEventHorizon: time.Hour},
+		Registry:  NewDummyRegistry(),
+		AWSClient: client,
+		Publisher: publisher,
+	}
+	prospector := &Prospector{Mode: GroupMode, StreamPrefix: "2020/", StreamInclude: []string{`\[\$LATEST\]`}}
+	group := NewGroup("group", prospector, params)
+
+	// go!
+	assert.Nil(t, group.Filter())
+	// assert
+	assert.Equal(t, "2020/", aws.StringValue(inputs[0].LogStreamNamePrefix))
+	assert.Equal(t, 1, len(*events))
+	assert.Equal(t, "Event 1\n", (*events)[0].Message)
+}
+
+func Test_Group_Filter_RestoresKeyedBuffersFromRegistry(t *testing.T) {
+	timestamp := TimeBeforeNowInMilliseconds(5 * time.Minute)
+	client := &MockCWLClient{}
+	inputs := []*cloudwatchlogs.FilterLogEventsInput{}
+	stubFilterLogEventsPages(client, &inputs)
+	registry := NewDummyRegistry()
+	params := &Params{
+		Config:    &Config{StreamEventHorizon: time.Hour},
+		Registry:  registry,
+		AWSClient: client,
+	}
+	prospector := &Prospector{
+		Mode:      GroupMode,
+		Multiline: &Multiline{Type: "key", KeyPattern: `RequestId: (\S+)`, FlushPattern: "^REPORT"},
+	}
+	group := NewGroup("group", prospector, params)
+	buffers := []KeyedBuffer{{Key: "aaa-bbb", Buffer: "START RequestId: aaa-bbb\n", Timestamp: timestamp}}
+	registry.WriteGroupInfo(group, &GroupRegistryItem{
+		Timestamp:    timestamp,
+		KeyedBuffers: map[string][]KeyedBuffer{"stream_b": buffers},
+	})
+
+	// go!
+	group.Filter()
+	// assert
+	assert.Equal(t, buffers, group.streams["stream_b"].keyedCheckpoint())
+	assert.Equal(t, map[string][]KeyedBuffer{"stream_b": buffers}, group.checkpoint().KeyedBuffers)
+}
@@ -0,0 +1,141 @@
+package cwl
+
+import (
+	"errors"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// the prefix of group name patterns that are regular expressions
+const regexGroupNamePrefix = "regex:"
+
+// GroupNamePattern matches log group names. A pattern is either a
+// literal group name, a glob pattern in which `*` matches any sequence of
+// characters, `?` any single character and `[...]` a character class (e.g.
+// `/aws/lambda/*-prod-*`), or a regular expression prefixed with "regex:"
+// (e.g. `regex:^/aws/lambda/(api|web)-`). Group names can not contain any
+// of the glob characters, so literal names are never ambiguous.
+type GroupNamePattern struct {
+	Pattern string
+	prefix  string         // the literal prefix of every matching group name
+	regex   *regexp.Regexp // nil if the pattern is a literal group name
+}
+
+func CompileGroupNamePattern(pattern string) (*GroupNamePattern, error) {
+	if strings.HasPrefix(pattern, regexGroupNamePrefix) {
+		expression := pattern[len(regexGroupNamePrefix):]
+		regex, err := regexp.Compile(expression)
+		if err != nil {
+			return nil, errors.New("group name pattern: " + err.Error())
+		}
+		return &GroupNamePattern{Pattern: pattern, prefix: regexPrefix(expression), regex: regex}, nil
+	}
+	index := strings.IndexAny(pattern, "*?[")
+	if index < 0 {
+		return &GroupNamePattern{Pattern: pattern, prefix: pattern}, nil
+	}
+	expression, err := globToRegex(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regex, err := regexp.Compile(expression)
+	if err != nil {
+		return nil, errors.New("group name pattern: " + err.Error())
+	}
+	return &GroupNamePattern{Pattern: pattern, prefix: pattern[:index], regex: regex}, nil
+}
+
+// Returns true if the pattern is a literal group name
+func (pattern *GroupNamePattern) IsLiteral() bool {
+	return pattern.regex == nil
+}
+
+// Returns the longest literal prefix of the group names matched by the
+// pattern, which is used to narrow the groups described by AWS
+func (pattern *GroupNamePattern) Prefix() string {
+	return pattern.prefix
+}
+
+// Returns true if the group name matches the pattern
+func (pattern *GroupNamePattern) Match(groupName string) bool {
+	if pattern.regex == nil {
+		return pattern.Pattern == groupName
+	}
+	return pattern.regex.MatchString(groupName)
+}
+
+// Returns true if the group is matched by any of the prospector's group
+// names and by none of its excluded group names
+func (prospector *Prospector) matchGroupName(groupName string) bool {
+	for _, pattern := range prospector.GroupNames {
+		if matchGroupName(pattern, groupName) {
+			return !prospector.excludesGroupName(groupName)
+		}
+	}
+	return false
+}
+
+func (prospector *Prospector) excludesGroupName(groupName string) bool {
+	for _, pattern := range prospector.ExcludeGroupNames {
+		if matchGroupName(pattern, groupName) {
+			return true
+		}
+	}
+	return false
+}
+
+// Converts a glob pattern to an anchored regular expression
+func globToRegex(pattern string) (string, error) {
+	var expression strings.Builder
+	expression.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			expression.WriteString(".*")
+		case '?':
+			expression.WriteString(".")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return "", errors.New("group name pattern: unterminated character class: " + pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expression.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			expression.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expression.WriteString("$")
+	return expression.String(), nil
+}
+
+// Returns the literal prefix of the strings matched by a regular
+// expression; the expression must be anchored at the beginning of the
+// text (^ or \A), otherwise the prefix is empty
+func regexPrefix(expression string) string {
+	re, err := syntax.Parse(expression, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	re = re.Simplify()
+	subs := []*syntax.Regexp{re}
+	if re.Op == syntax.OpConcat {
+		subs = re.Sub
+	}
+	if len(subs) == 0 || subs[0].Op != syntax.OpBeginText {
+		return ""
+	}
+	var prefix strings.Builder
+	for _, sub := range subs[1:] {
+		if sub.Op != syntax.OpLiteral || sub.Flags&syntax.FoldCase != 0 {
+			break
+		}
+		prefix.WriteString(string(sub.Rune))
+	}
+	return prefix.String()
+}
@@ -0,0 +1,78 @@
+package cwl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_GroupNamePattern_Match(t *testing.T) {
+	testCases := []struct {
+		pattern   string
+		groupName string
+		match     bool
+	}{
+		{"/aws/lambda/function", "/aws/lambda/function", true},
+		{"/aws/lambda/function", "/aws/lambda/function-2", false},
+		{"/aws/lambda/*", "/aws/lambda/function", true},
+		{"/aws/lambda/*", "/aws/lambda/nested/function", true},
+		{"/aws/lambda/*", "/aws/ecs/service", false},
+		{"/aws/lambda/*-prod-*", "/aws/lambda/api-prod-handler", true},
+		{"/aws/lambda/*-prod-*", "/aws/lambda/api-staging-handler", false},
+		{"/aws/lambda/api-v?", "/aws/lambda/api-v2", true},
+		{"/aws/lambda/api-v?", "/aws/lambda/api-v10", false},
+		{"/aws/lambda/api-v[12]", "/aws/lambda/api-v1", true},
+		{"/aws/lambda/api-v[!12]", "/aws/lambda/api-v1", false},
+		{"regex:^/aws/lambda/(api|web)-prod$", "/aws/lambda/web-prod", true},
+		{"regex:^/aws/lambda/(api|web)-prod$", "/aws/lambda/web-prod-debug", false},
+		{"regex:-debug$", "/aws/lambda/web-prod-debug", true},
+	}
+
+	for _, testCase := range testCases {
+		pattern, err := CompileGroupNamePattern(testCase.pattern)
+		assert.Nil(t, err, testCase.pattern)
+		assert.Equal(t, testCase.match, pattern.Match(testCase.groupName), testCase.pattern+"|"+testCase.groupName)
+	}
+}
+
+func Test_GroupNamePattern_Prefix(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		prefix  string
+		literal bool
+	}{
+		{"/aws/lambda/function", "/aws/lambda/function", true},
+		{"/aws/lambda/*", "/aws/lambda/", false},
+		{"/aws/lambda/*-prod-*", "/aws/lambda/", false},
+		{"*-prod", "", false},
+		{"regex:^/aws/lambda/(api|web)-prod$", "/aws/lambda/", false},
+		{`regex:^/aws/ecs/\w+`, "/aws/ecs/", false},
+		{"regex:(?i)^/aws/lambda/", "", false},
+		{"regex:/aws/lambda/", "", false},
+	}
+
+	for _, testCase := range testCases {
+		pattern, err := CompileGroupNamePattern(testCase.pattern)
+		assert.Nil(t, err, testCase.pattern)
+		assert.Equal(t, testCase.prefix, pattern.Prefix(), testCase.pattern)
+		assert.Equal(t, testCase.literal, pattern.IsLiteral(), testCase.pattern)
+	}
+}
+
+func Test_GroupNamePattern_Invalid(t *testing.T) {
+	for _, pattern := range []string{"regex:^/aws/(lambda", "/aws/lambda/[abc"} {
+		_, err := CompileGroupNamePattern(pattern)
+		assert.NotNil(t, err, pattern)
+	}
+}
+
+func Test_Prospector_MatchGroupName_HonoursExclusions(t *testing.T) {
+	prospector := &Prospector{
+		GroupNames:        []string{"/aws/lambda/*"},
+		ExcludeGroupNames: []string{"/aws/lambda/*-debug", "regex:^/aws/lambda/test-"},
+	}
+	assert.True(t, prospector.matchGroupName("/aws/lambda/api"))
+	assert.False(t, prospector.matchGroupName("/aws/lambda/api-debug"))
+	assert.False(t, prospector.matchGroupName("/aws/lambda/test-api"))
+	assert.False(t, prospector.matchGroupName("/aws/ecs/service"))
+}
@@ -1,7 +1,9 @@
 package cwl
 
 import (
+	"regexp"
 	"time"
+	"unicode/utf8"
 
 	"github.com/elastic/beats/v7/libbeat/logp"
 )
@@ -24,3 +26,31 @@ func IsBefore(horizon time.Duration, lastEventTimestamp int64) bool {
 	horizonTimestamp := time.Now().UTC().Add(-horizon)
 	return ToTime(lastEventTimestamp).Before(horizonTimestamp)
 }
+
+// Compiles a list of regular expressions
+func compileRegexes(expressions []string) ([]*regexp.Regexp, error) {
+	regexes := make([]*regexp.Regexp, 0, len(expressions))
+	for _, expression := range expressions {
+		regex, err := regexp.Compile(expression)
+		if err != nil {
+			return nil, err
+		}
+		regexes = append(regexes, regex)
+	}
+	return regexes, nil
+}
+
+// Returns the longest prefix of the string of at most n bytes that does
+// not split a UTF-8 encoded character
+func truncateUTF8(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -24,3 +24,12 @@ func Test_IsBefore_ReturnsTrue_WhenHorizon_IsZero_And_Timestamp_IsNow(t *testing
 	lastEventTimestamp := TimeBeforeNowInMilliseconds(0 * time.Minute)
 	assert.True(t, IsBefore(horizon, lastEventTimestamp))
 }
+
+func Test_TruncateUTF8_DoesNotSplitCharacters(t *testing.T) {
+	assert.Equal(t, "hello", truncateUTF8("hello", 10))
+	assert.Equal(t, "hel", truncateUTF8("hello", 3))
+	assert.Equal(t, "", truncateUTF8("hello", 0))
+	// "é" is encoded in two bytes
+	assert.Equal(t, "caf", truncateUTF8("café", 4))
+	assert.Equal(t, "café", truncateUTF8("café", 5))
+}
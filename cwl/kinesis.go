@@ -0,0 +1,373 @@
+package cwl
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/elastic/beats/v7/libbeat/logp"
+)
+
+// KinesisConsumer consumes a kinesis stream into which CloudWatch Logs
+// subscription filters deliver log events. The events are published using
+// the streams of the GroupManager, so the prospectors (and their multiline
+// settings) apply to them as if the groups were polled.
+type KinesisConsumer struct {
+	StreamName string
+	Client     kinesisiface.KinesisAPI
+	Manager    *GroupManager
+	Params     *Params
+	shards     map[string]*Shard
+	mutex      sync.Mutex // synchronize access to the shards map
+
+	ctx     context.Context // cancelled when the shards must stop
+	running sync.WaitGroup  // the shards being consumed
+}
+
+type Shard struct {
+	Id       string
+	Consumer *KinesisConsumer
+
+	acks            *batchQueue
+	streams         map[*Stream]bool // the streams whose events came from this shard
+	sequenceNumber  string           // the last consumed sequence number
+	started         bool             // true once the shard's state has been read from the registry
+	publishedEvents int64
+}
+
+func NewKinesisConsumer(streamName string, client kinesisiface.KinesisAPI, manager *GroupManager) *KinesisConsumer {
+	return &KinesisConsumer{
+		StreamName: streamName,
+		Client:     client,
+		Manager:    manager,
+		Params:     manager.Params,
+		shards:     make(map[string]*Shard),
+		ctx:        context.Background(),
+	}
+}
+
+func NewShard(id string, consumer *KinesisConsumer) *Shard {
+	shard := &Shard{
+		Id:       id,
+		Consumer: consumer,
+		streams:  make(map[*Stream]bool),
+	}
+	shard.acks = &batchQueue{
+		write: func(item interface{}) error {
+			return consumer.Params.Registry.WriteShardInfo(shard, item.(*ShardRegistryItem))
+		},
+	}
+	return shard
+}
+
+// Starts consuming the shards of the stream that are not consumed already
+func (consumer *KinesisConsumer) RefreshShards() {
+	params := &kinesis.ListShardsInput{StreamName: aws.String(consumer.StreamName)}
+	for {
+		output, err := consumer.Client.ListShards(params)
+		if err != nil {
+			logp.Err("kinesis: failed to list shards of %s [%s]", consumer.StreamName, err.Error())
+			return
+		}
+		for _, shard := range output.Shards {
+			id := aws.StringValue(shard.ShardId)
+			consumer.mutex.Lock()
+			_, ok := consumer.shards[id]
+			if !ok {
+				shard := NewShard(id, consumer)
+				consumer.shards[id] = shard
+				consumer.running.Add(1)
+				go func() {
+					defer consumer.running.Done()
+					shard.Monitor(consumer.ctx)
+				}()
+			}
+			consumer.mutex.Unlock()
+		}
+		if output.NextToken == nil {
+			return
+		}
+		// the stream name must not be set along with the next token
+		params = &kinesis.ListShardsInput{NextToken: output.NextToken}
+	}
+}
+
+func (consumer *KinesisConsumer) removeShard(shard *Shard) {
+	consumer.mutex.Lock()
+	delete(consumer.shards, shard.Id)
+	consumer.mutex.Unlock()
+}
+
+// Continuously consumes the shards of the stream until the context is
+// cancelled, in which case it returns once all the shards have drained
+func (consumer *KinesisConsumer) Monitor(ctx context.Context) {
+	logp.Info("[kinesis] %s started", consumer.StreamName)
+	defer logp.Info("[kinesis] %s stopped", consumer.StreamName)
+	consumer.ctx = ctx
+	consumer.RefreshShards()
+	ticker := time.NewTicker(consumer.Params.Config.KinesisShardRefreshFrequency)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			consumer.running.Wait()
+			return
+		case <-ticker.C:
+			consumer.RefreshShards()
+		}
+	}
+}
+
+// Returns the iterator from which the shard will be read: right after the
+// last consumed sequence number or, for new shards, from the oldest record.
+// The consumed sequence number (and the buffers) are restored from the
+// checkpoint the first time only.
+func (shard *Shard) iterator() (*string, error) {
+	if !shard.started {
+		item, err := shard.Consumer.Params.Registry.ReadShardInfo(shard)
+		if err != nil {
+			return nil, err
+		}
+		if item != nil && item.SequenceNumber != "" {
+			shard.sequenceNumber = item.SequenceNumber
+			shard.restore(item)
+		}
+		shard.started = true
+	}
+	params := &kinesis.GetShardIteratorInput{
+		StreamName:        aws.String(shard.Consumer.StreamName),
+		ShardId:           aws.String(shard.Id),
+		ShardIteratorType: aws.String(kinesis.ShardIteratorTypeTrimHorizon),
+	}
+	if shard.sequenceNumber != "" {
+		params.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber)
+		params.StartingSequenceNumber = aws.String(shard.sequenceNumber)
+	}
+	output, err := shard.Consumer.Client.GetShardIterator(params)
+	if err != nil {
+		return nil, err
+	}
+	return output.ShardIterator, nil
+}
+
+// Restores the multiline buffers of the streams fed by the shard
+func (shard *Shard) restore(item *ShardRegistryItem) {
+	manager := shard.Consumer.Manager
+	manager.dispatchLock.Lock()
+	defer manager.dispatchLock.Unlock()
+	for key, buffers := range item.Buffers {
+		account, groupName := splitGroupKey(key)
+		for streamName, buffer := range buffers {
+			if stream := manager.dispatchStream(account, groupName, streamName, true); stream != nil {
+				stream.restoreBuffer(buffer, item.BufferTimestamps[key][streamName])
+				shard.streams[stream] = true
+			}
+		}
+	}
+	for key, keyed := range item.KeyedBuffers {
+		account, groupName := splitGroupKey(key)
+		for streamName, buffers := range keyed {
+			if stream := manager.dispatchStream(account, groupName, streamName, true); stream != nil {
+				stream.restoreKeyed(buffers)
+				shard.streams[stream] = true
+			}
+		}
+	}
+}
+
+// Fetches the next batch of records from the shard and digests the log
+// events that they contain. Returns the iterator of the next batch, which
+// is nil when the shard has been closed.
+func (shard *Shard) Next(iterator *string) (*string, error) {
+	output, err := shard.Consumer.Client.GetRecords(&kinesis.GetRecordsInput{
+		ShardIterator: iterator,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(output.Records) > 0 {
+		manager := shard.Consumer.Manager
+		batch := shard.acks.newBatch()
+		for _, record := range output.Records {
+			message, err := DecodeSubscriptionMessage(record.Data)
+			if err != nil {
+				logp.Warn("kinesis: failed to decode record %s of shard %s [%s]",
+					aws.StringValue(record.SequenceNumber), shard.Id, err.Error())
+				continue
+			}
+			if stream := manager.digestSubscriptionMessage(message, batch); stream != nil {
+				shard.streams[stream] = true
+				shard.publishedEvents += int64(len(message.LogEvents))
+			}
+		}
+		shard.sequenceNumber = aws.StringValue(output.Records[len(output.Records)-1].SequenceNumber)
+		err = shard.acks.seal(batch, shard.checkpoint(shard.sequenceNumber))
+	}
+	// once the shard has caught up, no more lines can complete an
+	// incomplete event that has timed out
+	if err == nil && aws.Int64Value(output.MillisBehindLatest) == 0 {
+		err = shard.flushTimedOut()
+	}
+	return output.NextShardIterator, err
+}
+
+// Publishes the incomplete multiline events of the shard's streams that
+// have timed out and commits the shard's state once they are acknowledged
+func (shard *Shard) flushTimedOut() error {
+	now := time.Now().UnixNano() / 1e6
+	manager := shard.Consumer.Manager
+	var batch *eventBatch
+	manager.dispatchLock.Lock()
+	for stream := range shard.streams {
+		if !stream.timedOut(now) {
+			continue
+		}
+		if batch == nil {
+			batch = shard.acks.newBatch()
+		}
+		stream.batch = batch
+		stream.flushTimedOut(now)
+		stream.batch = nil
+	}
+	manager.dispatchLock.Unlock()
+	if batch == nil {
+		return nil
+	}
+	return shard.acks.seal(batch, shard.checkpoint(shard.sequenceNumber))
+}
+
+// Returns the registry item for the shard after the sequence number
+func (shard *Shard) checkpoint(sequenceNumber string) *ShardRegistryItem {
+	item := &ShardRegistryItem{
+		SequenceNumber:   sequenceNumber,
+		Buffers:          make(map[string]map[string]string),
+		BufferTimestamps: make(map[string]map[string]int64),
+		KeyedBuffers:     make(map[string]map[string][]KeyedBuffer),
+	}
+	manager := shard.Consumer.Manager
+	manager.dispatchLock.Lock()
+	defer manager.dispatchLock.Unlock()
+	for stream := range shard.streams {
+		if !stream.hasBuffer() {
+			delete(shard.streams, stream)
+			continue
+		}
+		// the buffers are stored by the key of their group, which
+		// includes the owner of its subscription messages
+		key := stream.Group.key()
+		if stream.buffer.Len() > 0 {
+			if _, ok := item.Buffers[key]; !ok {
+				item.Buffers[key] = make(map[string]string)
+				item.BufferTimestamps[key] = make(map[string]int64)
+			}
+			item.Buffers[key][stream.Name] = stream.buffer.String()
+			item.BufferTimestamps[key][stream.Name] = stream.bufferStart
+		}
+		if len(stream.keyed) > 0 {
+			if _, ok := item.KeyedBuffers[key]; !ok {
+				item.KeyedBuffers[key] = make(map[string][]KeyedBuffer)
+			}
+			item.KeyedBuffers[key][stream.Name] = stream.keyedCheckpoint()
+		}
+	}
+	return item
+}
+
+// Publishes the multiline buffers of the shard's streams as incomplete
+// events and commits the shard's final state once their events are
+// acknowledged
+func (shard *Shard) drain() {
+	if len(shard.streams) == 0 {
+		return
+	}
+	manager := shard.Consumer.Manager
+	batch := shard.acks.newBatch()
+	manager.dispatchLock.Lock()
+	for stream := range shard.streams {
+		stream.batch = batch
+		stream.flushPartial()
+		stream.batch = nil
+	}
+	manager.dispatchLock.Unlock()
+	if err := shard.acks.seal(batch, shard.checkpoint(shard.sequenceNumber)); err != nil {
+		logp.Err("%s/%s %s", shard.Consumer.StreamName, shard.Id, err.Error())
+	}
+}
+
+// Continuously consumes the shard until it is closed or it does not exist
+// anymore; in the latter case the consumer will pick the shard up again at
+// its next refresh. Failed requests are retried with an exponential backoff
+// and expired iterators are replaced by new ones after the last consumed
+// record. Closed shards are kept by the consumer so that they are not
+// consumed again. When the context is cancelled, the shard is drained before
+// consuming stops.
+func (shard *Shard) Monitor(ctx context.Context) {
+	name := shard.Consumer.StreamName + "/" + shard.Id
+	logp.Info("[shard] %s started", name)
+	defer logp.Info("[shard] %s stopped", name)
+
+	config := shard.Consumer.Params.Config
+	retry := newBackoff(config)
+	reportTicker := time.NewTicker(config.ReportFrequency)
+	defer reportTicker.Stop()
+
+	var iterator *string
+	fetch := true // whether a new iterator is required
+	for {
+		var err error
+		if fetch {
+			iterator, err = shard.iterator()
+			fetch = err != nil
+		}
+		// the iterator of a closed shard is nil
+		if err == nil && iterator != nil {
+			var next *string
+			next, err = shard.Next(iterator)
+			// the records have been consumed unless they could not be read
+			if err == nil || next != nil {
+				iterator = next
+			}
+		}
+		delay := config.KinesisRefreshFrequency
+		if err != nil {
+			class := classifyError(err)
+			if class == NotFoundError {
+				logp.Err("%s %s", name, err.Error())
+				shard.Consumer.removeShard(shard)
+				return
+			}
+			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == kinesis.ErrCodeExpiredIteratorException {
+				logp.Warn("%s iterator expired, reading again after %s", name, shard.sequenceNumber)
+				fetch = true
+				delay = 0
+			} else {
+				delay = retry.next(class)
+				logp.Warn("%s %s error, retrying in %v [%s]", name, class, delay, err.Error())
+			}
+		} else {
+			retry.reset()
+			if iterator == nil {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			shard.drain()
+			return
+		case <-reportTicker.C:
+			shard.report(name)
+		case <-time.After(delay):
+		}
+	}
+	logp.Info("[shard] %s closed", name)
+}
+
+func (shard *Shard) report(name string) {
+	logp.Info("report[shard] %d %s %s",
+		shard.publishedEvents, name, shard.Consumer.Params.Config.ReportFrequency)
+	shard.publishedEvents = 0
+}
@@ -0,0 +1,370 @@
+package cwl
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/stretchr/testify/assert"
+)
+
+// this is our mock Kinesis client
+type MockKinesisClient struct {
+	kinesisiface.KinesisAPI
+	ListShardsStub       func(*kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error)
+	GetShardIteratorStub func(*kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error)
+	GetRecordsStub       func(*kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error)
+}
+
+// stub ListShards
+func (client *MockKinesisClient) ListShards(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+	return client.ListShardsStub(input)
+}
+
+// stub GetShardIterator
+func (client *MockKinesisClient) GetShardIterator(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	return client.GetShardIteratorStub(input)
+}
+
+// stub GetRecords
+func (client *MockKinesisClient) GetRecords(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	return client.GetRecordsStub(input)
+}
+
+func Test_Shard_Iterator_StartsFromTrimHorizon_ForNewShards(t *testing.T) {
+	client := &MockKinesisClient{
+		GetShardIteratorStub: func(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+			assert.Equal(t, "the_stream", *input.StreamName)
+			assert.Equal(t, "shard-0", *input.ShardId)
+			assert.Equal(t, kinesis.ShardIteratorTypeTrimHorizon, *input.ShardIteratorType)
+			return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String("iterator")}, nil
+		},
+	}
+	params := &Params{Config: &Config{}, Registry: NewDummyRegistry()}
+	shard := NewShard("shard-0", NewKinesisConsumer("the_stream", client, NewGroupManager(params)))
+	// go!
+	iterator, err := shard.iterator()
+	// assert
+	assert.Nil(t, err)
+	assert.Equal(t, "iterator", *iterator)
+}
+
+func Test_Shard_Iterator_StartsAfterTheCheckpoint_AndRestoresBuffers(t *testing.T) {
+	client := &MockKinesisClient{
+		GetShardIteratorStub: func(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+			assert.Equal(t, kinesis.ShardIteratorTypeAfterSequenceNumber, *input.ShardIteratorType)
+			assert.Equal(t, "42", *input.StartingSequenceNumber)
+			return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String("iterator")}, nil
+		},
+	}
+	registry := NewDummyRegistry()
+	params := &Params{
+		Config:   &Config{Prospectors: []Prospector{{GroupNames: []string{"group"}}}},
+		Registry: registry,
+	}
+	manager := NewGroupManager(params)
+	shard := NewShard("shard-0", NewKinesisConsumer("the_stream", client, manager))
+	registry.WriteShardInfo(shard, &ShardRegistryItem{
+		SequenceNumber:   "42",
+		Buffers:          map[string]map[string]string{"123456789012:group": {"stream": "partial\n"}},
+		BufferTimestamps: map[string]map[string]int64{"123456789012:group": {"stream": 1578090901000}},
+	})
+	// go!
+	_, err := shard.iterator()
+	// assert
+	assert.Nil(t, err)
+	group := manager.groups["123456789012:group"]
+	assert.Equal(t, "123456789012", group.Account)
+	assert.Equal(t, "partial\n", group.streams["stream"].buffer.String())
+	assert.Equal(t, int64(1578090901000), group.streams["stream"].bufferStart)
+}
+
+func Test_Shard_Checkpoint_RecordsTheRestoredBuffers(t *testing.T) {
+	client := &MockKinesisClient{
+		GetShardIteratorStub: func(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+			return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String("iterator")}, nil
+		},
+	}
+	registry := NewDummyRegistry()
+	params := &Params{
+		Config:   &Config{Prospectors: []Prospector{{GroupNames: []string{"group"}}}},
+		Registry: registry,
+	}
+	shard := NewShard("shard-0", NewKinesisConsumer("the_stream", client, NewGroupManager(params)))
+	item := &ShardRegistryItem{
+		SequenceNumber:   "42",
+		Buffers:          map[string]map[string]string{"123456789012:group": {"stream": "partial\n"}},
+		BufferTimestamps: map[string]map[string]int64{"123456789012:group": {"stream": 1578090901000}},
+		KeyedBuffers: map[string]map[string][]KeyedBuffer{"123456789012:group": {
+			"other": {{Key: "aaa", Buffer: "START RequestId: aaa\n", Timestamp: 1578090902000}},
+		}},
+	}
+	registry.WriteShardInfo(shard, item)
+	// go!
+	_, err := shard.iterator()
+	// assert
+	assert.Nil(t, err)
+	assert.Equal(t, item, shard.checkpoint("42"))
+}
+
+func Test_Shard_Next_PublishesRecords_AndCheckpointsWhenAcked(t *testing.T) {
+	client := &MockKinesisClient{
+		GetRecordsStub: func(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+			assert.Equal(t, "iterator", *input.ShardIterator)
+			return &kinesis.GetRecordsOutput{
+				NextShardIterator: aws.String("next_iterator"),
+				Records: []*kinesis.Record{
+					{
+						SequenceNumber: aws.String("1"),
+						Data:           CreateSubscriptionPayload(CreateSubscriptionMessage("group", "stream", "line\n", "END\n")),
+					},
+					{
+						SequenceNumber: aws.String("2"),
+						Data:           []byte("garbage"),
+					},
+					{
+						SequenceNumber: aws.String("3"),
+						Data:           CreateSubscriptionPayload(CreateSubscriptionMessage("group", "stream", "partial\n")),
+					},
+				},
+			}, nil
+		},
+	}
+	registry := NewDummyRegistry()
+	publisher, events := CreateCollectingPublisher(false)
+	params := &Params{
+		Config: &Config{Prospectors: []Prospector{{
+			GroupNames: []string{"group"},
+			Multiline:  &Multiline{Pattern: "^END", Negate: true, Match: "before"},
+		}}},
+		Registry:  registry,
+		Publisher: publisher,
+	}
+	manager := NewGroupManager(params)
+	shard := NewShard("shard-0", NewKinesisConsumer("the_stream", client, manager))
+	// go!
+	iterator, err := shard.Next(aws.String("iterator"))
+	// assert
+	assert.Nil(t, err)
+	assert.Equal(t, "next_iterator", *iterator)
+	assert.Equal(t, 1, len(*events))
+	assert.Equal(t, "line\nEND\n", (*events)[0].Message)
+	item, _ := registry.ReadShardInfo(shard)
+	assert.Nil(t, item)
+
+	AckEvents(1, []interface{}{(*events)[0].batch})
+	item, _ = registry.ReadShardInfo(shard)
+	assert.Equal(t, "3", item.SequenceNumber)
+	assert.Equal(t, map[string]map[string]string{"123456789012:group": {"stream": "partial\n"}}, item.Buffers)
+	stream := manager.groups["123456789012:group"].streams["stream"]
+	assert.NotEqual(t, int64(0), stream.bufferStart)
+	assert.Equal(t, map[string]map[string]int64{"123456789012:group": {"stream": stream.bufferStart}}, item.BufferTimestamps)
+}
+
+func Test_Shard_Next_PublishesTimedOutEvents_OnceCaughtUp(t *testing.T) {
+	records := []*kinesis.Record{
+		{
+			SequenceNumber: aws.String("1"),
+			Data:           CreateSubscriptionPayload(CreateSubscriptionMessage("group", "stream", "partial\n")),
+		},
+	}
+	behind := int64(1000)
+	client := &MockKinesisClient{
+		GetRecordsStub: func(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+			output := &kinesis.GetRecordsOutput{
+				NextShardIterator:  aws.String("iterator"),
+				Records:            records,
+				MillisBehindLatest: aws.Int64(behind),
+			}
+			records = nil
+			return output, nil
+		},
+	}
+	registry := NewDummyRegistry()
+	publisher, events := CreateCollectingPublisher(false)
+	params := &Params{
+		Config: &Config{Prospectors: []Prospector{{
+			GroupNames: []string{"group"},
+			Multiline:  &Multiline{Pattern: "^END", Negate: true, Match: "before", Timeout: time.Millisecond},
+		}}},
+		Registry:  registry,
+		Publisher: publisher,
+	}
+	manager := NewGroupManager(params)
+	shard := NewShard("shard-0", NewKinesisConsumer("the_stream", client, manager))
+	// go!
+	shard.Next(aws.String("iterator"))
+	time.Sleep(10 * time.Millisecond)
+	// lines of the event may still be in the shard
+	shard.Next(aws.String("iterator"))
+	assert.Equal(t, 0, len(*events))
+	// once caught up, no more lines can complete the event
+	behind = 0
+	_, err := shard.Next(aws.String("iterator"))
+	// assert
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(*events))
+	assert.Equal(t, "partial\n", (*events)[0].Message)
+	assert.True(t, (*events)[0].Partial)
+	AckEvents(1, []interface{}{(*events)[0].batch})
+	item, _ := registry.ReadShardInfo(shard)
+	assert.Equal(t, "1", item.SequenceNumber)
+	assert.Equal(t, map[string]map[string]string{}, item.Buffers)
+}
+
+func Test_KinesisConsumer_RefreshShards_FollowsNextToken(t *testing.T) {
+	calls := 0
+	client := &MockKinesisClient{
+		ListShardsStub: func(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+			calls++
+			if calls == 1 {
+				assert.Equal(t, "the_stream", *input.StreamName)
+				return &kinesis.ListShardsOutput{
+					Shards:    []*kinesis.Shard{{ShardId: aws.String("shard-0")}},
+					NextToken: aws.String("token"),
+				}, nil
+			}
+			assert.Nil(t, input.StreamName)
+			assert.Equal(t, "token", *input.NextToken)
+			return &kinesis.ListShardsOutput{
+				Shards: []*kinesis.Shard{{ShardId: aws.String("shard-1")}},
+			}, nil
+		},
+		// the shards are closed immediately
+		GetShardIteratorStub: func(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+			return &kinesis.GetShardIteratorOutput{}, nil
+		},
+	}
+	params := &Params{Config: &Config{ReportFrequency: time.Minute}, Registry: NewDummyRegistry()}
+	consumer := NewKinesisConsumer("the_stream", client, NewGroupManager(params))
+	// go!
+	consumer.RefreshShards()
+	// assert
+	assert.Equal(t, 2, calls)
+	consumer.mutex.Lock()
+	assert.Equal(t, 2, len(consumer.shards))
+	consumer.mutex.Unlock()
+}
+
+func Test_Shard_Monitor_DrainsTheBuffers_WhenCancelled(t *testing.T) {
+	client := &MockKinesisClient{
+		GetShardIteratorStub: func(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+			return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String("iterator")}, nil
+		},
+		GetRecordsStub: func(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+			return &kinesis.GetRecordsOutput{
+				NextShardIterator: aws.String("iterator"),
+				Records: []*kinesis.Record{
+					{
+						SequenceNumber: aws.String("1"),
+						Data:           CreateSubscriptionPayload(CreateSubscriptionMessage("group", "stream", "partial\n")),
+					},
+				},
+			}, nil
+		},
+	}
+	registry := NewDummyRegistry()
+	publisher, events := CreateCollectingPublisher(false)
+	params := &Params{
+		Config: &Config{
+			ReportFrequency:         time.Hour,
+			KinesisRefreshFrequency: time.Hour,
+			Prospectors: []Prospector{{
+				GroupNames: []string{"group"},
+				Multiline:  &Multiline{Pattern: "^END", Negate: true, Match: "before"},
+			}},
+		},
+		Registry:  registry,
+		Publisher: publisher,
+	}
+	manager := NewGroupManager(params)
+	shard := NewShard("shard-0", NewKinesisConsumer("the_stream", client, manager))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// go!
+	shard.Monitor(ctx)
+	// assert
+	assert.Equal(t, 1, len(*events))
+	assert.Equal(t, "partial\n", (*events)[0].Message)
+	assert.True(t, (*events)[0].Partial)
+	AckEvents(1, []interface{}{(*events)[0].batch})
+	item, _ := registry.ReadShardInfo(shard)
+	assert.Equal(t, "1", item.SequenceNumber)
+	assert.Equal(t, map[string]map[string]string{}, item.Buffers)
+}
+
+func Test_Shard_Monitor_RetriesThrottledReads_AndRefetchesExpiredIterators(t *testing.T) {
+	iterators := []string{}
+	client := &MockKinesisClient{
+		GetShardIteratorStub: func(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+			iterators = append(iterators, aws.StringValue(input.ShardIteratorType)+" "+aws.StringValue(input.StartingSequenceNumber))
+			return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String("iterator")}, nil
+		},
+	}
+	calls := 0
+	client.GetRecordsStub = func(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+		calls++
+		switch calls {
+		case 1:
+			return nil, awserr.New(kinesis.ErrCodeProvisionedThroughputExceededException, "Rate exceeded", nil)
+		case 2:
+			return &kinesis.GetRecordsOutput{
+				NextShardIterator: aws.String("iterator"),
+				Records: []*kinesis.Record{{
+					SequenceNumber: aws.String("1"),
+					Data:           CreateSubscriptionPayload(CreateSubscriptionMessage("group", "stream", "Event 1\n")),
+				}},
+			}, nil
+		case 3:
+			return nil, awserr.New(kinesis.ErrCodeExpiredIteratorException, "Iterator expired", nil)
+		}
+		// the shard is closed
+		return &kinesis.GetRecordsOutput{}, nil
+	}
+	publisher, events := CreateCollectingPublisher(true)
+	params := &Params{
+		Config: &Config{
+			ReportFrequency:         time.Hour,
+			KinesisRefreshFrequency: time.Millisecond,
+			RetryInitialBackoff:     time.Millisecond,
+			RetryMaxBackoff:         time.Millisecond,
+			Prospectors:             []Prospector{{GroupNames: []string{"group"}}},
+		},
+		Registry:  NewDummyRegistry(),
+		Publisher: publisher,
+	}
+	consumer := NewKinesisConsumer("the_stream", client, NewGroupManager(params))
+	shard := NewShard("shard-0", consumer)
+	consumer.shards[shard.Id] = shard
+	// go!
+	shard.Monitor(context.Background())
+	// assert
+	assert.Equal(t, 4, calls)
+	assert.Equal(t, 1, len(*events))
+	assert.Equal(t, []string{
+		kinesis.ShardIteratorTypeTrimHorizon + " ",
+		kinesis.ShardIteratorTypeAfterSequenceNumber + " 1",
+	}, iterators)
+	// closed shards are kept by the consumer
+	assert.Equal(t, shard, consumer.shards[shard.Id])
+}
+
+func Test_Shard_Monitor_RemovesTheShard_WhenItDoesNotExist(t *testing.T) {
+	client := &MockKinesisClient{
+		GetShardIteratorStub: func(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+			return nil, awserr.New(kinesis.ErrCodeResourceNotFoundException, "Not found", nil)
+		},
+	}
+	params := &Params{Config: &Config{ReportFrequency: time.Hour}, Registry: NewDummyRegistry()}
+	consumer := NewKinesisConsumer("the_stream", client, NewGroupManager(params))
+	shard := NewShard("shard-0", consumer)
+	consumer.shards[shard.Id] = shard
+	// go!
+	shard.Monitor(context.Background())
+	// assert
+	assert.Equal(t, 0, len(consumer.shards))
+}
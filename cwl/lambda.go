@@ -0,0 +1,101 @@
+package cwl
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+)
+
+// the prefix of the names of the lambda functions' log groups
+const lambdaGroupPrefix = "/aws/lambda/"
+
+var (
+	// the platform lines of an invocation, e.g.
+	// START RequestId: 8f5a... Version: $LATEST
+	// REPORT RequestId: 8f5a...	Duration: 2.27 ms	Billed Duration: 3 ms ...
+	lambdaPlatformRegex = regexp.MustCompile(`^(START|END|REPORT) RequestId: (\S+)(.*)`)
+	// the lines logged by the runtimes, e.g.
+	// 2020-01-01T00:00:00.000Z	8f5a...	INFO	message
+	lambdaLogRegex = regexp.MustCompile(`^\S+\t([0-9a-fA-F-]{36})\t`)
+	// the version of the stream names, e.g. 2020/01/01/[$LATEST]abcdef
+	lambdaStreamRegex = regexp.MustCompile(`^\d{4}/\d{2}/\d{2}/\[([^\]]+)\]`)
+)
+
+// the metrics of the REPORT lines by their name, with their fields and
+// whether they are integers
+var lambdaReportMetrics = map[string]struct {
+	field   string
+	integer bool
+}{
+	"Duration":        {"duration_ms", false},
+	"Billed Duration": {"billed_duration_ms", true},
+	"Memory Size":     {"memory_size_mb", true},
+	"Max Memory Used": {"max_memory_used_mb", true},
+	"Init Duration":   {"init_duration_ms", false},
+}
+
+// Parses the lines of an event of a lambda function's log group into the
+// fields of the invocation: the request id, the function's version (of
+// the START line) and the metrics of the REPORT line. The function's name
+// and version are also derived from the names of the group and stream.
+// Returns the fields under the "lambda" key.
+func parseLambdaEvent(groupName string, streamName string, message string) common.MapStr {
+	fields := common.MapStr{}
+	if strings.HasPrefix(groupName, lambdaGroupPrefix) {
+		fields["function_name"] = groupName[len(lambdaGroupPrefix):]
+	}
+	if match := lambdaStreamRegex.FindStringSubmatch(streamName); match != nil {
+		fields["version"] = match[1]
+	}
+	for _, line := range strings.Split(message, "\n") {
+		if match := lambdaLogRegex.FindStringSubmatch(line); match != nil {
+			fields["request_id"] = match[1]
+			continue
+		}
+		match := lambdaPlatformRegex.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		fields["request_id"] = match[2]
+		switch match[1] {
+		case "START":
+			if version := strings.TrimPrefix(strings.TrimSpace(match[3]), "Version: "); version != "" {
+				fields["version"] = version
+			}
+		case "REPORT":
+			parseLambdaReport(match[3], fields)
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return common.MapStr{"lambda": fields}
+}
+
+// Parses the tab separated metrics of a REPORT line, e.g. "Duration: 2.27 ms"
+func parseLambdaReport(report string, fields common.MapStr) {
+	for _, metric := range strings.Split(report, "\t") {
+		index := strings.Index(metric, ": ")
+		if index < 0 {
+			continue
+		}
+		name := strings.TrimSpace(metric[:index])
+		spec, ok := lambdaReportMetrics[name]
+		if !ok {
+			continue
+		}
+		value := strings.Fields(metric[index+2:])
+		if len(value) == 0 {
+			continue
+		}
+		if spec.integer {
+			if n, err := strconv.ParseInt(value[0], 10, 64); err == nil {
+				fields[spec.field] = n
+			}
+		} else if n, err := strconv.ParseFloat(value[0], 64); err == nil {
+			fields[spec.field] = n
+		}
+	}
+}
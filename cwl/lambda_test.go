@@ -0,0 +1,108 @@
+package cwl
+
+import (
+	"testing"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseLambdaEvent(t *testing.T) {
+	testCases := []struct {
+		group    string
+		stream   string
+		message  string
+		expected common.MapStr
+	}{
+		{
+			"/aws/lambda/function", "2020/01/01/[$LATEST]abcdef",
+			"START RequestId: 8f5a6b3e-1c2d-4e5f-8a9b-0c1d2e3f4a5b Version: 42\n",
+			common.MapStr{
+				"function_name": "function",
+				"request_id":    "8f5a6b3e-1c2d-4e5f-8a9b-0c1d2e3f4a5b",
+				"version":       "42",
+			},
+		},
+		{
+			"/aws/lambda/function", "2020/01/01/[$LATEST]abcdef",
+			"END RequestId: 8f5a6b3e-1c2d-4e5f-8a9b-0c1d2e3f4a5b\n",
+			common.MapStr{
+				"function_name": "function",
+				"request_id":    "8f5a6b3e-1c2d-4e5f-8a9b-0c1d2e3f4a5b",
+				"version":       "$LATEST",
+			},
+		},
+		{
+			"/aws/lambda/function", "2020/01/01/[7]abcdef",
+			"REPORT RequestId: 8f5a6b3e-1c2d-4e5f-8a9b-0c1d2e3f4a5b\tDuration: 2.27 ms\tBilled Duration: 3 ms\tMemory Size: 128 MB\tMax Memory Used: 63 MB\tInit Duration: 117.36 ms\t\n",
+			common.MapStr{
+				"function_name":      "function",
+				"request_id":         "8f5a6b3e-1c2d-4e5f-8a9b-0c1d2e3f4a5b",
+				"version":            "7",
+				"duration_ms":        2.27,
+				"billed_duration_ms": int64(3),
+				"memory_size_mb":     int64(128),
+				"max_memory_used_mb": int64(63),
+				"init_duration_ms":   117.36,
+			},
+		},
+		{
+			"/aws/lambda/function", "2020/01/01/[$LATEST]abcdef",
+			"START RequestId: 8f5a6b3e-1c2d-4e5f-8a9b-0c1d2e3f4a5b Version: $LATEST\n" +
+				"2020-01-01T00:00:00.000Z\t8f5a6b3e-1c2d-4e5f-8a9b-0c1d2e3f4a5b\tINFO\tHello\n" +
+				"END RequestId: 8f5a6b3e-1c2d-4e5f-8a9b-0c1d2e3f4a5b\n" +
+				"REPORT RequestId: 8f5a6b3e-1c2d-4e5f-8a9b-0c1d2e3f4a5b\tDuration: 1.00 ms\tBilled Duration: 1 ms\tMemory Size: 128 MB\tMax Memory Used: 60 MB\t\n",
+			common.MapStr{
+				"function_name":      "function",
+				"request_id":         "8f5a6b3e-1c2d-4e5f-8a9b-0c1d2e3f4a5b",
+				"version":            "$LATEST",
+				"duration_ms":        1.0,
+				"billed_duration_ms": int64(1),
+				"memory_size_mb":     int64(128),
+				"max_memory_used_mb": int64(60),
+			},
+		},
+		{
+			"/aws/lambda/function", "2020/01/01/[$LATEST]abcdef",
+			"2020-01-01T00:00:00.000Z\t8f5a6b3e-1c2d-4e5f-8a9b-0c1d2e3f4a5b\tERROR\tFailed\n",
+			common.MapStr{
+				"function_name": "function",
+				"request_id":    "8f5a6b3e-1c2d-4e5f-8a9b-0c1d2e3f4a5b",
+				"version":       "$LATEST",
+			},
+		},
+		{
+			"/ecs/api", "api/web/abcdef",
+			"GET /health 200\n",
+			nil,
+		},
+	}
+
+	for _, testCase := range testCases {
+		fields := parseLambdaEvent(testCase.group, testCase.stream, testCase.message)
+		if testCase.expected == nil {
+			assert.Nil(t, fields, testCase)
+		} else {
+			assert.Equal(t, common.MapStr{"lambda": testCase.expected}, fields, testCase)
+		}
+	}
+}
+
+func Test_Stream_ParsesTheEvents_OfLambdaProspectors(t *testing.T) {
+	group := &Group{Name: "/aws/lambda/function", Prospector: &Prospector{Parser: "lambda"}}
+	publisher, events := CreateCollectingPublisher(false)
+	params := &Params{Config: &Config{}, Publisher: publisher}
+	stream := NewStream("2020/01/01/[$LATEST]abcdef", group, nil, nil, params)
+
+	// fire!
+	stream.digest(CreateOutputLogEvent("END RequestId: 8f5a6b3e-1c2d-4e5f-8a9b-0c1d2e3f4a5b\n"))
+	// assert
+	assert.Equal(t, 1, len(*events))
+	assert.Equal(t, common.MapStr{
+		"lambda": common.MapStr{
+			"function_name": "function",
+			"request_id":    "8f5a6b3e-1c2d-4e5f-8a9b-0c1d2e3f4a5b",
+			"version":       "$LATEST",
+		},
+	}, (*events)[0].Fields)
+}
@@ -0,0 +1,255 @@
+package cwl
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/elastic/beats/v7/libbeat/logp"
+)
+
+// The CloudWatch Logs APIs whose requests are rate limited
+const (
+	DescribeLogGroupsAPI  = "describe_log_groups"
+	DescribeLogStreamsAPI = "describe_log_streams"
+	GetLogEventsAPI       = "get_log_events"
+	FilterLogEventsAPI    = "filter_log_events"
+	ListTagsLogGroupAPI   = "list_tags_log_group"
+)
+
+// The rate limit of an API: the number of requests per second and the
+// number of requests that can be made at once
+type RateLimit struct {
+	Rate  float64 `config:"rate"`
+	Burst int     `config:"burst"`
+}
+
+// RateLimitedClient wraps a CloudWatch Logs client so that the requests
+// of each API, as made by all the groups and streams, do not exceed the
+// API's rate limit. The rate of an API is halved whenever its requests are
+// throttled and recovers gradually as requests succeed.
+type RateLimitedClient struct {
+	cloudwatchlogsiface.CloudWatchLogsAPI
+	Name    string // identifies the client in the reports (e.g. its region)
+	buckets map[string]*tokenBucket
+	// true if throttled attempts are observed as they are retried by the
+	// SDK, rather than when the SDK gives up
+	observesRetries bool
+}
+
+// the limited APIs by the name of their SDK operation
+var rateLimitedOperations = map[string]string{
+	"DescribeLogGroups":  DescribeLogGroupsAPI,
+	"DescribeLogStreams": DescribeLogStreamsAPI,
+	"GetLogEvents":       GetLogEventsAPI,
+	"FilterLogEvents":    FilterLogEventsAPI,
+	"ListTagsLogGroup":   ListTagsLogGroupAPI,
+}
+
+func NewRateLimitedClient(client cloudwatchlogsiface.CloudWatchLogsAPI, limits map[string]*RateLimit) *RateLimitedClient {
+	limited := &RateLimitedClient{
+		CloudWatchLogsAPI: client,
+		buckets:           make(map[string]*tokenBucket),
+	}
+	for api, limit := range limits {
+		if limit != nil && limit.Rate > 0 {
+			limited.buckets[api] = newTokenBucket(*limit)
+		}
+	}
+	// the SDK retries throttled requests on its own
+	if sdkClient, ok := client.(*cloudwatchlogs.CloudWatchLogs); ok {
+		limited.observesRetries = true
+		sdkClient.Handlers.Retry.PushBack(func(r *request.Request) {
+			if request.IsErrorThrottle(r.Error) {
+				limited.observe(rateLimitedOperations[r.Operation.Name], r.Error)
+			}
+		})
+	}
+	return limited
+}
+
+// Waits until a request to the API is allowed
+func (client *RateLimitedClient) wait(api string) {
+	if bucket, ok := client.buckets[api]; ok {
+		bucket.wait()
+	}
+}
+
+// Adapts the rate of the API to the outcome of a request
+func (client *RateLimitedClient) observe(api string, err error) {
+	if bucket, ok := client.buckets[api]; ok {
+		bucket.adapt(err != nil && classifyError(err) == ThrottlingError)
+	}
+}
+
+// Adapts the rate of the API to the outcome of a call, unless the call
+// failed because of throttling that has been observed already
+func (client *RateLimitedClient) complete(api string, err error) {
+	if err != nil && client.observesRetries && classifyError(err) == ThrottlingError {
+		return
+	}
+	client.observe(api, err)
+}
+
+func (client *RateLimitedClient) GetLogEvents(input *cloudwatchlogs.GetLogEventsInput) (*cloudwatchlogs.GetLogEventsOutput, error) {
+	client.wait(GetLogEventsAPI)
+	output, err := client.CloudWatchLogsAPI.GetLogEvents(input)
+	client.complete(GetLogEventsAPI, err)
+	return output, err
+}
+
+func (client *RateLimitedClient) ListTagsLogGroup(input *cloudwatchlogs.ListTagsLogGroupInput) (*cloudwatchlogs.ListTagsLogGroupOutput, error) {
+	client.wait(ListTagsLogGroupAPI)
+	output, err := client.CloudWatchLogsAPI.ListTagsLogGroup(input)
+	client.complete(ListTagsLogGroupAPI, err)
+	return output, err
+}
+
+// the pages after the first are fetched after their predecessor's
+// callback returns, so waiting in the callback limits every request
+
+func (client *RateLimitedClient) DescribeLogGroupsPages(input *cloudwatchlogs.DescribeLogGroupsInput,
+	f func(*cloudwatchlogs.DescribeLogGroupsOutput, bool) bool) error {
+
+	client.wait(DescribeLogGroupsAPI)
+	err := client.CloudWatchLogsAPI.DescribeLogGroupsPages(input,
+		func(page *cloudwatchlogs.DescribeLogGroupsOutput, lastPage bool) bool {
+			client.observe(DescribeLogGroupsAPI, nil)
+			next := f(page, lastPage)
+			if next && !lastPage {
+				client.wait(DescribeLogGroupsAPI)
+			}
+			return next
+		})
+	if err != nil {
+		client.complete(DescribeLogGroupsAPI, err)
+	}
+	return err
+}
+
+func (client *RateLimitedClient) DescribeLogStreamsPages(input *cloudwatchlogs.DescribeLogStreamsInput,
+	f func(*cloudwatchlogs.DescribeLogStreamsOutput, bool) bool) error {
+
+	client.wait(DescribeLogStreamsAPI)
+	err := client.CloudWatchLogsAPI.DescribeLogStreamsPages(input,
+		func(page *cloudwatchlogs.DescribeLogStreamsOutput, lastPage bool) bool {
+			client.observe(DescribeLogStreamsAPI, nil)
+			next := f(page, lastPage)
+			if next && !lastPage {
+				client.wait(DescribeLogStreamsAPI)
+			}
+			return next
+		})
+	if err != nil {
+		client.complete(DescribeLogStreamsAPI, err)
+	}
+	return err
+}
+
+func (client *RateLimitedClient) FilterLogEventsPages(input *cloudwatchlogs.FilterLogEventsInput,
+	f func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool) error {
+
+	client.wait(FilterLogEventsAPI)
+	err := client.CloudWatchLogsAPI.FilterLogEventsPages(input,
+		func(page *cloudwatchlogs.FilterLogEventsOutput, lastPage bool) bool {
+			client.observe(FilterLogEventsAPI, nil)
+			next := f(page, lastPage)
+			if next && !lastPage {
+				client.wait(FilterLogEventsAPI)
+			}
+			return next
+		})
+	if err != nil {
+		client.complete(FilterLogEventsAPI, err)
+	}
+	return err
+}
+
+// Logs the time spent waiting for each API and its current rate
+func (client *RateLimitedClient) report(frequency time.Duration) {
+	apis := make([]string, 0, len(client.buckets))
+	for api := range client.buckets {
+		apis = append(apis, api)
+	}
+	sort.Strings(apis)
+	for _, api := range apis {
+		waited, requests, throttled, rate := client.buckets[api].stats()
+		name := api
+		if client.Name != "" {
+			name = client.Name + ":" + api
+		}
+		logp.Info("report[limiter] %d %d %v %.2f %s %s", requests, throttled, waited, rate, name, frequency)
+	}
+}
+
+// A token bucket whose rate adapts to throttling: the rate is halved
+// (down to a sixteenth of the limit) whenever a request is throttled and
+// increases by a twentieth of the limit with every successful request
+type tokenBucket struct {
+	mutex  sync.Mutex
+	limit  float64 // the configured rate (requests per second)
+	rate   float64 // the current rate
+	burst  float64
+	tokens float64 // may become negative, in which case requests wait
+	last   time.Time
+
+	// statistics since the last report
+	waited    time.Duration
+	requests  int64
+	throttled int64
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = math.Max(1, math.Ceil(limit.Rate))
+	}
+	return &tokenBucket{
+		limit:  limit.Rate,
+		rate:   limit.Rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Takes a token, waiting for it if none is available
+func (bucket *tokenBucket) wait() {
+	bucket.mutex.Lock()
+	now := time.Now()
+	bucket.tokens = math.Min(bucket.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate)
+	bucket.last = now
+	bucket.tokens--
+	var delay time.Duration
+	if bucket.tokens < 0 {
+		delay = time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+	}
+	bucket.waited += delay
+	bucket.requests++
+	bucket.mutex.Unlock()
+	time.Sleep(delay)
+}
+
+func (bucket *tokenBucket) adapt(throttled bool) {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	if throttled {
+		bucket.throttled++
+		bucket.rate = math.Max(bucket.limit/16, bucket.rate/2)
+	} else {
+		bucket.rate = math.Min(bucket.limit, bucket.rate+bucket.limit/20)
+	}
+}
+
+// Returns and resets the statistics of the bucket
+func (bucket *tokenBucket) stats() (time.Duration, int64, int64, float64) {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	waited, requests, throttled := bucket.waited, bucket.requests, bucket.throttled
+	bucket.waited, bucket.requests, bucket.throttled = 0, 0, 0
+	return waited, requests, throttled, bucket.rate
+}
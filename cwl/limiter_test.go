@@ -0,0 +1,121 @@
+package cwl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_TokenBucket_AllowsBursts_ThenWaits(t *testing.T) {
+	bucket := newTokenBucket(RateLimit{Rate: 100, Burst: 2})
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		bucket.wait()
+	}
+	// the last two requests wait for up to 10ms each
+	assert.True(t, time.Since(start) >= 19*time.Millisecond)
+	waited, requests, throttled, rate := bucket.stats()
+	assert.True(t, waited > 0)
+	assert.Equal(t, int64(4), requests)
+	assert.Equal(t, int64(0), throttled)
+	assert.Equal(t, 100.0, rate)
+	// the statistics are reset
+	waited, requests, _, _ = bucket.stats()
+	assert.Equal(t, time.Duration(0), waited)
+	assert.Equal(t, int64(0), requests)
+}
+
+func Test_TokenBucket_DefaultBurst_IsTheRate(t *testing.T) {
+	assert.Equal(t, 3.0, newTokenBucket(RateLimit{Rate: 2.5}).burst)
+	assert.Equal(t, 1.0, newTokenBucket(RateLimit{Rate: 0.2}).burst)
+}
+
+func Test_TokenBucket_SlowsDown_WhenThrottled(t *testing.T) {
+	bucket := newTokenBucket(RateLimit{Rate: 16, Burst: 1})
+	bucket.adapt(true)
+	assert.Equal(t, 8.0, bucket.rate)
+	for i := 0; i < 10; i++ {
+		bucket.adapt(true)
+	}
+	assert.Equal(t, 1.0, bucket.rate)
+	bucket.adapt(false)
+	assert.Equal(t, 1.8, bucket.rate)
+	for i := 0; i < 30; i++ {
+		bucket.adapt(false)
+	}
+	assert.Equal(t, 16.0, bucket.rate)
+	_, _, throttled, _ := bucket.stats()
+	assert.Equal(t, int64(11), throttled)
+}
+
+func Test_RateLimitedClient_GetLogEvents_AdaptsToThrottling(t *testing.T) {
+	client := &MockCWLClient{}
+	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).
+		Return(nil, awserr.New("ThrottlingException", "Rate exceeded", nil))
+	limited := NewRateLimitedClient(client, map[string]*RateLimit{
+		GetLogEventsAPI:       {Rate: 10, Burst: 10},
+		DescribeLogStreamsAPI: {Rate: 0},
+	})
+	// go!
+	_, err := limited.GetLogEvents(&cloudwatchlogs.GetLogEventsInput{})
+	// assert
+	assert.NotNil(t, err)
+	assert.Equal(t, 5.0, limited.buckets[GetLogEventsAPI].rate)
+	// APIs without a rate are not limited
+	_, ok := limited.buckets[DescribeLogStreamsAPI]
+	assert.False(t, ok)
+}
+
+func Test_RateLimitedClient_DescribeLogStreamsPages_LimitsEveryPage(t *testing.T) {
+	client := &MockCWLClient{}
+	client.On(
+		"DescribeLogStreamsPages",
+		mock.AnythingOfType("*cloudwatchlogs.DescribeLogStreamsInput"),
+		mock.AnythingOfType("func(*cloudwatchlogs.DescribeLogStreamsOutput, bool) bool"),
+	).Return(nil).Run(
+		func(args mock.Arguments) {
+			f := args.Get(1).(func(*cloudwatchlogs.DescribeLogStreamsOutput, bool) bool)
+			for page := 0; page < 3 && f(&cloudwatchlogs.DescribeLogStreamsOutput{}, page == 2); page++ {
+			}
+		},
+	)
+	limited := NewRateLimitedClient(client, map[string]*RateLimit{
+		DescribeLogStreamsAPI: {Rate: 1000, Burst: 1},
+	})
+	pages := 0
+	// go!
+	err := limited.DescribeLogStreamsPages(&cloudwatchlogs.DescribeLogStreamsInput{},
+		func(page *cloudwatchlogs.DescribeLogStreamsOutput, lastPage bool) bool {
+			pages++
+			return true
+		})
+	// assert
+	assert.Nil(t, err)
+	assert.Equal(t, 3, pages)
+	_, requests, _, _ := limited.buckets[DescribeLogStreamsAPI].stats()
+	assert.Equal(t, int64(3), requests)
+}
+
+func Test_Config_RateLimits_AreMergedWithTheDefaults(t *testing.T) {
+	content :=
+		`
+rate_limits:
+  get_log_events:
+    rate: 2
+    burst: 4
+`
+	cfg, _ := common.NewConfigWithYAML([]byte(content), "test")
+	config := DefaultConfig("eu-west-1")
+	assert.Nil(t, cfg.Unpack(config))
+	assert.Nil(t, config.Validate())
+	assert.Equal(t, &RateLimit{Rate: 2, Burst: 4}, config.RateLimits[GetLogEventsAPI])
+	assert.Equal(t, &RateLimit{Rate: 5, Burst: 5}, config.RateLimits[DescribeLogGroupsAPI])
+
+	config.RateLimits["put_log_events"] = &RateLimit{Rate: 1}
+	assert.NotNil(t, config.Validate())
+}
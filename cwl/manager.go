@@ -1,7 +1,8 @@
 package cwl
 
 import (
-	"strings"
+	"context"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -12,72 +13,276 @@ import (
 type GroupManager struct {
 	Params *Params
 	groups map[string]*Group
+	tags   map[string]*groupTagCache // the tags of the groups selected by group_tags by clientKey
+	// serializes the digestion of pushed events (kinesis, firehose etc.)
+	dispatchLock sync.Mutex
+
+	ctx      context.Context // cancelled when the groups must stop
+	running  sync.WaitGroup  // the groups being monitored
+	finished chan *Group     // the groups that do not exist anymore
+
+	newGroups     int
+	removedGroups int
 }
 
 func NewGroupManager(params *Params) *GroupManager {
+	if params.Scheduler == nil && params.Config.StreamWorkers > 0 {
+		params.Scheduler = NewScheduler(params.Config.StreamWorkers)
+	}
 	return &GroupManager{
-		Params: params,
-		groups: make(map[string]*Group),
+		Params:   params,
+		groups:   make(map[string]*Group),
+		tags:     make(map[string]*groupTagCache),
+		ctx:      context.Background(),
+		finished: make(chan *Group),
 	}
 }
 
+// Adds the groups of the prospectors that are not monitored yet and
+// removes the monitored groups that are not matched anymore (e.g. because
+// they have been deleted). Patterns are looked up by their literal prefix
+// and matched locally, as are the tags of prospectors with group_tags.
+// Groups are only removed if all the patterns (and tags) have been looked
+// up successfully.
 func (manager *GroupManager) refreshGroups() {
-	for _, prospector := range manager.Params.Config.Prospectors {
-		prospector := prospector
-		for _, groupName := range prospector.GroupNames {
-			groupName := groupName
-			// If input group name doesn't end with a star, then consider it a
-			// normal group name
-			if !strings.HasSuffix(groupName, "*") {
-				if _, ok := manager.groups[groupName]; !ok {
-					manager.addNewGroup(groupName, &prospector)
-				}
-				continue
+	matched := make(map[string]bool)
+	complete := true
+	for i := range manager.Params.Config.Prospectors {
+		prospector := &manager.Params.Config.Prospectors[i]
+		for _, region := range manager.Params.Config.ProspectorRegions(prospector) {
+			if !manager.refreshRegionGroups(prospector, region, matched) {
+				complete = false
 			}
-			// If the input group name ends with a star, then consider it a prefix and
-			// find all group names with that prefix
-			err := manager.Params.AWSClient.DescribeLogGroupsPages(
-				&cloudwatchlogs.DescribeLogGroupsInput{
-					LogGroupNamePrefix: aws.String(groupName[:len(groupName)-1]),
-				},
-				func(page *cloudwatchlogs.DescribeLogGroupsOutput, lastPage bool) bool {
-					for _, logGroup := range page.LogGroups {
-						groupName := aws.StringValue(logGroup.LogGroupName)
-						if _, ok := manager.groups[groupName]; !ok {
-							manager.addNewGroup(groupName, &prospector)
-						}
+		}
+	}
+	for _, cache := range manager.tags {
+		cache.expire()
+	}
+	if !complete {
+		return
+	}
+	for key, group := range manager.groups {
+		if !matched[key] {
+			manager.removeGroup(group)
+		}
+	}
+}
+
+// Adds the groups of the prospector in a region (and the prospector's
+// account) and marks them as matched by their key; returns false if any
+// lookup failed
+func (manager *GroupManager) refreshRegionGroups(prospector *Prospector, region string, matched map[string]bool) bool {
+	complete := true
+	// the groups of aws_region have no region
+	if region == manager.Params.Config.AWSRegion {
+		region = ""
+	}
+	account := prospector.AccountId()
+	client := manager.Params.Client(account, region)
+	// checks the tags of a group against the prospector's selector (if any)
+	selected := func(groupName string) bool {
+		if len(prospector.GroupTags) == 0 {
+			return true
+		}
+		cache, ok := manager.tags[ClientKey(account, region)]
+		if !ok {
+			cache = newGroupTagCache(client, manager.Params.Config.GroupTagsRefreshFrequency)
+			manager.tags[ClientKey(account, region)] = cache
+		}
+		tags, err := cache.get(groupName)
+		if err != nil && classifyError(err) == NotFoundError {
+			return false
+		}
+		if err != nil {
+			logp.Warn("manager: Failed to list the tags of log group %s [%s]", groupKey(account, region, groupName), err.Error())
+			complete = false
+			return false
+		}
+		return matchGroupTags(prospector.GroupTags, tags)
+	}
+	// marks the group as matched and monitors it if needed
+	add := func(groupName string) {
+		key := groupKey(account, region, groupName)
+		matched[key] = true
+		if _, ok := manager.groups[key]; !ok {
+			manager.addNewGroup(groupName, account, region, prospector)
+		}
+	}
+	groupNames := prospector.GroupNames
+	if len(groupNames) == 0 && len(prospector.GroupTags) > 0 {
+		groupNames = []string{"*"}
+	}
+	for _, groupName := range groupNames {
+		pattern, err := CompileGroupNamePattern(groupName)
+		if err != nil {
+			logp.Warn("manager: Invalid group name pattern %s [%s]", groupName, err.Error())
+			continue
+		}
+		// find all group names with the pattern's prefix (if any) and
+		// match them against the pattern; literal group names are looked
+		// up too, so that deleted groups are not monitored again
+		input := &cloudwatchlogs.DescribeLogGroupsInput{}
+		if pattern.Prefix() != "" {
+			input.LogGroupNamePrefix = aws.String(pattern.Prefix())
+		}
+		err = client.DescribeLogGroupsPages(
+			input,
+			func(page *cloudwatchlogs.DescribeLogGroupsOutput, lastPage bool) bool {
+				for _, logGroup := range page.LogGroups {
+					groupName := aws.StringValue(logGroup.LogGroupName)
+					if pattern.Match(groupName) && !prospector.excludesGroupName(groupName) && selected(groupName) {
+						add(groupName)
 					}
-					return true
-				},
-			)
-			if err != nil {
-				logp.Warn("manager: Failed to describe log group %s [%s]", groupName, err.Error())
-			}
+				}
+				return true
+			},
+		)
+		if err != nil {
+			logp.Warn("manager: Failed to describe log group %s [%s]", groupKey(account, region, groupName), err.Error())
+			complete = false
 		}
 	}
+	return complete
 }
 
-func (manager *GroupManager) addNewGroup(name string, prospector *Prospector) {
+func (manager *GroupManager) addNewGroup(name string, account string, region string, prospector *Prospector) {
 	group := NewGroup(name, prospector, manager.Params)
-	manager.groups[group.Name] = group
-	go group.Monitor()
+	group.Account = account
+	group.Region = region
+	ctx, stop := context.WithCancel(manager.ctx)
+	group.stop = stop
+	group.finished = manager.finished
+	logp.Info("Start monitoring group %s", group.key())
+	manager.groups[group.key()] = group
+	manager.running.Add(1)
+	go func() {
+		defer manager.running.Done()
+		group.Monitor(ctx)
+	}()
+	manager.newGroups++
 }
 
-func (manager *GroupManager) Monitor() {
+// Stops monitoring a group; its streams are drained and, if
+// cleanup_registry is enabled, their registry items are deleted
+func (manager *GroupManager) removeGroup(group *Group) {
+	logp.Info("Stop monitoring group %s", group.key())
+	delete(manager.groups, group.key())
+	group.removed = true
+	group.stop()
+	manager.removedGroups++
+}
+
+// Returns the first prospector that matches the group name
+func (manager *GroupManager) findProspector(groupName string) *Prospector {
+	for i := range manager.Params.Config.Prospectors {
+		prospector := &manager.Params.Config.Prospectors[i]
+		if prospector.matchGroupName(groupName) {
+			return prospector
+		}
+	}
+	return nil
+}
+
+// A group name pattern matches a group if it is equal to its name or, in
+// case it is a glob pattern or a regular expression, if it matches its name
+func matchGroupName(pattern string, groupName string) bool {
+	compiled, err := CompileGroupNamePattern(pattern)
+	if err != nil {
+		return false
+	}
+	return compiled.Match(groupName)
+}
+
+// Returns the stream that digests the events of a group's stream whose
+// events are pushed to the beat, creating the group (without monitoring
+// it) if needed. The groups of subscription messages belong to the
+// message's owner and have no known region. Returns nil if the group is
+// not matched by any prospector or the stream is filtered out by its
+// prospector.
+// Must be called with the dispatchLock held.
+func (manager *GroupManager) dispatchStream(account string, groupName string, streamName string, subscribed bool) *Stream {
+	key := groupKey(account, "", groupName)
+	group, ok := manager.groups[key]
+	if !ok {
+		prospector := manager.findProspector(groupName)
+		if prospector == nil {
+			logp.Debug("manager", "no prospector matches group %s", key)
+			return nil
+		}
+		group = NewGroup(groupName, prospector, manager.Params)
+		group.Account = account
+		group.subscribed = subscribed
+		manager.groups[key] = group
+	}
+	if !group.matchStreamName(streamName) {
+		return nil
+	}
+	return group.dispatchStream(streamName)
+}
+
+// Continuously monitors the groups of the prospectors until the context
+// is cancelled, in which case it returns once all the groups (and the
+// scheduler of their streams) have drained
+func (manager *GroupManager) Monitor(ctx context.Context) {
+	manager.ctx = ctx
+	if scheduler := manager.Params.Scheduler; scheduler != nil {
+		manager.running.Add(1)
+		go func() {
+			defer manager.running.Done()
+			scheduler.Run(ctx)
+		}()
+	}
 	ticker := time.NewTicker(manager.Params.Config.GroupRefreshFrequency)
 	defer ticker.Stop()
 	reportTicker := time.NewTicker(manager.Params.Config.ReportFrequency)
 	defer reportTicker.Stop()
 	for {
 		select {
+		case <-ctx.Done():
+			manager.running.Wait()
+			return
 		case <-ticker.C:
 			manager.refreshGroups()
+		case group := <-manager.finished:
+			// the group may have been removed (or replaced) in the meantime
+			if manager.groups[group.key()] == group {
+				manager.removeGroup(group)
+			}
 		case <-reportTicker.C:
 			manager.report()
 		}
 	}
 }
 
+// Publishes the multiline buffers of the streams whose events are pushed
+// to the beat as incomplete events; used on shutdown by inputs that do not
+// keep any state
+func (manager *GroupManager) flush() {
+	manager.dispatchLock.Lock()
+	defer manager.dispatchLock.Unlock()
+	for _, group := range manager.groups {
+		group.mutex.RLock()
+		for _, stream := range group.streams {
+			stream.flushPartial()
+		}
+		group.mutex.RUnlock()
+	}
+}
+
 func (manager *GroupManager) report() {
-	logp.Info("report[manager] %d %d", len(manager.Params.Config.Prospectors), len(manager.groups))
+	logp.Info("report[manager] %d %d %d %d", len(manager.Params.Config.Prospectors), len(manager.groups),
+		manager.newGroups, manager.removedGroups)
+	manager.newGroups = 0
+	manager.removedGroups = 0
+	if scheduler := manager.Params.Scheduler; scheduler != nil {
+		scheduler.report()
+	}
+	if client, ok := manager.Params.AWSClient.(*RateLimitedClient); ok {
+		client.report(manager.Params.Config.ReportFrequency)
+	}
+	for _, client := range manager.Params.Clients {
+		if client, ok := client.(*RateLimitedClient); ok {
+			client.report(manager.Params.Config.ReportFrequency)
+		}
+	}
 }
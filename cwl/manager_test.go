@@ -0,0 +1,312 @@
+package cwl
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// stubs DescribeLogGroupsPages to list the named groups once
+func stubDescribeLogGroupsPages(client *MockCWLClient, err error, names ...string) {
+	stubDescribeLogGroupsPagesInput(client, mock.AnythingOfType("*cloudwatchlogs.DescribeLogGroupsInput"), err, names...)
+}
+
+// stubs DescribeLogGroupsPages to list the named groups once for the
+// lookups of a prefix
+func stubDescribeLogGroupsPagesWithPrefix(client *MockCWLClient, prefix string, err error, names ...string) {
+	stubDescribeLogGroupsPagesInput(client, mock.MatchedBy(func(input *cloudwatchlogs.DescribeLogGroupsInput) bool {
+		return aws.StringValue(input.LogGroupNamePrefix) == prefix
+	}), err, names...)
+}
+
+func stubDescribeLogGroupsPagesInput(client *MockCWLClient, input interface{}, err error, names ...string) {
+	client.On(
+		"DescribeLogGroupsPages",
+		input,
+		mock.AnythingOfType("func(*cloudwatchlogs.DescribeLogGroupsOutput, bool) bool"),
+	).Return(err).Run(
+		func(args mock.Arguments) {
+			page := &cloudwatchlogs.DescribeLogGroupsOutput{}
+			for _, name := range names {
+				page.LogGroups = append(page.LogGroups, &cloudwatchlogs.LogGroup{LogGroupName: aws.String(name)})
+			}
+			f := args.Get(1).(func(*cloudwatchlogs.DescribeLogGroupsOutput, bool) bool)
+			f(page, true)
+		},
+	).Once()
+}
+
+func Test_GroupManager_RemovesGroups_ThatAreNotListedAnymore(t *testing.T) {
+	client := &MockCWLClient{}
+	for i := 0; i < 3; i++ {
+		stubDescribeLogGroupsPagesWithPrefix(client, "literal", nil, "literal", "literal-other")
+	}
+	stubDescribeLogGroupsPages(client, nil, "/aws/lambda/a", "/aws/lambda/b")
+	stubDescribeLogGroupsPages(client, errors.New("throttled"))
+	stubDescribeLogGroupsPages(client, nil, "/aws/lambda/a")
+	params := &Params{
+		Config: &Config{
+			Prospectors:                 []Prospector{{GroupNames: []string{"/aws/lambda/*", "literal"}}},
+			GroupRefreshFrequency:       time.Hour,
+			StreamRefreshFrequency:      time.Hour,
+			StreamEventHorizon:          time.Hour,
+			StreamEventRefreshFrequency: time.Hour,
+			ReportFrequency:             time.Hour,
+		},
+		Registry:  NewDummyRegistry(),
+		AWSClient: client,
+	}
+	manager := NewGroupManager(params)
+	ctx, cancel := context.WithCancel(context.Background())
+	manager.ctx = ctx
+
+	// go!
+	manager.refreshGroups()
+	assert.Equal(t, 3, len(manager.groups))
+	removed := manager.groups["/aws/lambda/b"]
+	// a failed listing does not remove any group
+	manager.refreshGroups()
+	assert.Equal(t, 3, len(manager.groups))
+	manager.refreshGroups()
+	// assert
+	assert.Equal(t, 2, len(manager.groups))
+	assert.Nil(t, manager.groups["/aws/lambda/b"])
+	assert.NotNil(t, manager.groups["literal"])
+	assert.True(t, removed.removed)
+	assert.Equal(t, 3, manager.newGroups)
+	assert.Equal(t, 1, manager.removedGroups)
+	cancel()
+	manager.running.Wait()
+}
+
+func Test_GroupManager_RemovesDeletedGroups_AndCleansUpTheRegistry(t *testing.T) {
+	client := &MockCWLClient{}
+	client.On(
+		"FilterLogEventsPages",
+		mock.AnythingOfType("*cloudwatchlogs.FilterLogEventsInput"),
+		mock.AnythingOfType("func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool"),
+	).Return(awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, "Not found", nil))
+	registry := NewDummyRegistry()
+	params := &Params{
+		Config: &Config{
+			Prospectors:                 []Prospector{{GroupNames: []string{"deleted"}, Mode: GroupMode}},
+			GroupRefreshFrequency:       time.Hour,
+			StreamRefreshFrequency:      time.Hour,
+			StreamEventHorizon:          time.Hour,
+			StreamEventRefreshFrequency: time.Millisecond,
+			ReportFrequency:             time.Hour,
+			CleanupRegistry:             true,
+		},
+		Registry:  registry,
+		AWSClient: client,
+	}
+	manager := NewGroupManager(params)
+	group := NewGroup("deleted", &params.Config.Prospectors[0], params)
+	registry.WriteGroupInfo(group, &GroupRegistryItem{Timestamp: TimeBeforeNowInMilliseconds(time.Minute)})
+	stubDescribeLogGroupsPagesWithPrefix(client, "deleted", nil, "deleted")
+	stubDescribeLogGroupsPagesWithPrefix(client, "deleted", nil)
+	manager.refreshGroups()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	// go!
+	go func() {
+		manager.Monitor(ctx)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool {
+		item, _ := registry.ReadGroupInfo(group)
+		return item == nil
+	}, time.Second, time.Millisecond)
+	cancel()
+	<-done
+	// the deleted group is not listed anymore, so it stays removed
+	manager.refreshGroups()
+	// assert
+	assert.Equal(t, 0, len(manager.groups))
+	assert.Equal(t, 1, manager.newGroups)
+	assert.Equal(t, 1, manager.removedGroups)
+	client.AssertNumberOfCalls(t, "DescribeLogGroupsPages", 2)
+}
+
+func Test_GroupManager_LooksUpPatternsByPrefix_AndMatchesThemLocally(t *testing.T) {
+	client := &MockCWLClient{}
+	stubDescribeLogGroupsPages(client, nil,
+		"/aws/lambda/api-prod-handler", "/aws/lambda/api-prod-debug", "/aws/lambda/api-staging-handler")
+	params := &Params{
+		Config: &Config{
+			Prospectors: []Prospector{{
+				GroupNames:        []string{"/aws/lambda/*-prod-*"},
+				ExcludeGroupNames: []string{"*-debug"},
+			}},
+			GroupRefreshFrequency:       time.Hour,
+			StreamRefreshFrequency:      time.Hour,
+			StreamEventHorizon:          time.Hour,
+			StreamEventRefreshFrequency: time.Hour,
+			ReportFrequency:             time.Hour,
+		},
+		Registry:  NewDummyRegistry(),
+		AWSClient: client,
+	}
+	manager := NewGroupManager(params)
+	ctx, cancel := context.WithCancel(context.Background())
+	manager.ctx = ctx
+
+	// go!
+	manager.refreshGroups()
+	// assert
+	input := client.Calls[0].Arguments.Get(0).(*cloudwatchlogs.DescribeLogGroupsInput)
+	assert.Equal(t, "/aws/lambda/", aws.StringValue(input.LogGroupNamePrefix))
+	assert.Equal(t, 1, len(manager.groups))
+	assert.NotNil(t, manager.groups["/aws/lambda/api-prod-handler"])
+	cancel()
+	manager.running.Wait()
+}
+
+func Test_GroupManager_SelectsGroupsByTags(t *testing.T) {
+	client := &MockCWLClient{}
+	stubDescribeLogGroupsPages(client, nil, "payments-api", "payments-staging", "search-api")
+	stubListTagsLogGroup(client, "payments-api", map[string]string{"team": "payments", "env": "prod"})
+	stubListTagsLogGroup(client, "payments-staging", map[string]string{"team": "payments", "env": "staging"})
+	stubListTagsLogGroup(client, "search-api", map[string]string{"team": "search", "env": "prod"})
+	params := &Params{
+		Config: &Config{
+			Prospectors: []Prospector{{
+				GroupTags: map[string]string{"team": "payments", "env": "prod"},
+			}},
+			GroupRefreshFrequency:       time.Hour,
+			StreamRefreshFrequency:      time.Hour,
+			StreamEventHorizon:          time.Hour,
+			StreamEventRefreshFrequency: time.Hour,
+			ReportFrequency:             time.Hour,
+			GroupTagsRefreshFrequency:   time.Hour,
+		},
+		Registry:  NewDummyRegistry(),
+		AWSClient: client,
+	}
+	manager := NewGroupManager(params)
+	ctx, cancel := context.WithCancel(context.Background())
+	manager.ctx = ctx
+
+	// go!
+	manager.refreshGroups()
+	// assert
+	input := client.Calls[0].Arguments.Get(0).(*cloudwatchlogs.DescribeLogGroupsInput)
+	assert.Nil(t, input.LogGroupNamePrefix)
+	assert.Equal(t, 1, len(manager.groups))
+	assert.NotNil(t, manager.groups["payments-api"])
+	cancel()
+	manager.running.Wait()
+}
+
+func Test_GroupManager_DispatchStream_SkipsFilteredStreams(t *testing.T) {
+	params := &Params{
+		Config: &Config{
+			Prospectors: []Prospector{{
+				GroupNames:    []string{"/aws/lambda/*"},
+				StreamExclude: []string{"debug"},
+			}},
+			GroupRefreshFrequency:       time.Hour,
+			StreamRefreshFrequency:      time.Hour,
+			StreamEventHorizon:          time.Hour,
+			StreamEventRefreshFrequency: time.Hour,
+			ReportFrequency:             time.Hour,
+		},
+		Registry:  NewDummyRegistry(),
+		AWSClient: &MockCWLClient{},
+	}
+	manager := NewGroupManager(params)
+	assert.NotNil(t, manager.dispatchStream("", "/aws/lambda/function", "2020/01/01/abcde", false))
+	assert.Nil(t, manager.dispatchStream("", "/aws/lambda/function", "2020/01/01/debug", false))
+}
+
+func Test_GroupManager_MonitorsGroups_InEveryRegion(t *testing.T) {
+	client := &MockCWLClient{}
+	stubDescribeLogGroupsPages(client, nil, "/aws/lambda/function")
+	otherClient := &MockCWLClient{}
+	stubDescribeLogGroupsPages(otherClient, nil, "/aws/lambda/function")
+	params := &Params{
+		Config: &Config{
+			Prospectors: []Prospector{{
+				GroupNames: []string{"/aws/lambda/*"},
+				Regions:    []string{"eu-west-1", "us-east-1"},
+			}},
+			GroupRefreshFrequency:       time.Hour,
+			StreamRefreshFrequency:      time.Hour,
+			StreamEventHorizon:          time.Hour,
+			StreamEventRefreshFrequency: time.Hour,
+			ReportFrequency:             time.Hour,
+			AWSRegion:                   "eu-west-1",
+		},
+		Registry:  NewDummyRegistry(),
+		AWSClient: client,
+		Clients:   map[string]cloudwatchlogsiface.CloudWatchLogsAPI{ClientKey("", "us-east-1"): otherClient},
+	}
+	manager := NewGroupManager(params)
+	ctx, cancel := context.WithCancel(context.Background())
+	manager.ctx = ctx
+
+	// go!
+	manager.refreshGroups()
+	// assert
+	assert.Equal(t, 2, len(manager.groups))
+	assert.Equal(t, "", manager.groups["/aws/lambda/function"].Region)
+	assert.Equal(t, "us-east-1", manager.groups["us-east-1:/aws/lambda/function"].Region)
+	client.AssertNumberOfCalls(t, "DescribeLogGroupsPages", 1)
+	otherClient.AssertNumberOfCalls(t, "DescribeLogGroupsPages", 1)
+	// the registry keys of aws_region are not prefixed with the region
+	for key, group := range manager.groups {
+		stream := NewStream("stream", group, nil, nil, params)
+		assert.Equal(t, key+"/stream", generateKey(stream))
+	}
+	assert.Equal(t, "/aws/lambda/function/:group", generateGroupKey(manager.groups["/aws/lambda/function"]))
+	cancel()
+	manager.running.Wait()
+}
+
+func Test_GroupManager_MonitorsGroups_OfOtherAccounts(t *testing.T) {
+	client := &MockCWLClient{}
+	accountClient := &MockCWLClient{}
+	stubDescribeLogGroupsPages(accountClient, nil, "/aws/lambda/function")
+	params := &Params{
+		Config: &Config{
+			Prospectors: []Prospector{{
+				GroupNames: []string{"/aws/lambda/*"},
+				RoleArn:    "arn:aws:iam::123456789012:role/cloudwatchlogsbeat",
+			}},
+			GroupRefreshFrequency:       time.Hour,
+			StreamRefreshFrequency:      time.Hour,
+			StreamEventHorizon:          time.Hour,
+			StreamEventRefreshFrequency: time.Hour,
+			ReportFrequency:             time.Hour,
+		},
+		Registry:  NewDummyRegistry(),
+		AWSClient: client,
+		Clients:   map[string]cloudwatchlogsiface.CloudWatchLogsAPI{ClientKey("123456789012", ""): accountClient},
+	}
+	manager := NewGroupManager(params)
+	ctx, cancel := context.WithCancel(context.Background())
+	manager.ctx = ctx
+
+	// go!
+	manager.refreshGroups()
+	// assert
+	group := manager.groups["123456789012:/aws/lambda/function"]
+	assert.NotNil(t, group)
+	assert.Equal(t, "123456789012", group.Account)
+	client.AssertNumberOfCalls(t, "DescribeLogGroupsPages", 0)
+	accountClient.AssertNumberOfCalls(t, "DescribeLogGroupsPages", 1)
+	stream := NewStream("stream", group, nil, nil, params)
+	assert.Equal(t, "123456789012:/aws/lambda/function/stream", generateKey(stream))
+	assert.Equal(t, "123456789012:us-east-1:/aws/lambda/function", groupKey("123456789012", "us-east-1", "/aws/lambda/function"))
+	cancel()
+	manager.running.Wait()
+}
@@ -0,0 +1,163 @@
+package cwl
+
+import (
+	"bytes"
+	"strings"
+	"time"
+)
+
+// A multiline event of the "key" type, buffered by its correlation key
+type keyedBuffer struct {
+	key       string
+	buffer    bytes.Buffer
+	start     int64 // the timestamp of the first line
+	lines     int   // the number of lines, including the dropped ones
+	truncated bool  // true if lines were dropped
+}
+
+// Appends the nth line of an event to its buffer; the lines beyond
+// max_lines and the bytes beyond max_bytes are dropped. Returns false if
+// the line was (partly) dropped.
+func (multiline *Multiline) append(buffer *bytes.Buffer, n int, message string) bool {
+	if multiline.MaxLines > 0 && n > multiline.MaxLines {
+		return false
+	}
+	if max := multiline.MaxBytes; max > 0 && buffer.Len()+len(message) > max {
+		buffer.WriteString(truncateUTF8(message, max-buffer.Len()))
+		return false
+	}
+	buffer.WriteString(message)
+	return true
+}
+
+func (buffer *keyedBuffer) add(multiline *Multiline, message string) {
+	buffer.lines++
+	if !multiline.append(&buffer.buffer, buffer.lines, message) {
+		buffer.truncated = true
+	}
+}
+
+// Returns the correlation key of a line, i.e. the first non-empty
+// submatch of the key pattern, or "" if the line has no key
+func (stream *Stream) multilineKey(message string) string {
+	submatches := stream.keyRegex.FindStringSubmatch(message)
+	if submatches == nil {
+		return ""
+	}
+	for _, submatch := range submatches[1:] {
+		if submatch != "" {
+			return submatch
+		}
+	}
+	return ""
+}
+
+// Returns the buffered event of the key, or nil if there is none
+func (stream *Stream) keyedBuffer(key string) *keyedBuffer {
+	for _, buffer := range stream.keyed {
+		if buffer.key == key {
+			return buffer
+		}
+	}
+	return nil
+}
+
+// Groups the lines by their correlation key, so that the lines of
+// interleaved events (e.g. concurrent lambda invocations) are not mixed.
+// Lines without a key belong to the event of the previous line if it is
+// still buffered, otherwise they are events on their own. Lines that match
+// the flush pattern end the event of their key.
+func (stream *Stream) digestKey(event *Event, message string) {
+	var buffer *keyedBuffer
+	if key := stream.multilineKey(message); key != "" {
+		buffer = stream.keyedBuffer(key)
+		if buffer == nil {
+			buffer = &keyedBuffer{key: key, start: event.Timestamp}
+			stream.keyed = append(stream.keyed, buffer)
+		}
+		stream.lastKey = key
+	} else if stream.lastKey != "" {
+		buffer = stream.keyedBuffer(stream.lastKey)
+	}
+	if buffer == nil {
+		stream.buffered(message, event.Timestamp)
+		stream.publish(event)
+		return
+	}
+	buffer.add(stream.multiline, message)
+	if stream.flushRegex != nil && stream.flushRegex.MatchString(message) {
+		stream.publishKeyed(buffer, event.Timestamp, false)
+		stream.removeKeyed(buffer)
+	}
+}
+
+// Publishes a buffered event of the "key" type
+func (stream *Stream) publishKeyed(buffer *keyedBuffer, timestamp int64, partial bool) {
+	stream.send(&Event{
+		Stream:    stream,
+		Message:   buffer.buffer.String(),
+		Timestamp: timestamp,
+		Partial:   partial,
+		Truncated: buffer.truncated,
+	})
+}
+
+func (stream *Stream) removeKeyed(buffer *keyedBuffer) {
+	for i := range stream.keyed {
+		if stream.keyed[i] == buffer {
+			stream.keyed = append(stream.keyed[:i], stream.keyed[i+1:]...)
+			return
+		}
+	}
+}
+
+// Publishes the buffered events of the "key" type as incomplete events,
+// which is done once no more lines can complete them
+func (stream *Stream) flushKeyed() {
+	for _, buffer := range stream.keyed {
+		stream.publishKeyed(buffer, stream.LastEventTimestamp, true)
+	}
+	stream.keyed = nil
+}
+
+// Returns true if the stream buffers any multiline content
+func (stream *Stream) hasBuffer() bool {
+	return stream.buffer.Len() > 0 || len(stream.keyed) > 0
+}
+
+// Returns the buffered events of the "key" type to be stored in the
+// registry, oldest first
+func (stream *Stream) keyedCheckpoint() []KeyedBuffer {
+	if len(stream.keyed) == 0 {
+		return nil
+	}
+	buffers := make([]KeyedBuffer, 0, len(stream.keyed))
+	for _, buffer := range stream.keyed {
+		buffers = append(buffers, KeyedBuffer{
+			Key:       buffer.key,
+			Buffer:    buffer.buffer.String(),
+			Timestamp: buffer.start,
+		})
+	}
+	return buffers
+}
+
+// Restores the buffered events of the "key" type from the registry
+func (stream *Stream) restoreKeyed(buffers []KeyedBuffer) {
+	stream.keyed = nil
+	for _, item := range buffers {
+		buffer := &keyedBuffer{key: item.Key, start: item.Timestamp}
+		if buffer.start == 0 {
+			buffer.start = time.Now().UnixNano() / 1e6
+		}
+		buffer.buffer.WriteString(item.Buffer)
+		buffer.lines = countLines(item.Buffer)
+		stream.keyed = append(stream.keyed, buffer)
+	}
+}
+
+// Returns the number of lines of a restored buffer; the lines are not
+// stored, but they are terminated by newlines
+func countLines(buffer string) int {
+	return strings.Count(buffer, "\n")
+}
@@ -3,7 +3,9 @@ package cwl
 import (
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -35,7 +37,7 @@ func Test_Multiline_MatchBefore_NegateTrue(t *testing.T) {
 	// stub the registry functions
 	registry := &MockRegistry{}
 	registry.On("ReadStreamInfo", mock.AnythingOfType("*cwl.Stream")).Return(nil)
-	registry.On("WriteStreamInfo", mock.AnythingOfType("*cwl.Stream")).Return(nil)
+	registry.On("WriteStreamInfo", mock.AnythingOfType("*cwl.Stream"), mock.AnythingOfType("*cwl.RegistryItem")).Return(nil)
 	client := &MockCWLClient{}
 	// stub the log events
 	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).Return(
@@ -90,7 +92,7 @@ func Test_Multiline_MatchAfter_NegateTrue(t *testing.T) {
 	// stub the registry functions
 	registry := &MockRegistry{}
 	registry.On("ReadStreamInfo", mock.AnythingOfType("*cwl.Stream")).Return(nil)
-	registry.On("WriteStreamInfo", mock.AnythingOfType("*cwl.Stream")).Return(nil)
+	registry.On("WriteStreamInfo", mock.AnythingOfType("*cwl.Stream"), mock.AnythingOfType("*cwl.RegistryItem")).Return(nil)
 	client := &MockCWLClient{}
 	// stub the log events
 	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).Return(
@@ -143,7 +145,7 @@ func Test_Multiline_MatchBefore_NegateFalse(t *testing.T) {
 	// stub the registry functions
 	registry := &MockRegistry{}
 	registry.On("ReadStreamInfo", mock.AnythingOfType("*cwl.Stream")).Return(nil)
-	registry.On("WriteStreamInfo", mock.AnythingOfType("*cwl.Stream")).Return(nil)
+	registry.On("WriteStreamInfo", mock.AnythingOfType("*cwl.Stream"), mock.AnythingOfType("*cwl.RegistryItem")).Return(nil)
 	client := &MockCWLClient{}
 	// stub the log events
 	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).Return(
@@ -198,7 +200,7 @@ func Test_Multiline_MatchAfter_NegateFalse(t *testing.T) {
 	// stub the registry functions
 	registry := &MockRegistry{}
 	registry.On("ReadStreamInfo", mock.AnythingOfType("*cwl.Stream")).Return(nil)
-	registry.On("WriteStreamInfo", mock.AnythingOfType("*cwl.Stream")).Return(nil)
+	registry.On("WriteStreamInfo", mock.AnythingOfType("*cwl.Stream"), mock.AnythingOfType("*cwl.RegistryItem")).Return(nil)
 	client := &MockCWLClient{}
 	// stub the log events
 	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).Return(
@@ -236,3 +238,437 @@ func createExpectedMessage(events []*cloudwatchlogs.OutputLogEvent) string {
 	}, "")
 
 }
+
+func Test_Multiline_Timeout_PublishesThePartialEvent_OfLaterLines(t *testing.T) {
+	multiline := &Multiline{
+		Pattern: "^REPORT RequestId.+",
+		Negate:  true,
+		Match:   "before",
+		Timeout: time.Minute,
+	}
+	group := &Group{Name: "group", Prospector: &Prospector{Multiline: multiline}}
+	// the first invocation crashed before its REPORT line
+	events := []*cloudwatchlogs.OutputLogEvent{
+		CreateOutputLogEventWithTimestamp("START RequestId: aaa-bbb Version: $LATEST\n", TimeBeforeNowInMilliseconds(10*time.Minute)),
+		CreateOutputLogEventWithTimestamp("2017-06-12T10:09:46.650Z aaa-bbb [Info] Hello\n", TimeBeforeNowInMilliseconds(10*time.Minute)),
+		CreateOutputLogEventWithTimestamp("START RequestId: aaa-ccc Version: $LATEST\n", TimeBeforeNowInMilliseconds(5*time.Minute)),
+		CreateOutputLogEventWithTimestamp("REPORT RequestId: aaa-ccc Duration: 1.27 ms\n", TimeBeforeNowInMilliseconds(5*time.Minute)),
+	}
+	client := &MockCWLClient{}
+	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).Return(
+		&cloudwatchlogs.GetLogEventsOutput{Events: events}, nil)
+	publisher, published := CreateCollectingPublisher(false)
+	params := &Params{
+		Config:    &Config{},
+		Registry:  NewDummyRegistry(),
+		AWSClient: client,
+		Publisher: publisher,
+	}
+	stream := NewStream("TestStream", group, group.Prospector.Multiline, make(chan bool), params)
+	// fire!
+	stream.Next()
+	// assert
+	assert.Equal(t, 2, len(*published))
+	assert.Equal(t, *events[0].Message+*events[1].Message, (*published)[0].Message)
+	assert.True(t, (*published)[0].Partial)
+	assert.Equal(t, *events[2].Message+*events[3].Message, (*published)[1].Message)
+	assert.False(t, (*published)[1].Partial)
+}
+
+func Test_Multiline_Timeout_PublishesThePartialEvent_OnceCaughtUp(t *testing.T) {
+	multiline := &Multiline{
+		Pattern: "^REPORT RequestId.+",
+		Negate:  true,
+		Match:   "before",
+		Timeout: time.Minute,
+	}
+	group := &Group{Name: "group", Prospector: &Prospector{Multiline: multiline}}
+	events := []*cloudwatchlogs.OutputLogEvent{
+		CreateOutputLogEventWithTimestamp("START RequestId: aaa-bbb Version: $LATEST\n", TimeBeforeNowInMilliseconds(2*time.Minute)),
+		CreateOutputLogEventWithTimestamp("2017-06-12T10:09:46.650Z aaa-bbb [Info] Hello\n", TimeBeforeNowInMilliseconds(2*time.Minute)),
+	}
+	client := &MockCWLClient{}
+	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).Return(
+		&cloudwatchlogs.GetLogEventsOutput{Events: events, NextForwardToken: aws.String("token")}, nil).Once()
+	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).Return(
+		&cloudwatchlogs.GetLogEventsOutput{NextForwardToken: aws.String("token")}, nil)
+	publisher, published := CreateCollectingPublisher(true)
+	registry := NewDummyRegistry()
+	params := &Params{
+		Config:    &Config{ReportFrequency: time.Minute, StreamEventHorizon: time.Hour},
+		Registry:  registry,
+		AWSClient: client,
+		Publisher: publisher,
+	}
+	stream := NewStream("TestStream", group, group.Prospector.Multiline, make(chan bool), params)
+	// the lines are buffered until the stream has caught up
+	stream.poll()
+	assert.Equal(t, 0, len(*published))
+	restored := NewStream("TestStream", group, nil, nil, params)
+	registry.ReadStreamInfo(restored)
+	assert.Equal(t, stream.bufferStart, restored.bufferStart)
+	stream.poll()
+	// assert
+	assert.Equal(t, 1, len(*published))
+	assert.Equal(t, *events[0].Message+*events[1].Message, (*published)[0].Message)
+	assert.True(t, (*published)[0].Partial)
+	restored = NewStream("TestStream", group, nil, nil, params)
+	registry.ReadStreamInfo(restored)
+	assert.Equal(t, "", restored.buffer.String())
+}
+
+func Test_Multiline_MaxLinesAndMaxBytes_TruncateTheEvent(t *testing.T) {
+	testCases := []struct {
+		maxLines  int
+		maxBytes  int
+		message   string
+		truncated bool
+	}{
+		{0, 0, "START\nat a()\nat b()\nat c()\nREPORT\n", false},
+		{5, 0, "START\nat a()\nat b()\nat c()\nREPORT\n", false},
+		{3, 0, "START\nat a()\nat b()\n", true},
+		{0, 16, "START\nat a()\nat ", true},
+		{2, 16, "START\nat a()\n", true},
+	}
+
+	for _, testCase := range testCases {
+		multiline := &Multiline{
+			Pattern:  "^REPORT",
+			Negate:   true,
+			Match:    "before",
+			MaxLines: testCase.maxLines,
+			MaxBytes: testCase.maxBytes,
+		}
+		group := &Group{Name: "group", Prospector: &Prospector{Multiline: multiline}}
+		publisher, published := CreateCollectingPublisher(false)
+		params := &Params{Config: &Config{}, Publisher: publisher}
+		stream := NewStream("TestStream", group, group.Prospector.Multiline, nil, params)
+		for _, line := range []string{"START\n", "at a()\n", "at b()\n", "at c()\n", "REPORT\n"} {
+			stream.digest(CreateOutputLogEvent(line))
+		}
+		assert.Equal(t, 1, len(*published), testCase)
+		assert.Equal(t, testCase.message, (*published)[0].Message, testCase)
+		assert.Equal(t, testCase.truncated, (*published)[0].Truncated, testCase)
+		// the next event is not truncated
+		assert.False(t, stream.truncated, testCase)
+		assert.Equal(t, 0, stream.bufferLines, testCase)
+	}
+}
+
+func Test_Multiline_RestoredBuffer_KeepsItsLimits(t *testing.T) {
+	multiline := &Multiline{Pattern: "^REPORT", Negate: true, Match: "before", MaxLines: 2}
+	group := &Group{Name: "group", Prospector: &Prospector{Multiline: multiline}}
+	params := &Params{Config: &Config{}}
+	stream := NewStream("TestStream", group, group.Prospector.Multiline, nil, params)
+	stream.restoreBuffer("START\nat a()\n", 0)
+	assert.Equal(t, 2, stream.bufferLines)
+	stream.digest(CreateOutputLogEvent("at b()\n"))
+	assert.Equal(t, "START\nat a()\n", stream.buffer.String())
+	assert.True(t, stream.truncated)
+}
+
+func Test_Multiline_FlushPattern_EndsTheEvent(t *testing.T) {
+	// setup multiline settings
+	multiline := &Multiline{
+		Pattern:      "^BEGIN",
+		Negate:       true,
+		Match:        "after",
+		FlushPattern: "^END",
+	}
+	group := &Group{
+		Name: "group",
+		Prospector: &Prospector{
+			Multiline: multiline,
+		},
+	}
+
+	// create the events that we expect
+	events := []*cloudwatchlogs.OutputLogEvent{
+		CreateOutputLogEvent("BEGIN transaction\n"),
+		CreateOutputLogEvent("UPDATE accounts\n"),
+		CreateOutputLogEvent("END transaction\n"),
+		CreateOutputLogEvent("some other line\n"),
+	}
+	// stub the registry functions
+	registry := &MockRegistry{}
+	registry.On("ReadStreamInfo", mock.AnythingOfType("*cwl.Stream")).Return(nil)
+	registry.On("WriteStreamInfo", mock.AnythingOfType("*cwl.Stream"), mock.AnythingOfType("*cwl.RegistryItem")).Return(nil)
+	client := &MockCWLClient{}
+	// stub the log events
+	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).Return(
+		&cloudwatchlogs.GetLogEventsOutput{
+			Events: events,
+		}, nil)
+	publisher := &MockPublisher{}
+	// stub the publisher
+	publisher.On("Publish", mock.AnythingOfType("*cwl.Event")).Return().Run(
+		func(args mock.Arguments) {
+			event := args.Get(0).(*Event)
+			expectedMessage := createExpectedMessage(events)
+			assert.Equal(t, expectedMessage, event.Message)
+		})
+
+	params := &Params{
+		Config:    &Config{},
+		Registry:  registry,
+		AWSClient: client,
+		Publisher: publisher,
+	}
+	stream := NewStream("TestStream", group, group.Prospector.Multiline, make(chan bool), params)
+
+	// fire!
+	stream.Next()
+
+	// check remaining buffer
+	publisher.AssertNumberOfCalls(t, "Publish", 1)
+	assert.Equal(t, *events[3].Message, stream.buffer.String())
+}
+
+func Test_Multiline_CountLines_GroupsEveryNLines(t *testing.T) {
+	// setup multiline settings
+	multiline := &Multiline{
+		Type:       "count",
+		CountLines: 3,
+	}
+	group := &Group{
+		Name: "group",
+		Prospector: &Prospector{
+			Multiline: multiline,
+		},
+	}
+
+	// create the events that we expect
+	events := []*cloudwatchlogs.OutputLogEvent{
+		CreateOutputLogEvent("line 1\n"),
+		CreateOutputLogEvent("line 2\n"),
+		CreateOutputLogEvent("line 3\n"),
+		CreateOutputLogEvent("line 4\n"),
+	}
+	// stub the registry functions
+	registry := &MockRegistry{}
+	registry.On("ReadStreamInfo", mock.AnythingOfType("*cwl.Stream")).Return(nil)
+	registry.On("WriteStreamInfo", mock.AnythingOfType("*cwl.Stream"), mock.AnythingOfType("*cwl.RegistryItem")).Return(nil)
+	client := &MockCWLClient{}
+	// stub the log events
+	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).Return(
+		&cloudwatchlogs.GetLogEventsOutput{
+			Events: events,
+		}, nil)
+	publisher := &MockPublisher{}
+	// stub the publisher
+	publisher.On("Publish", mock.AnythingOfType("*cwl.Event")).Return().Run(
+		func(args mock.Arguments) {
+			event := args.Get(0).(*Event)
+			expectedMessage := createExpectedMessage(events)
+			assert.Equal(t, expectedMessage, event.Message)
+		})
+
+	params := &Params{
+		Config:    &Config{},
+		Registry:  registry,
+		AWSClient: client,
+		Publisher: publisher,
+	}
+	stream := NewStream("TestStream", group, group.Prospector.Multiline, make(chan bool), params)
+
+	// fire!
+	stream.Next()
+
+	// check remaining buffer
+	publisher.AssertNumberOfCalls(t, "Publish", 1)
+	assert.Equal(t, *events[3].Message, stream.buffer.String())
+}
+
+func Test_Multiline_WhilePattern_GroupsConsecutiveMatchingLines(t *testing.T) {
+	// setup multiline settings
+	multiline := &Multiline{
+		Type:    "while_pattern",
+		Pattern: `^\s`,
+	}
+	group := &Group{
+		Name: "group",
+		Prospector: &Prospector{
+			Multiline: multiline,
+		},
+	}
+
+	// create the events that we expect
+	events := []*cloudwatchlogs.OutputLogEvent{
+		CreateOutputLogEvent("  at com.example.A\n"),
+		CreateOutputLogEvent("  at com.example.B\n"),
+		CreateOutputLogEvent("  at com.example.C\n"),
+		CreateOutputLogEvent("Exception in thread main\n"),
+		CreateOutputLogEvent("  at com.example.D\n"),
+	}
+	// stub the registry functions
+	registry := &MockRegistry{}
+	registry.On("ReadStreamInfo", mock.AnythingOfType("*cwl.Stream")).Return(nil)
+	registry.On("WriteStreamInfo", mock.AnythingOfType("*cwl.Stream"), mock.AnythingOfType("*cwl.RegistryItem")).Return(nil)
+	client := &MockCWLClient{}
+	// stub the log events
+	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).Return(
+		&cloudwatchlogs.GetLogEventsOutput{
+			Events: events,
+		}, nil)
+	messages := []string{}
+	publisher := &MockPublisher{}
+	// stub the publisher
+	publisher.On("Publish", mock.AnythingOfType("*cwl.Event")).Return().Run(
+		func(args mock.Arguments) {
+			event := args.Get(0).(*Event)
+			messages = append(messages, event.Message)
+		})
+
+	params := &Params{
+		Config:    &Config{},
+		Registry:  registry,
+		AWSClient: client,
+		Publisher: publisher,
+	}
+	stream := NewStream("TestStream", group, group.Prospector.Multiline, make(chan bool), params)
+
+	// fire!
+	stream.Next()
+
+	// the line that does not match is an event on its own
+	assert.Equal(t, []string{createExpectedMessage(events), *events[3].Message}, messages)
+	// check remaining buffer
+	assert.Equal(t, *events[4].Message, stream.buffer.String())
+}
+
+// the lines of two concurrent lambda invocations
+var interleavedEvents = []*cloudwatchlogs.OutputLogEvent{
+	CreateOutputLogEvent("START RequestId: aaa-bbb Version: $LATEST\n"),
+	CreateOutputLogEvent("START RequestId: aaa-ccc Version: $LATEST\n"),
+	CreateOutputLogEvent("2017-06-12T10:09:46.650Z\taaa-bbb\tINFO\tHello\n"),
+	CreateOutputLogEvent("2017-06-12T10:09:46.651Z\taaa-ccc\tERROR\tFailed\n"),
+	CreateOutputLogEvent("    at handler (index.js:1:1)\n"),
+	CreateOutputLogEvent("END RequestId: aaa-bbb\n"),
+	CreateOutputLogEvent("REPORT RequestId: aaa-bbb\tDuration: 1.27 ms\n"),
+	CreateOutputLogEvent("END RequestId: aaa-ccc\n"),
+	CreateOutputLogEvent("REPORT RequestId: aaa-ccc\tDuration: 2.54 ms\n"),
+}
+
+func Test_Multiline_Key_GroupsInterleavedLines(t *testing.T) {
+	// setup multiline settings
+	multiline := &Multiline{
+		Type:         "key",
+		KeyPattern:   `RequestId: (\S+)|^\S+\t(\S+)\t`,
+		FlushPattern: "^REPORT",
+	}
+	group := &Group{
+		Name: "group",
+		Prospector: &Prospector{
+			Multiline: multiline,
+		},
+	}
+	events := interleavedEvents
+	// stub the registry functions
+	registry := &MockRegistry{}
+	registry.On("ReadStreamInfo", mock.AnythingOfType("*cwl.Stream")).Return(nil)
+	registry.On("WriteStreamInfo", mock.AnythingOfType("*cwl.Stream"), mock.AnythingOfType("*cwl.RegistryItem")).Return(nil)
+	client := &MockCWLClient{}
+	// stub the log events
+	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).Return(
+		&cloudwatchlogs.GetLogEventsOutput{
+			Events: events,
+		}, nil)
+	messages := []string{}
+	publisher := &MockPublisher{}
+	// stub the publisher
+	publisher.On("Publish", mock.AnythingOfType("*cwl.Event")).Return().Run(
+		func(args mock.Arguments) {
+			event := args.Get(0).(*Event)
+			messages = append(messages, event.Message)
+		})
+
+	params := &Params{
+		Config:    &Config{},
+		Registry:  registry,
+		AWSClient: client,
+		Publisher: publisher,
+	}
+	stream := NewStream("TestStream", group, group.Prospector.Multiline, make(chan bool), params)
+
+	// fire!
+	stream.Next()
+
+	// the line without a key belongs to the invocation of the previous line
+	assert.Equal(t, []string{
+		*events[0].Message + *events[2].Message + *events[5].Message + *events[6].Message,
+		*events[1].Message + *events[3].Message + *events[4].Message + *events[7].Message + *events[8].Message,
+	}, messages)
+	assert.False(t, stream.hasBuffer())
+}
+
+func Test_Multiline_Key_PersistsTheBuffersInTheRegistry(t *testing.T) {
+	multiline := &Multiline{
+		Type:         "key",
+		KeyPattern:   `RequestId: (\S+)|^\S+\t(\S+)\t`,
+		FlushPattern: "^REPORT",
+	}
+	group := &Group{Name: "group", Prospector: &Prospector{Multiline: multiline}}
+	events := interleavedEvents
+	client := &MockCWLClient{}
+	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).Return(
+		&cloudwatchlogs.GetLogEventsOutput{Events: events[:6], NextForwardToken: aws.String("token")}, nil).Once()
+	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).Return(
+		&cloudwatchlogs.GetLogEventsOutput{Events: events[6:], NextForwardToken: aws.String("next")}, nil)
+	messages := []string{}
+	publisher := &MockPublisher{}
+	publisher.On("Publish", mock.AnythingOfType("*cwl.Event")).Return().Run(
+		func(args mock.Arguments) {
+			event := args.Get(0).(*Event)
+			messages = append(messages, event.Message)
+			AckEvents(1, []interface{}{event.batch})
+		})
+	registry := NewDummyRegistry()
+	params := &Params{
+		Config:    &Config{ReportFrequency: time.Minute, StreamEventHorizon: time.Hour},
+		Registry:  registry,
+		AWSClient: client,
+		Publisher: publisher,
+	}
+	stream := NewStream("TestStream", group, group.Prospector.Multiline, nil, params)
+	stream.Next()
+	// the invocations are kept in the registry on shutdown
+	stream.drain()
+	assert.Equal(t, 0, len(messages))
+
+	// restart
+	restored := NewStream("TestStream", group, group.Prospector.Multiline, nil, params)
+	registry.ReadStreamInfo(restored)
+	assert.Equal(t, 2, len(restored.keyed))
+	restored.Next()
+	// assert
+	assert.Equal(t, []string{
+		*events[0].Message + *events[2].Message + *events[5].Message + *events[6].Message,
+		*events[1].Message + *events[3].Message + *events[4].Message + *events[7].Message + *events[8].Message,
+	}, messages)
+	restored = NewStream("TestStream", group, group.Prospector.Multiline, nil, params)
+	registry.ReadStreamInfo(restored)
+	assert.Equal(t, 0, len(restored.keyed))
+}
+
+func Test_Multiline_Key_PublishesThePartialEvents_OnTimeout(t *testing.T) {
+	multiline := &Multiline{
+		Type:         "key",
+		KeyPattern:   `RequestId: (\S+)`,
+		FlushPattern: "^REPORT",
+		Timeout:      time.Minute,
+	}
+	group := &Group{Name: "group", Prospector: &Prospector{Multiline: multiline}}
+	publisher, published := CreateCollectingPublisher(false)
+	params := &Params{Config: &Config{}, Publisher: publisher}
+	stream := NewStream("TestStream", group, group.Prospector.Multiline, nil, params)
+	stream.digest(CreateOutputLogEventWithTimestamp("START RequestId: aaa-bbb\n", TimeBeforeNowInMilliseconds(10*time.Minute)))
+	stream.digest(CreateOutputLogEventWithTimestamp("START RequestId: aaa-ccc\n", TimeBeforeNowInMilliseconds(30*time.Second)))
+	// fire!
+	stream.flushTimedOut(TimeBeforeNowInMilliseconds(0))
+	// assert
+	assert.Equal(t, 1, len(*published))
+	assert.Equal(t, "START RequestId: aaa-bbb\n", (*published)[0].Message)
+	assert.True(t, (*published)[0].Partial)
+	assert.Equal(t, 1, len(stream.keyed))
+	assert.Equal(t, "aaa-ccc", stream.keyed[0].key)
+}
@@ -7,6 +7,26 @@ import (
 type Params struct {
 	Config    *Config
 	Registry  Registry
-	AWSClient cloudwatchlogsiface.CloudWatchLogsAPI
+	AWSClient cloudwatchlogsiface.CloudWatchLogsAPI // the client of aws_region
+	// the clients of the other accounts and regions of the prospectors, by
+	// their clientKey
+	Clients   map[string]cloudwatchlogsiface.CloudWatchLogsAPI
+	AccountId string // the id of the beat's own account, if known
 	Publisher EventPublisher
+	// polls the streams; if nil, every stream is polled by its own goroutine
+	Scheduler *Scheduler
+}
+
+// Returns the client of the account and region; the empty account is the
+// beat's own account and the empty region is aws_region
+func (params *Params) Client(account string, region string) cloudwatchlogsiface.CloudWatchLogsAPI {
+	if client, ok := params.Clients[ClientKey(account, region)]; ok {
+		return client
+	}
+	return params.AWSClient
+}
+
+// Returns the key of the client of an account and region
+func ClientKey(account string, region string) string {
+	return account + "/" + region
 }
@@ -0,0 +1,369 @@
+package cwl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// FilterPattern evaluates a CloudWatch Logs filter pattern locally, for the
+// streams whose events are not fetched using FilterLogEvents. Term patterns
+// (e.g. `ERROR -Exiting`, `?ERROR ?WARN`, `"Connection refused"`) and JSON
+// patterns (e.g. `{ ($.level = "ERROR") || ($.latency > 500) }`) are
+// supported; space-delimited patterns (e.g. `[ip, user, ...]`) are not.
+type FilterPattern struct {
+	required []string // all must be contained in the message
+	optional []string // at least one must be contained (if any)
+	excluded []string // none must be contained
+	json     jsonExpression
+}
+
+func CompileFilterPattern(pattern string) (*FilterPattern, error) {
+	pattern = strings.TrimSpace(pattern)
+	switch {
+	case strings.HasPrefix(pattern, "{"):
+		if !strings.HasSuffix(pattern, "}") {
+			return nil, errors.New("filter pattern: unterminated json pattern: " + pattern)
+		}
+		expression, err := parseJSONPattern(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, err
+		}
+		return &FilterPattern{json: expression}, nil
+	case strings.HasPrefix(pattern, "["):
+		return nil, errors.New("filter pattern: space-delimited patterns are only supported in group mode: " + pattern)
+	}
+	terms, err := splitTerms(pattern)
+	if err != nil {
+		return nil, err
+	}
+	filter := &FilterPattern{}
+	for _, term := range terms {
+		switch {
+		case strings.HasPrefix(term, "?") && len(term) > 1:
+			filter.optional = append(filter.optional, unquote(term[1:]))
+		case strings.HasPrefix(term, "-") && len(term) > 1:
+			filter.excluded = append(filter.excluded, unquote(term[1:]))
+		default:
+			filter.required = append(filter.required, unquote(term))
+		}
+	}
+	return filter, nil
+}
+
+// Returns true if the message matches the pattern
+func (filter *FilterPattern) Match(message string) bool {
+	if filter.json != nil {
+		var document interface{}
+		if err := json.Unmarshal([]byte(message), &document); err != nil {
+			return false
+		}
+		return filter.json.eval(document)
+	}
+	for _, term := range filter.excluded {
+		if strings.Contains(message, term) {
+			return false
+		}
+	}
+	for _, term := range filter.required {
+		if !strings.Contains(message, term) {
+			return false
+		}
+	}
+	for _, term := range filter.optional {
+		if strings.Contains(message, term) {
+			return true
+		}
+	}
+	return len(filter.optional) == 0
+}
+
+// Splits a term pattern on whitespace, keeping double-quoted terms intact
+func splitTerms(pattern string) ([]string, error) {
+	var terms []string
+	var term strings.Builder
+	quoted := false
+	for _, r := range pattern {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			term.WriteRune(r)
+		case unicode.IsSpace(r) && !quoted:
+			if term.Len() > 0 {
+				terms = append(terms, term.String())
+				term.Reset()
+			}
+		default:
+			term.WriteRune(r)
+		}
+	}
+	if quoted {
+		return nil, errors.New("filter pattern: unterminated quote: " + pattern)
+	}
+	if term.Len() > 0 {
+		terms = append(terms, term.String())
+	}
+	return terms, nil
+}
+
+func unquote(term string) string {
+	if len(term) >= 2 && strings.HasPrefix(term, `"`) && strings.HasSuffix(term, `"`) {
+		return term[1 : len(term)-1]
+	}
+	return term
+}
+
+// === JSON patterns ===
+
+type jsonExpression interface {
+	eval(document interface{}) bool
+}
+
+type jsonAnd struct{ left, right jsonExpression }
+type jsonOr struct{ left, right jsonExpression }
+
+func (e jsonAnd) eval(document interface{}) bool {
+	return e.left.eval(document) && e.right.eval(document)
+}
+
+func (e jsonOr) eval(document interface{}) bool {
+	return e.left.eval(document) || e.right.eval(document)
+}
+
+// a comparison of the value found under selector
+type jsonComparison struct {
+	selector []interface{} // field names (string) and array indexes (int)
+	operator string        // =, !=, <, <=, >, >=, IS, EXISTS, NOT EXISTS
+	number   *float64      // the value to compare with, if numeric
+	text     *regexp.Regexp
+	keyword  string // NULL, TRUE or FALSE for the IS operator
+}
+
+func (e jsonComparison) eval(document interface{}) bool {
+	value, exists := selectJSON(document, e.selector)
+	switch e.operator {
+	case "EXISTS":
+		return exists
+	case "NOT EXISTS":
+		return !exists
+	}
+	if !exists {
+		return false
+	}
+	if e.operator == "IS" {
+		switch e.keyword {
+		case "NULL":
+			return value == nil
+		case "TRUE":
+			return value == true
+		default:
+			return value == false
+		}
+	}
+	if e.number != nil {
+		number, ok := value.(float64)
+		if !ok {
+			return false
+		}
+		switch e.operator {
+		case "=":
+			return number == *e.number
+		case "!=":
+			return number != *e.number
+		case "<":
+			return number < *e.number
+		case "<=":
+			return number <= *e.number
+		case ">":
+			return number > *e.number
+		default:
+			return number >= *e.number
+		}
+	}
+	text, ok := value.(string)
+	if !ok {
+		return false
+	}
+	return e.text.MatchString(text) == (e.operator == "=")
+}
+
+func selectJSON(document interface{}, selector []interface{}) (interface{}, bool) {
+	value := document
+	for _, step := range selector {
+		switch step := step.(type) {
+		case string:
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if value, ok = object[step]; !ok {
+				return nil, false
+			}
+		case int:
+			array, ok := value.([]interface{})
+			if !ok || step >= len(array) {
+				return nil, false
+			}
+			value = array[step]
+		}
+	}
+	return value, true
+}
+
+var jsonTokenRegex = regexp.MustCompile(`\s*("(?:[^"\\]|\\.)*"|&&|\|\||!=|<=|>=|[=<>()]|[^\s=<>()!&|"]+)`)
+
+type jsonParser struct {
+	tokens []string
+	pos    int
+}
+
+func parseJSONPattern(pattern string) (jsonExpression, error) {
+	parser := &jsonParser{}
+	rest := strings.TrimSpace(pattern)
+	for len(rest) > 0 {
+		match := jsonTokenRegex.FindStringSubmatchIndex(rest)
+		if match == nil || match[0] != 0 {
+			return nil, errors.New("filter pattern: invalid json pattern: " + pattern)
+		}
+		parser.tokens = append(parser.tokens, rest[match[2]:match[3]])
+		rest = strings.TrimSpace(rest[match[1]:])
+	}
+	expression, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.pos < len(parser.tokens) {
+		return nil, fmt.Errorf("filter pattern: unexpected %q in json pattern", parser.tokens[parser.pos])
+	}
+	return expression, nil
+}
+
+func (parser *jsonParser) peek() string {
+	if parser.pos < len(parser.tokens) {
+		return parser.tokens[parser.pos]
+	}
+	return ""
+}
+
+func (parser *jsonParser) next() string {
+	token := parser.peek()
+	parser.pos++
+	return token
+}
+
+func (parser *jsonParser) parseOr() (jsonExpression, error) {
+	left, err := parser.parseAnd()
+	for err == nil && parser.peek() == "||" {
+		parser.next()
+		var right jsonExpression
+		right, err = parser.parseAnd()
+		left = jsonOr{left, right}
+	}
+	return left, err
+}
+
+func (parser *jsonParser) parseAnd() (jsonExpression, error) {
+	left, err := parser.parseUnary()
+	for err == nil && parser.peek() == "&&" {
+		parser.next()
+		var right jsonExpression
+		right, err = parser.parseUnary()
+		left = jsonAnd{left, right}
+	}
+	return left, err
+}
+
+func (parser *jsonParser) parseUnary() (jsonExpression, error) {
+	if parser.peek() == "(" {
+		parser.next()
+		expression, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if parser.next() != ")" {
+			return nil, errors.New("filter pattern: missing ) in json pattern")
+		}
+		return expression, nil
+	}
+	return parser.parseComparison()
+}
+
+func (parser *jsonParser) parseComparison() (jsonExpression, error) {
+	selector, err := parseSelector(parser.next())
+	if err != nil {
+		return nil, err
+	}
+	comparison := jsonComparison{selector: selector, operator: parser.next()}
+	switch comparison.operator {
+	case "EXISTS":
+		return comparison, nil
+	case "NOT":
+		if parser.next() != "EXISTS" {
+			return nil, errors.New("filter pattern: expected EXISTS after NOT in json pattern")
+		}
+		comparison.operator = "NOT EXISTS"
+		return comparison, nil
+	case "IS":
+		comparison.keyword = parser.next()
+		switch comparison.keyword {
+		case "NULL", "TRUE", "FALSE":
+			return comparison, nil
+		}
+		return nil, errors.New("filter pattern: expected NULL, TRUE or FALSE after IS in json pattern")
+	case "=", "!=", "<", "<=", ">", ">=":
+	default:
+		return nil, fmt.Errorf("filter pattern: invalid operator %q in json pattern", comparison.operator)
+	}
+	value := parser.next()
+	if value == "" {
+		return nil, errors.New("filter pattern: missing value in json pattern")
+	}
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		comparison.number = &number
+		return comparison, nil
+	}
+	if comparison.operator != "=" && comparison.operator != "!=" {
+		return nil, fmt.Errorf("filter pattern: %s requires a numeric value in json pattern", comparison.operator)
+	}
+	if strings.HasPrefix(value, `"`) {
+		if value, err = strconv.Unquote(value); err != nil {
+			return nil, err
+		}
+	}
+	// strings may contain * wildcards
+	parts := strings.Split(value, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	comparison.text = regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+	return comparison, nil
+}
+
+var selectorStepRegex = regexp.MustCompile(`^(?:\.([^.\[\]]+)|\[(\d+)\])`)
+
+// Parses a selector such as $.user.roles[0] into its steps
+func parseSelector(selector string) ([]interface{}, error) {
+	if !strings.HasPrefix(selector, "$") {
+		return nil, fmt.Errorf("filter pattern: invalid selector %q in json pattern", selector)
+	}
+	steps := []interface{}{}
+	rest := selector[1:]
+	for len(rest) > 0 {
+		match := selectorStepRegex.FindStringSubmatch(rest)
+		if match == nil {
+			return nil, fmt.Errorf("filter pattern: invalid selector %q in json pattern", selector)
+		}
+		if match[1] != "" {
+			steps = append(steps, match[1])
+		} else {
+			index, _ := strconv.Atoi(match[2])
+			steps = append(steps, index)
+		}
+		rest = rest[len(match[0]):]
+	}
+	return steps, nil
+}
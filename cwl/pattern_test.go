@@ -0,0 +1,150 @@
+package cwl
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_FilterPattern_Terms(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		message string
+		result  bool
+	}{
+		{"", "anything", true},
+		{"ERROR", "[ERROR] failed", true},
+		{"ERROR", "[error] failed", false},
+		{"ERROR Exception", "ERROR NullPointerException", true},
+		{"ERROR Exception", "ERROR failed", false},
+		{"?ERROR ?WARN", "WARN disk full", true},
+		{"?ERROR ?WARN", "INFO started", false},
+		{"ERROR -Exiting", "ERROR Exiting now", false},
+		{"ERROR -Exiting", "ERROR retrying", true},
+		{`"Connection refused"`, "dial: Connection refused", true},
+		{`"Connection refused"`, "Connection was refused", false},
+	}
+
+	for _, testCase := range testCases {
+		filter, err := CompileFilterPattern(testCase.pattern)
+		assert.Nil(t, err)
+		assert.Equal(t, testCase.result, filter.Match(testCase.message), testCase.pattern+" / "+testCase.message)
+	}
+}
+
+func Test_FilterPattern_JSON(t *testing.T) {
+	message := `{"level":"ERROR","latency":750,"user":{"id":"u-123","roles":["admin"]},"cached":false,"trace":null}` + "\n"
+	testCases := []struct {
+		pattern string
+		result  bool
+	}{
+		{`{ $.level = "ERROR" }`, true},
+		{`{ $.level = ERROR }`, true},
+		{`{ $.level != "ERROR" }`, false},
+		{`{ $.level = "ERR*" }`, true},
+		{`{ $.latency > 500 }`, true},
+		{`{ $.latency <= 500 }`, false},
+		{`{ $.latency = 750 }`, true},
+		{`{ $.user.id = "u-*" }`, true},
+		{`{ $.user.roles[0] = "admin" }`, true},
+		{`{ $.user.roles[1] = "admin" }`, false},
+		{`{ $.cached IS FALSE }`, true},
+		{`{ $.cached IS TRUE }`, false},
+		{`{ $.trace IS NULL }`, true},
+		{`{ $.missing NOT EXISTS }`, true},
+		{`{ $.level EXISTS }`, true},
+		{`{ ($.level = "INFO") || ($.latency > 500) }`, true},
+		{`{ ($.level = "ERROR") && ($.latency < 500) }`, false},
+		{`{ $.level = "ERROR" && ($.latency < 500 || $.cached IS FALSE) }`, true},
+	}
+
+	for _, testCase := range testCases {
+		filter, err := CompileFilterPattern(testCase.pattern)
+		assert.Nil(t, err, testCase.pattern)
+		assert.Equal(t, testCase.result, filter.Match(message), testCase.pattern)
+	}
+
+	// non-json messages never match json patterns
+	filter, _ := CompileFilterPattern(`{ $.level EXISTS }`)
+	assert.False(t, filter.Match("level: ERROR"))
+}
+
+func Test_FilterPattern_InvalidPatterns(t *testing.T) {
+	patterns := []string{
+		`"unterminated`,
+		`{ $.level = "ERROR"`,
+		`{ level = "ERROR" }`,
+		`{ $.level ~ "ERROR" }`,
+		`{ $.level > "ERROR" }`,
+		`{ ($.level = "ERROR" }`,
+		`{ $.level IS MAYBE }`,
+		`[ip, user, status_code = 4*]`,
+	}
+
+	for _, pattern := range patterns {
+		_, err := CompileFilterPattern(pattern)
+		assert.NotNil(t, err, pattern)
+	}
+}
+
+func Test_Stream_Digest_SkipsEventsNotMatchingTheFilterPattern(t *testing.T) {
+	group := &Group{
+		Name:       "group",
+		Prospector: &Prospector{FilterPattern: "?ERROR ?WARN"},
+	}
+	messages := []string{}
+	publisher := &MockPublisher{}
+	publisher.On("Publish", mock.AnythingOfType("*cwl.Event")).Return().Run(
+		func(args mock.Arguments) {
+			messages = append(messages, args.Get(0).(*Event).Message)
+		})
+	params := &Params{Config: &Config{}, Publisher: publisher}
+	stream := NewStream("stream", group, nil, nil, params)
+	// go!
+	stream.digest(CreateOutputLogEvent("INFO started\n"))
+	stream.digest(CreateOutputLogEvent("WARN disk full\n"))
+	stream.digest(CreateOutputLogEvent("ERROR failed\n"))
+	// assert
+	assert.Equal(t, []string{"WARN disk full\n", "ERROR failed\n"}, messages)
+}
+
+func Test_Group_Filter_PushesDownTheFilterPattern(t *testing.T) {
+	client := &MockCWLClient{}
+	inputs := []*cloudwatchlogs.FilterLogEventsInput{}
+	stubFilterLogEventsPages(client, &inputs)
+	params := &Params{
+		Config:    &Config{},
+		Registry:  NewDummyRegistry(),
+		AWSClient: client,
+	}
+	prospector := &Prospector{Mode: GroupMode, FilterPattern: "[ip, user, ...]"}
+	group := NewGroup("group", prospector, params)
+	// go!
+	group.Filter()
+	// assert
+	assert.Equal(t, "[ip, user, ...]", *inputs[0].FilterPattern)
+	assert.Nil(t, group.dispatchStream("stream").filter)
+}
+
+func Test_Stream_EvaluatesTheFilterPattern_OfPushedGroupModeEvents(t *testing.T) {
+	for _, input := range []string{KinesisInput, FirehoseInput, S3ExportInput} {
+		publisher, events := CreateCollectingPublisher(false)
+		params := &Params{
+			Config: &Config{
+				Input:       input,
+				Prospectors: []Prospector{{GroupNames: []string{"group"}, Mode: GroupMode, FilterPattern: "ERROR"}},
+			},
+			Registry:  NewDummyRegistry(),
+			Publisher: publisher,
+		}
+		manager := NewGroupManager(params)
+		message := CreateSubscriptionMessage("group", "stream", "INFO started\n", "ERROR failed\n")
+		// go!
+		manager.digestSubscriptionMessage(message, nil)
+		// assert
+		assert.Equal(t, 1, len(*events), input)
+		assert.Equal(t, "ERROR failed\n", (*events)[0].Message, input)
+	}
+}
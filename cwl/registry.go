@@ -4,14 +4,92 @@ import "fmt"
 
 type Registry interface {
 	ReadStreamInfo(*Stream) error
-	WriteStreamInfo(*Stream) error
+	WriteStreamInfo(*Stream, *RegistryItem) error
+	DeleteStreamInfo(*Stream) error
+	// returns nil if the group has no registry item
+	ReadGroupInfo(*Group) (*GroupRegistryItem, error)
+	WriteGroupInfo(*Group, *GroupRegistryItem) error
+	DeleteGroupInfo(*Group) error
+	// returns nil if the shard has no registry item
+	ReadShardInfo(*Shard) (*ShardRegistryItem, error)
+	WriteShardInfo(*Shard, *ShardRegistryItem) error
+	// returns nil if the export object has no registry item
+	ReadExportInfo(*ExportObject) (*ExportRegistryItem, error)
+	WriteExportInfo(*ExportObject, *ExportRegistryItem) error
 }
 
 type RegistryItem struct {
-	NextToken string
+	NextToken       string `dynamodbav:",omitempty"`
+	Buffer          string `dynamodbav:",omitempty"`
+	BufferTimestamp int64  `json:",omitempty" dynamodbav:",omitempty"` // the timestamp of the first buffered line
+
+	KeyedBuffers []KeyedBuffer `json:",omitempty" dynamodbav:",omitempty"` // the events buffered by their correlation key
+}
+
+// A multiline event buffered by its correlation key
+type KeyedBuffer struct {
+	Key       string
 	Buffer    string
+	Timestamp int64 // the timestamp of the first line
+}
+
+// The state of a group that is monitored in "group" mode
+type GroupRegistryItem struct {
+	Timestamp int64             // the start of the next time window (in milliseconds since 1970)
+	EventIds  []string          `dynamodbav:",omitempty"` // the ids of the latest events already seen in the lookback window
+	Buffers   map[string]string `dynamodbav:",omitempty"` // the multiline buffers per stream name
+
+	BufferTimestamps map[string]int64 `json:",omitempty" dynamodbav:",omitempty"` // the timestamps of the buffers' first lines
+
+	KeyedBuffers map[string][]KeyedBuffer `json:",omitempty" dynamodbav:",omitempty"` // the events buffered by their correlation key per stream name
+}
+
+// The state of a kinesis shard
+type ShardRegistryItem struct {
+	SequenceNumber string                       // the last consumed sequence number
+	Buffers        map[string]map[string]string `dynamodbav:",omitempty"` // the multiline buffers per group and stream name
+
+	BufferTimestamps map[string]map[string]int64         `json:",omitempty" dynamodbav:",omitempty"` // the timestamps of the buffers' first lines per group and stream name
+	KeyedBuffers     map[string]map[string][]KeyedBuffer `json:",omitempty" dynamodbav:",omitempty"` // the events buffered by their correlation key per group and stream name
+}
+
+// The state of an S3 export object that has been ingested
+type ExportRegistryItem struct {
+	Completed bool   // true once all the object's events have been acknowledged
+	Buffer    string `dynamodbav:",omitempty"` // the stream's multiline buffer after the object
+
+	BufferTimestamp int64 `json:",omitempty" dynamodbav:",omitempty"` // the timestamp of the buffer's first line
+
+	KeyedBuffers []KeyedBuffer `json:",omitempty" dynamodbav:",omitempty"` // the events buffered by their correlation key after the object
 }
 
+// A registry item that, once committed by a batchQueue, deletes the
+// entity's item instead of writing it; used to clean up the state of the
+// groups that are removed after their events have been acknowledged
+type registryDeletion struct{}
+
+// The registry keys never collide, given that neither group nor stream
+// names can contain colons:
+//   - streams: <group key>/<stream name>
+//   - groups in group mode: <group key>/:group
+//   - kinesis shards: :kinesis/<kinesis stream>/<shard id>
+//   - S3 export objects: :export/<bucket>/<object key>
+// where the group key is the group name prefixed with its account and
+// region if they differ from the beat's own (see groupKey), so that the
+// keys of the beat's own groups are unchanged.
+
 func generateKey(stream *Stream) string {
-	return fmt.Sprintf("%v/%v", stream.Group.Name, stream.Name)
+	return fmt.Sprintf("%v/%v", stream.Group.key(), stream.Name)
+}
+
+func generateGroupKey(group *Group) string {
+	return fmt.Sprintf("%v/:group", group.key())
+}
+
+func generateShardKey(shard *Shard) string {
+	return fmt.Sprintf(":kinesis/%v/%v", shard.Consumer.StreamName, shard.Id)
+}
+
+func generateExportKey(object *ExportObject) string {
+	return fmt.Sprintf(":export/%v/%v", object.Bucket, object.Key)
 }
@@ -0,0 +1,94 @@
+package cwl
+
+import (
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Error classes that determine how monitoring handles an error
+const (
+	ThrottlingError   = "throttling"
+	NotFoundError     = "not_found"
+	AccessDeniedError = "access_denied"
+	NetworkError      = "network"
+	ConflictError     = "conflict" // the registry item was written by another instance
+	OtherError        = "other"
+)
+
+// the error codes that denote insufficient permissions or credentials
+var accessDeniedCodes = map[string]bool{
+	"AccessDenied":          true,
+	"AccessDeniedException": true,
+	cloudwatchlogs.ErrCodeUnrecognizedClientException: true,
+	"ExpiredToken":          true,
+	"ExpiredTokenException": true,
+	"InvalidClientTokenId":  true,
+}
+
+// Returns the class of an error returned by the AWS APIs or the registry
+func classifyError(err error) string {
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch {
+		case request.IsErrorThrottle(err),
+			awsErr.Code() == cloudwatchlogs.ErrCodeLimitExceededException:
+			return ThrottlingError
+		case awsErr.Code() == cloudwatchlogs.ErrCodeResourceNotFoundException:
+			return NotFoundError
+		case awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException:
+			return ConflictError
+		case accessDeniedCodes[awsErr.Code()]:
+			return AccessDeniedError
+		case awsErr.Code() == cloudwatchlogs.ErrCodeServiceUnavailableException,
+			request.IsErrorRetryable(err):
+			return NetworkError
+		}
+		return OtherError
+	}
+	if _, ok := err.(net.Error); ok {
+		return NetworkError
+	}
+	return OtherError
+}
+
+// Exponential backoff with jitter: the n-th consecutive retry waits for a
+// random duration between half and the whole of initial*2^n, capped at max
+type backoff struct {
+	initial  time.Duration
+	max      time.Duration
+	attempts int
+}
+
+func newBackoff(config *Config) *backoff {
+	return &backoff{initial: config.RetryInitialBackoff, max: config.RetryMaxBackoff}
+}
+
+// Returns how long to wait before retrying after an error of the class;
+// access denied errors are not expected to resolve soon, so they always
+// wait for the maximum backoff
+func (b *backoff) next(class string) time.Duration {
+	delay := b.max
+	if class != AccessDeniedError {
+		delay = b.initial
+		for i := 0; i < b.attempts && delay < b.max; i++ {
+			delay *= 2
+		}
+		if delay > b.max {
+			delay = b.max
+		}
+	}
+	b.attempts++
+	if delay < 2 {
+		return delay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+func (b *backoff) reset() {
+	b.attempts = 0
+}
@@ -0,0 +1,51 @@
+package cwl
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ClassifyError(t *testing.T) {
+	testCases := []struct {
+		err   error
+		class string
+	}{
+		{awserr.New("ThrottlingException", "Rate exceeded", nil), ThrottlingError},
+		{awserr.New(cloudwatchlogs.ErrCodeLimitExceededException, "Limit exceeded", nil), ThrottlingError},
+		{awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, "Not found", nil), NotFoundError},
+		{awserr.New("AccessDeniedException", "Denied", nil), AccessDeniedError},
+		{awserr.New(cloudwatchlogs.ErrCodeUnrecognizedClientException, "Invalid token", nil), AccessDeniedError},
+		{awserr.New(request.ErrCodeRequestError, "send request failed", &net.OpError{Op: "dial", Err: errors.New("connection reset by peer")}), NetworkError},
+		{awserr.New(cloudwatchlogs.ErrCodeServiceUnavailableException, "Unavailable", nil), NetworkError},
+		{&net.DNSError{Err: "no such host", Name: "logs.eu-west-1.amazonaws.com"}, NetworkError},
+		{awserr.New(cloudwatchlogs.ErrCodeInvalidParameterException, "Invalid", nil), OtherError},
+		{errors.New("registry write failed"), OtherError},
+	}
+	for _, testCase := range testCases {
+		assert.Equal(t, testCase.class, classifyError(testCase.err), testCase.err.Error())
+	}
+}
+
+func Test_Backoff_GrowsExponentially_WithJitter_UpToTheMaximum(t *testing.T) {
+	retry := newBackoff(&Config{RetryInitialBackoff: time.Second, RetryMaxBackoff: 10 * time.Second})
+	for _, max := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		delay := retry.next(ThrottlingError)
+		assert.True(t, delay >= max*time.Second/2 && delay <= max*time.Second, delay)
+	}
+	retry.reset()
+	delay := retry.next(NetworkError)
+	assert.True(t, delay >= 500*time.Millisecond && delay <= time.Second, delay)
+}
+
+func Test_Backoff_WaitsForTheMaximum_OnAccessDenied(t *testing.T) {
+	retry := newBackoff(&Config{RetryInitialBackoff: time.Second, RetryMaxBackoff: 10 * time.Second})
+	delay := retry.next(AccessDeniedError)
+	assert.True(t, delay >= 5*time.Second && delay <= 10*time.Second, delay)
+}
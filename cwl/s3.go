@@ -25,8 +25,70 @@ type S3Registry struct {
 // }
 
 func (registry *S3Registry) ReadStreamInfo(stream *Stream) error {
+	var item RegistryItem
+	found, err := registry.readItem(registry.GetBucketKeyForStream(stream), &item)
+	if err != nil || !found {
+		return err
+	}
+	stream.restore(&item)
+	return nil
+}
+
+func (registry *S3Registry) WriteStreamInfo(stream *Stream, item *RegistryItem) error {
+	return registry.writeItem(registry.GetBucketKeyForStream(stream), item)
+}
+
+func (registry *S3Registry) DeleteStreamInfo(stream *Stream) error {
+	return registry.deleteItem(registry.GetBucketKeyForStream(stream))
+}
+
+func (registry *S3Registry) ReadGroupInfo(group *Group) (*GroupRegistryItem, error) {
+	var item GroupRegistryItem
+	found, err := registry.readItem(registry.KeyPrefix+generateGroupKey(group), &item)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func (registry *S3Registry) WriteGroupInfo(group *Group, item *GroupRegistryItem) error {
+	return registry.writeItem(registry.KeyPrefix+generateGroupKey(group), item)
+}
+
+func (registry *S3Registry) DeleteGroupInfo(group *Group) error {
+	return registry.deleteItem(registry.KeyPrefix + generateGroupKey(group))
+}
+
+func (registry *S3Registry) ReadShardInfo(shard *Shard) (*ShardRegistryItem, error) {
+	var item ShardRegistryItem
+	found, err := registry.readItem(registry.KeyPrefix+generateShardKey(shard), &item)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func (registry *S3Registry) WriteShardInfo(shard *Shard, item *ShardRegistryItem) error {
+	return registry.writeItem(registry.KeyPrefix+generateShardKey(shard), item)
+}
+
+func (registry *S3Registry) ReadExportInfo(object *ExportObject) (*ExportRegistryItem, error) {
+	var item ExportRegistryItem
+	found, err := registry.readItem(registry.KeyPrefix+generateExportKey(object), &item)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func (registry *S3Registry) WriteExportInfo(object *ExportObject, item *ExportRegistryItem) error {
+	return registry.writeItem(registry.KeyPrefix+generateExportKey(object), item)
+}
+
+// Reads the object under key into item; returns false if the object
+// does not exist
+func (registry *S3Registry) readItem(key string, item interface{}) (bool, error) {
 	var err error
-	key := registry.GetBucketKeyForStream(stream)
 	defer func() {
 		if err != nil {
 			logp.Warn(fmt.Sprintf("s3: failed to read key=%s [message=%s]", key, err.Error()))
@@ -46,42 +108,31 @@ func (registry *S3Registry) ReadStreamInfo(stream *Stream) error {
 				// this is a normal condition when the program
 				// starts monitoring a new stream
 				err = nil
-				return nil
+				return false, nil
 			default:
-				return err
+				return false, err
 			}
 		} else {
-			return err
+			return false, err
 		}
 	}
 
 	body, err := ioutil.ReadAll(result.Body)
 	if err != nil {
-		return err
+		return false, err
 	}
-	var item RegistryItem
-	err = json.Unmarshal(body, &item)
+	err = json.Unmarshal(body, item)
 	if err != nil {
-		return err
+		return false, err
 	}
-	// update stream
-	stream.queryParams.NextToken = aws.String(item.NextToken)
-	stream.buffer.Reset()
-	stream.buffer.WriteString(item.Buffer)
-
-	return nil
+	return true, nil
 }
 
-func (registry *S3Registry) WriteStreamInfo(stream *Stream) error {
-	item := RegistryItem{
-		NextToken: *stream.queryParams.NextToken,
-		Buffer:    stream.buffer.String(),
-	}
+func (registry *S3Registry) writeItem(key string, item interface{}) error {
 	body, err := json.Marshal(item)
 	if err != nil {
 		return err
 	}
-	key := registry.GetBucketKeyForStream(stream)
 	buf := bytes.NewReader(body)
 	// TODO: Implement expiration here?
 	input := &s3.PutObjectInput{
@@ -98,6 +149,17 @@ func (registry *S3Registry) WriteStreamInfo(stream *Stream) error {
 	return err
 }
 
+func (registry *S3Registry) deleteItem(key string) error {
+	_, err := registry.S3Client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(registry.BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		logp.Warn(fmt.Sprintf("s3: failed to delete key=%s [message=%s]", key, err.Error()))
+	}
+	return err
+}
+
 func (registry *S3Registry) GetBucketKeyForStream(stream *Stream) string {
 	return registry.KeyPrefix + generateKey(stream)
 }
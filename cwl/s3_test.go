@@ -19,6 +19,10 @@ type MockS3Client struct {
 	s3iface.S3API
 	GetObjectStub func(*s3.GetObjectInput) (*s3.GetObjectOutput, error)
 	PutObjectStub func(*s3.PutObjectInput) (*s3.PutObjectOutput, error)
+
+	DeleteObjectStub func(*s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error)
+
+	ListObjectsV2PagesStub func(*s3.ListObjectsV2Input, func(*s3.ListObjectsV2Output, bool) bool) error
 }
 
 // stub GetObject
@@ -31,6 +35,17 @@ func (client *MockS3Client) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOu
 	return client.PutObjectStub(input)
 }
 
+// stub DeleteObject
+func (client *MockS3Client) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	return client.DeleteObjectStub(input)
+}
+
+// stub ListObjectsV2Pages
+func (client *MockS3Client) ListObjectsV2Pages(input *s3.ListObjectsV2Input,
+	f func(*s3.ListObjectsV2Output, bool) bool) error {
+	return client.ListObjectsV2PagesStub(input, f)
+}
+
 // this is our mock S3 body object
 type S3ItemBody struct {
 	io.Reader
@@ -89,12 +104,13 @@ func Test_S3_ReadStreamInfo_WhenItemExists_ShouldUpdateStream(t *testing.T) {
 
 func Test_S3_WriteStreamInfo_ShouldReturnNil_OnSuccess(t *testing.T) {
 	stream.buffer = *bytes.NewBufferString("This is the buffer")
+	stream.bufferStart = 12345
 	stream.queryParams.NextToken = aws.String("abcde")
 	client := &MockS3Client{
 		PutObjectStub: func(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
 			body := &bytes.Buffer{}
 			body.ReadFrom(input.Body)
-			assert.Equal(t, `{"NextToken":"abcde","Buffer":"This is the buffer"}`, body.String())
+			assert.Equal(t, `{"NextToken":"abcde","Buffer":"This is the buffer","BufferTimestamp":12345}`, body.String())
 			assert.Equal(t, "the_bucket_name", *input.Bucket)
 			assert.Equal(t, "group/stream", *input.Key)
 			assert.Equal(t, "application/json", *input.ContentEncoding)
@@ -103,7 +119,7 @@ func Test_S3_WriteStreamInfo_ShouldReturnNil_OnSuccess(t *testing.T) {
 		},
 	}
 	registry := S3Registry{S3Client: client, BucketName: "the_bucket_name"}
-	registry.WriteStreamInfo(stream)
+	registry.WriteStreamInfo(stream, stream.checkpoint())
 }
 
 func Test_S3_WriteStreamInfo_ShouldReturnError_OnError(t *testing.T) {
@@ -114,7 +130,7 @@ func Test_S3_WriteStreamInfo_ShouldReturnError_OnError(t *testing.T) {
 		},
 	}
 	registry := S3Registry{S3Client: client, BucketName: "the_bucket_name"}
-	err := registry.WriteStreamInfo(stream)
+	err := registry.WriteStreamInfo(stream, stream.checkpoint())
 	assert.Equal(t, "S3 Error", err.Error())
 }
 
@@ -133,3 +149,31 @@ func Test_S3_GetBucketKeyForStream(t *testing.T) {
 		assert.Equal(t, testCase.result, registry.GetBucketKeyForStream(stream))
 	}
 }
+
+func Test_S3_WriteGroupInfo_UsesGroupKey(t *testing.T) {
+	client := &MockS3Client{
+		PutObjectStub: func(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+			body := &bytes.Buffer{}
+			body.ReadFrom(input.Body)
+			assert.Equal(t, `{"Timestamp":12345,"EventIds":["1"],"Buffers":null}`, body.String())
+			assert.Equal(t, "prefix/group/:group", *input.Key)
+			return nil, nil
+		},
+	}
+	registry := S3Registry{S3Client: client, BucketName: "the_bucket_name", KeyPrefix: "prefix/"}
+	err := registry.WriteGroupInfo(group, &GroupRegistryItem{Timestamp: 12345, EventIds: []string{"1"}})
+	assert.Nil(t, err)
+}
+
+func Test_S3_DeleteGroupInfo_DeletesGroupKey(t *testing.T) {
+	client := &MockS3Client{
+		DeleteObjectStub: func(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+			assert.Equal(t, "the_bucket_name", *input.Bucket)
+			assert.Equal(t, "prefix/group/:group", *input.Key)
+			return &s3.DeleteObjectOutput{}, nil
+		},
+	}
+	registry := S3Registry{S3Client: client, BucketName: "the_bucket_name", KeyPrefix: "prefix/"}
+	err := registry.DeleteGroupInfo(group)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,197 @@
+package cwl
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+)
+
+// Scheduler polls the streams of all the groups using a fixed number of
+// workers, instead of a goroutine per stream. Streams are kept in a
+// priority queue by the time of their next poll (which depends on whether
+// they are hot) and are handed to the workers when due. A stream is never
+// polled by more than one worker at a time, so its events are published
+// in order and its multiline state is preserved.
+type Scheduler struct {
+	Workers int
+
+	mutex  sync.Mutex
+	queue  scheduleQueue
+	wakeup chan struct{} // signals the dispatcher that the queue has changed
+
+	// statistics since the last report
+	polls int64
+	lag   time.Duration // the maximum delay of a poll after its due time
+}
+
+func NewScheduler(workers int) *Scheduler {
+	return &Scheduler{
+		Workers: workers,
+		wakeup:  make(chan struct{}, 1),
+	}
+}
+
+// Schedules a new stream to be polled as soon as possible
+func (scheduler *Scheduler) Add(stream *Stream) {
+	logp.Info("[stream] %s scheduled", stream.FullName())
+	scheduler.schedule(stream, time.Now())
+}
+
+func (scheduler *Scheduler) schedule(stream *Stream, due time.Time) {
+	scheduler.mutex.Lock()
+	heap.Push(&scheduler.queue, &scheduledStream{stream: stream, due: due})
+	scheduler.mutex.Unlock()
+	select {
+	case scheduler.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Returns the next due stream or, if none is due, how long to wait for it;
+// a zero duration means that the queue is empty
+func (scheduler *Scheduler) next() (*Stream, time.Duration) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	if len(scheduler.queue) == 0 {
+		return nil, 0
+	}
+	head := scheduler.queue[0]
+	wait := time.Until(head.due)
+	if wait > 0 {
+		return nil, wait
+	}
+	heap.Pop(&scheduler.queue)
+	scheduler.polls++
+	if -wait > scheduler.lag {
+		scheduler.lag = -wait
+	}
+	return head.stream, 0
+}
+
+// Dispatches the due streams to the workers until the context is
+// cancelled, in which case it waits for the ongoing polls and drains all
+// the streams before returning
+func (scheduler *Scheduler) Run(ctx context.Context) {
+	logp.Info("[scheduler] started with %d workers", scheduler.Workers)
+	defer logp.Info("[scheduler] stopped")
+
+	work := make(chan *Stream)
+	var workers sync.WaitGroup
+	for i := 0; i < scheduler.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for stream := range work {
+				scheduler.poll(stream)
+			}
+		}()
+	}
+
+	for ctx.Err() == nil {
+		stream, wait := scheduler.next()
+		if stream != nil {
+			select {
+			case work <- stream:
+			case <-ctx.Done():
+				scheduler.schedule(stream, time.Now())
+			}
+			continue
+		}
+		var timer <-chan time.Time
+		if wait > 0 {
+			timer = time.After(wait)
+		}
+		select {
+		case <-ctx.Done():
+		case <-scheduler.wakeup:
+		case <-timer:
+		}
+	}
+
+	close(work)
+	workers.Wait()
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	for _, scheduled := range scheduler.queue {
+		scheduled.stream.drain()
+	}
+}
+
+// Removes the queued streams of a group that is not monitored anymore and
+// returns them; streams that are being polled are dropped by their worker
+func (scheduler *Scheduler) remove(group *Group) []*Stream {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	var removed []*Stream
+	queue := scheduler.queue[:0]
+	for _, scheduled := range scheduler.queue {
+		if scheduled.stream.Group == group {
+			removed = append(removed, scheduled.stream)
+		} else {
+			queue = append(queue, scheduled)
+		}
+	}
+	for i := len(queue); i < len(scheduler.queue); i++ {
+		scheduler.queue[i] = nil
+	}
+	scheduler.queue = queue
+	heap.Init(&scheduler.queue)
+	return removed
+}
+
+// Polls the stream and schedules its next poll, or removes it from its
+// group if it must not be polled anymore. The streams of stopped groups
+// are stopped instead of being scheduled again.
+func (scheduler *Scheduler) poll(stream *Stream) {
+	wait, ok := stream.poll()
+	if ok && stream.Group.ctx.Err() != nil {
+		stream.stop()
+		return
+	}
+	if !ok {
+		logp.Info("[stream] %s unscheduled", stream.FullName())
+		stream.Group.removeStream(stream)
+		return
+	}
+	scheduler.schedule(stream, time.Now().Add(wait))
+}
+
+func (scheduler *Scheduler) report() {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	logp.Info("report[scheduler] %d %d %d %v", scheduler.Workers, len(scheduler.queue), scheduler.polls, scheduler.lag)
+	scheduler.polls = 0
+	scheduler.lag = 0
+}
+
+// === priority queue ===
+
+type scheduledStream struct {
+	stream *Stream
+	due    time.Time
+}
+
+// A min-heap of streams by due time; implements heap.Interface
+type scheduleQueue []*scheduledStream
+
+func (queue scheduleQueue) Len() int { return len(queue) }
+
+func (queue scheduleQueue) Less(i, j int) bool { return queue[i].due.Before(queue[j].due) }
+
+func (queue scheduleQueue) Swap(i, j int) { queue[i], queue[j] = queue[j], queue[i] }
+
+func (queue *scheduleQueue) Push(x interface{}) {
+	*queue = append(*queue, x.(*scheduledStream))
+}
+
+func (queue *scheduleQueue) Pop() interface{} {
+	old := *queue
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*queue = old[:n-1]
+	return item
+}
@@ -0,0 +1,194 @@
+package cwl
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_ScheduleQueue_PopsTheEarliestDueStream(t *testing.T) {
+	now := time.Now()
+	queue := &scheduleQueue{}
+	for _, offset := range []int{3, 1, 2, 0} {
+		heap.Push(queue, &scheduledStream{
+			stream: &Stream{Name: string(rune('a' + offset))},
+			due:    now.Add(time.Duration(offset) * time.Second),
+		})
+	}
+	names := ""
+	for queue.Len() > 0 {
+		names += heap.Pop(queue).(*scheduledStream).stream.Name
+	}
+	assert.Equal(t, "abcd", names)
+}
+
+func Test_Scheduler_PollsStreams_WithBoundedConcurrency(t *testing.T) {
+	var lock sync.Mutex
+	polling, maxPolling, polls := 0, 0, 0
+	client := &MockCWLClient{}
+	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).Return(
+		&cloudwatchlogs.GetLogEventsOutput{}, nil).Run(
+		func(args mock.Arguments) {
+			lock.Lock()
+			polling++
+			polls++
+			if polling > maxPolling {
+				maxPolling = polling
+			}
+			lock.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			lock.Lock()
+			polling--
+			lock.Unlock()
+		})
+	params := &Params{
+		Config: &Config{
+			ReportFrequency:             time.Hour,
+			StreamEventHorizon:          time.Hour,
+			StreamEventRefreshFrequency: time.Hour,
+		},
+		Registry:  NewDummyRegistry(),
+		AWSClient: client,
+		Publisher: &MockPublisher{},
+		Scheduler: NewScheduler(2),
+	}
+	group := NewGroup("group", &Prospector{}, params)
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		group.addNewStream(name)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	// go!
+	go func() {
+		group.Params.Scheduler.Run(ctx)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return polls == 6
+	}, time.Second, time.Millisecond)
+	cancel()
+	<-done
+	// assert
+	assert.Equal(t, 2, maxPolling)
+	// the streams are due again in an hour
+	assert.Equal(t, 6, len(group.Params.Scheduler.queue))
+	assert.Equal(t, 6, len(group.streams))
+}
+
+func Test_Scheduler_RemovesStreams_ThatDoNotExistAnymore(t *testing.T) {
+	client := &MockCWLClient{}
+	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).Return(
+		nil, awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, "Not found", nil))
+	params := &Params{
+		Config: &Config{
+			ReportFrequency:             time.Hour,
+			StreamEventHorizon:          time.Hour,
+			StreamEventRefreshFrequency: time.Hour,
+		},
+		Registry:  NewDummyRegistry(),
+		AWSClient: client,
+		Publisher: &MockPublisher{},
+		Scheduler: NewScheduler(1),
+	}
+	group := NewGroup("group", &Prospector{}, params)
+	group.addNewStream("deleted")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	// go!
+	go func() {
+		group.Params.Scheduler.Run(ctx)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool {
+		group.mutex.RLock()
+		defer group.mutex.RUnlock()
+		return len(group.streams) == 0
+	}, time.Second, time.Millisecond)
+	cancel()
+	<-done
+	// assert
+	assert.Equal(t, 0, len(group.Params.Scheduler.queue))
+}
+
+func Test_Scheduler_PreservesMultilineState_AndDrainsOnCancel(t *testing.T) {
+	client := &MockCWLClient{}
+	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).Return(
+		&cloudwatchlogs.GetLogEventsOutput{
+			Events: []*cloudwatchlogs.OutputLogEvent{
+				CreateOutputLogEventWithTimestamp("line 1\n", TimeBeforeNowInMilliseconds(0)),
+				CreateOutputLogEventWithTimestamp("END\n", TimeBeforeNowInMilliseconds(0)),
+				CreateOutputLogEventWithTimestamp("partial\n", TimeBeforeNowInMilliseconds(0)),
+			},
+			NextForwardToken: aws.String("token"),
+		}, nil)
+	var lock sync.Mutex
+	messages := []string{}
+	publisher := &MockPublisher{}
+	publisher.On("Publish", mock.AnythingOfType("*cwl.Event")).Return().Run(
+		func(args mock.Arguments) {
+			event := args.Get(0).(*Event)
+			lock.Lock()
+			messages = append(messages, event.Message)
+			lock.Unlock()
+			AckEvents(1, []interface{}{event.batch})
+		})
+	prospector := &Prospector{Multiline: &Multiline{Pattern: "^END", Negate: true, Match: "before"}}
+	params := &Params{
+		Config: &Config{
+			ReportFrequency:             time.Hour,
+			StreamEventHorizon:          time.Hour,
+			StreamEventRefreshFrequency: time.Hour,
+		},
+		Registry:  NewDummyRegistry(),
+		AWSClient: client,
+		Publisher: publisher,
+		Scheduler: NewScheduler(1),
+	}
+	group := NewGroup("group", prospector, params)
+	group.addNewStream("stream")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	// go!
+	go func() {
+		group.Params.Scheduler.Run(ctx)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(messages) == 1
+	}, time.Second, time.Millisecond)
+	cancel()
+	<-done
+	// assert
+	assert.Equal(t, []string{"line 1\nEND\n", "partial\n"}, messages)
+	restored := NewStream("stream", group, nil, nil, group.Params)
+	group.Params.Registry.ReadStreamInfo(restored)
+	assert.Equal(t, "token", *restored.queryParams.NextToken)
+	assert.Equal(t, "", restored.buffer.String())
+}
+
+func Test_Scheduler_Remove_ReturnsTheQueuedStreamsOfTheGroup(t *testing.T) {
+	scheduler := NewScheduler(1)
+	removed := &Group{Name: "removed"}
+	kept := &Group{Name: "kept"}
+	for _, group := range []*Group{removed, kept, removed, kept} {
+		scheduler.schedule(&Stream{Group: group}, time.Now())
+	}
+	streams := scheduler.remove(removed)
+	assert.Equal(t, 2, len(streams))
+	assert.Equal(t, 2, len(scheduler.queue))
+	for _, scheduled := range scheduler.queue {
+		assert.Equal(t, kept, scheduled.stream.Group)
+	}
+}
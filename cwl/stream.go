@@ -2,8 +2,10 @@ package cwl
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"regexp"
+	"sync/atomic"
 	"time"
 
 	"github.com/elastic/beats/v7/libbeat/logp"
@@ -17,22 +19,45 @@ type Stream struct {
 	Group  *Group
 	Params *Params
 
+	config      *Config // the effective config of the group's prospector
 	queryParams *cloudwatchlogs.GetLogEventsInput
 
 	// This is used for multi line mode. We store all text needed until we find
 	// the end of message
-	buffer     bytes.Buffer
-	multiline  *Multiline
-	multiRegex *regexp.Regexp // cached regex for performance
+	buffer      bytes.Buffer
+	bufferStart int64 // the timestamp of the buffer's first line
+	bufferLines int   // the number of lines of the buffered event, including the dropped ones
+	truncated   bool  // true if lines of the buffered event were dropped
+	multiline   *Multiline
+	multiRegex  *regexp.Regexp // cached regex for performance
+	flushRegex  *regexp.Regexp // nil unless there is a flush pattern
+	keyRegex    *regexp.Regexp // the correlation key of "key" multiline events
+	keyed       []*keyedBuffer // the buffered "key" multiline events, oldest first
+	lastKey     string         // the correlation key of the last line
+
+	// the prospector's filter pattern, evaluated locally
+	filter *FilterPattern
 
 	LastEventTimestamp int64       // the last event that we've processed (in milliseconds since 1970)
 	finished           chan<- bool // channel for the stream to signal that its processing is over
 	publishedEvents    int64       // number of published events
+	retries            int64       // number of polls retried after an error
+	retry              *backoff    // the backoff of failed polls
+	started            bool        // true once the state has been read from the registry
+	caughtUp           bool        // true if the last poll returned no events
+	reported           time.Time   // when the stream was last reported
+	conflicted         int32       // set (atomically) once another instance has written the stream's registry item
+
+	// batches of published events whose registry items are waiting for
+	// the pipeline's acknowledgement before being committed
+	batch *eventBatch // the batch in which published events are added
+	acks  *batchQueue
 }
 
 func NewStream(name string, group *Group, multiline *Multiline, finished chan<- bool, params *Params) *Stream {
 
-	startTime := time.Now().UTC().Add(-params.Config.StreamEventHorizon)
+	config := params.Config.ProspectorConfig(group.Prospector)
+	startTime := time.Now().UTC().Add(-config.StreamEventHorizon)
 
 	queryParams := &cloudwatchlogs.GetLogEventsInput{
 		LogGroupName:  aws.String(group.Name),
@@ -46,10 +71,25 @@ func NewStream(name string, group *Group, multiline *Multiline, finished chan<-
 		Name:               name,
 		Group:              group,
 		Params:             params,
+		config:             config,
 		queryParams:        queryParams,
 		multiline:          multiline,
 		finished:           finished,
 		LastEventTimestamp: 1000 * time.Now().Unix(),
+		retry:              newBackoff(params.Config),
+	}
+
+	stream.acks = &batchQueue{
+		write: func(item interface{}) error {
+			if _, ok := item.(registryDeletion); ok {
+				return stream.Params.Registry.DeleteStreamInfo(stream)
+			}
+			err := stream.Params.Registry.WriteStreamInfo(stream, item.(*RegistryItem))
+			if err != nil && classifyError(err) == ConflictError {
+				atomic.StoreInt32(&stream.conflicted, 1)
+			}
+			return err
+		},
 	}
 
 	// Construct regular expression if multiline mode
@@ -58,9 +98,24 @@ func NewStream(name string, group *Group, multiline *Multiline, finished chan<-
 	if stream.multiline != nil {
 		regx, err = regexp.Compile(stream.multiline.Pattern)
 		Fatal(err)
+		if stream.multiline.FlushPattern != "" {
+			stream.flushRegex, err = regexp.Compile(stream.multiline.FlushPattern)
+			Fatal(err)
+		}
+		if stream.multiline.Type == MultilineKey {
+			stream.keyRegex, err = regexp.Compile(stream.multiline.KeyPattern)
+			Fatal(err)
+		}
 	}
 	stream.multiRegex = regx
 
+	// unless the events come from FilterLogEvents, which evaluates the
+	// filter pattern itself, the pattern is evaluated locally
+	if group.Prospector.FilterPattern != "" && !params.Config.pushesDownFilter(group.Prospector) {
+		stream.filter, err = CompileFilterPattern(group.Prospector.FilterPattern)
+		Fatal(err)
+	}
+
 	return stream
 }
 
@@ -69,84 +124,218 @@ func NewStream(name string, group *Group, multiline *Multiline, finished chan<-
 func (stream *Stream) Next() error {
 	var err error
 
-	output, err := stream.Params.AWSClient.GetLogEvents(stream.queryParams)
+	output, err := stream.Params.Client(stream.Group.Account, stream.Group.Region).GetLogEvents(stream.queryParams)
 	if err != nil {
 		return err
 	}
 
 	// have we got anything new?
-	if len(output.Events) == 0 {
+	stream.caughtUp = len(output.Events) == 0
+	if stream.caughtUp {
 		return nil
 	}
 	// process the events
+	stream.batch = stream.acks.newBatch()
 	for _, streamEvent := range output.Events {
 		stream.digest(streamEvent)
 		stream.LastEventTimestamp = aws.Int64Value(streamEvent.Timestamp)
 	}
 	stream.queryParams.NextToken = output.NextForwardToken
-	err = stream.Params.Registry.WriteStreamInfo(stream)
-	return err
+	// the registry is updated once the published events are acknowledged
+	batch := stream.batch
+	stream.batch = nil
+	return stream.acks.seal(batch, stream.checkpoint())
 }
 
-// Coninuously monitors the stream for new events. If an error is
-// encountered, monitoring will stop and the stream will send an event
-// to the finished channel for the group to cleanup
-func (stream *Stream) Monitor() {
-	logp.Info("[stream] %s started", stream.FullName())
+// Updates the stream's state from a registry item
+func (stream *Stream) restore(item *RegistryItem) {
+	stream.queryParams.NextToken = aws.String(item.NextToken)
+	stream.restoreBuffer(item.Buffer, item.BufferTimestamp)
+	stream.restoreKeyed(item.KeyedBuffers)
+}
 
-	defer func() {
-		logp.Info("[stream] %s stopped", stream.FullName())
-		stream.finished <- true
-	}()
+// Restores the multiline buffer; if the timestamp of its first line is
+// unknown, the buffer times out as if it started now
+func (stream *Stream) restoreBuffer(buffer string, timestamp int64) {
+	stream.buffer.Reset()
+	stream.buffer.WriteString(buffer)
+	if timestamp == 0 {
+		timestamp = time.Now().UnixNano() / 1e6
+	}
+	stream.bufferStart = timestamp
+	// the event is truncated again by the next line if it is full
+	stream.bufferLines = countLines(buffer)
+	stream.truncated = false
+}
+
+// Returns the registry item that represents the stream's current state
+func (stream *Stream) checkpoint() *RegistryItem {
+	item := &RegistryItem{
+		NextToken:    aws.StringValue(stream.queryParams.NextToken),
+		Buffer:       stream.buffer.String(),
+		KeyedBuffers: stream.keyedCheckpoint(),
+	}
+	if stream.buffer.Len() > 0 {
+		item.BufferTimestamp = stream.bufferStart
+	}
+	return item
+}
 
+// Polls the stream once and returns how long to wait before its next
+// poll. Failed polls are retried with an exponential backoff; returns false
+// if the stream must not be polled anymore (it is expired, it does not
+// exist anymore or another instance has taken it over).
+func (stream *Stream) poll() (time.Duration, bool) {
+	// another instance has taken over the stream, whose state must not
+	// be overwritten
+	if atomic.LoadInt32(&stream.conflicted) == 1 {
+		logp.Err("%s is monitored by another instance", stream.FullName())
+		return 0, false
+	}
 	// first of all, read the stream's info from our registry storage
-	err := stream.Params.Registry.ReadStreamInfo(stream)
+	if !stream.started {
+		if err := stream.Params.Registry.ReadStreamInfo(stream); err != nil {
+			// the state is read again after a backoff, as the stream
+			// must not be read from its start position instead
+			class := classifyError(err)
+			stream.retries++
+			delay := stream.retry.next(class)
+			logp.Warn("%s registry %s error, retrying in %v [%s]",
+				stream.FullName(), class, delay, err.Error())
+			return delay, true
+		}
+		stream.started = true
+		stream.reported = time.Now()
+		// streams without a registry entry are read from the
+		// prospector's start position
+		if stream.queryParams.NextToken == nil {
+			stream.queryParams.StartTime = aws.Int64(
+				stream.Group.Prospector.startTime(stream.config.StreamEventHorizon))
+		}
+	}
+
+	var eventRefreshFrequency time.Duration
+	err := stream.Next()
 	if err != nil {
-		return
+		class := classifyError(err)
+		if class == NotFoundError {
+			logp.Err("%s %s", stream.FullName(), err.Error())
+			return 0, false
+		}
+		stream.retries++
+		eventRefreshFrequency = stream.retry.next(class)
+		logp.Warn("%s %s error, retrying in %v [%s]",
+			stream.FullName(), class, eventRefreshFrequency, err.Error())
+	} else {
+		stream.retry.reset()
+		// is the stream expired? streams read from before the horizon
+		// are not expired until they have caught up
+		if stream.caughtUp && IsBefore(stream.config.StreamEventHorizon, stream.LastEventTimestamp) {
+			return 0, false
+		}
+		// is the stream "hot"?
+		if stream.IsHot(stream.LastEventTimestamp) {
+			eventRefreshFrequency = stream.config.HotStreamEventRefreshFrequency
+		} else {
+			eventRefreshFrequency = stream.config.StreamEventRefreshFrequency
+		}
+	}
+	// once the stream has caught up, no more lines can complete an
+	// incomplete event that has timed out
+	if stream.caughtUp && stream.timedOut(time.Now().UnixNano()/1e6) {
+		stream.batch = stream.acks.newBatch()
+		stream.flushTimedOut(time.Now().UnixNano() / 1e6)
+		batch := stream.batch
+		stream.batch = nil
+		if err := stream.acks.seal(batch, stream.checkpoint()); err != nil {
+			logp.Err("%s %s", stream.FullName(), err.Error())
+		}
+	}
+	if time.Since(stream.reported) >= stream.Params.Config.ReportFrequency {
+		stream.report()
 	}
+	return eventRefreshFrequency, true
+}
 
-	reportTicker := time.NewTicker(stream.Params.Config.ReportFrequency)
-	defer reportTicker.Stop()
+// Coninuously monitors the stream for new events on its own goroutine,
+// which is used when streams are not polled by a Scheduler. When polling
+// stops, the stream will send an event to the finished channel for the
+// group to cleanup. When the context is cancelled, the stream is drained
+// before monitoring stops.
+func (stream *Stream) Monitor(ctx context.Context) {
+	logp.Info("[stream] %s started", stream.FullName())
 
-	var eventRefreshFrequency = stream.Params.Config.StreamEventRefreshFrequency
+	defer func() {
+		logp.Info("[stream] %s stopped", stream.FullName())
+		stream.finished <- true
+	}()
 
 	for {
-		err := stream.Next()
-		if err != nil {
-			logp.Err("%s %s", stream.FullName(), err.Error())
+		wait, ok := stream.poll()
+		if !ok {
 			return
 		}
-		// is the stream expired?
-		if IsBefore(stream.Params.Config.StreamEventHorizon, stream.LastEventTimestamp) {
+		select {
+		case <-ctx.Done():
+			stream.stop()
 			return
+		case <-time.After(wait):
 		}
-		// is the stream "hot"?
-		if stream.IsHot(stream.LastEventTimestamp) {
-			eventRefreshFrequency = stream.Params.Config.HotStreamEventRefreshFrequency
-		} else {
-			eventRefreshFrequency = stream.Params.Config.StreamEventRefreshFrequency
+	}
+}
+
+// Publishes the multiline buffer (if any) as an incomplete event and
+// commits the stream's final state once its events are acknowledged. The events buffered by their
+// correlation key are kept in the registry, as their lines may be
+// interleaved with the lines of other events.
+func (stream *Stream) drain() {
+	if stream.buffer.Len() == 0 {
+		return
+	}
+	stream.batch = stream.acks.newBatch()
+	stream.flushPartial()
+	batch := stream.batch
+	stream.batch = nil
+	if err := stream.acks.seal(batch, stream.checkpoint()); err != nil {
+		logp.Err("%s %s", stream.FullName(), err.Error())
+	}
+}
+
+// Drains the stream once it must not be polled anymore; if its group has
+// been removed and cleanup_registry is enabled, the stream's registry item
+// is deleted once its events are acknowledged
+func (stream *Stream) stop() {
+	if stream.Group.removed && len(stream.keyed) > 0 {
+		stream.batch = stream.acks.newBatch()
+		stream.flushKeyed()
+		batch := stream.batch
+		stream.batch = nil
+		if err := stream.acks.seal(batch, stream.checkpoint()); err != nil {
+			logp.Err("%s %s", stream.FullName(), err.Error())
 		}
-		select {
-		case <-reportTicker.C:
-			stream.report()
-		default:
-			time.Sleep(eventRefreshFrequency)
+	}
+	stream.drain()
+	if stream.Group.removed && stream.Params.Config.CleanupRegistry {
+		if err := stream.acks.seal(stream.acks.newBatch(), registryDeletion{}); err != nil {
+			logp.Err("%s %s", stream.FullName(), err.Error())
 		}
 	}
 }
 
 func (stream *Stream) IsHot(lastEventTimestamp int64) bool {
-	return !IsBefore(stream.Params.Config.HotStreamEventHorizon, lastEventTimestamp)
+	return !IsBefore(stream.config.HotStreamEventHorizon, lastEventTimestamp)
 }
 
 func (stream *Stream) report() {
-	logp.Info("report[stream] %d %s %s",
-		stream.publishedEvents, stream.FullName(), stream.Params.Config.ReportFrequency)
+	logp.Info("report[stream] %d %d %s %s",
+		stream.publishedEvents, stream.retries, stream.FullName(), stream.Params.Config.ReportFrequency)
 	stream.publishedEvents = 0
+	stream.retries = 0
+	stream.reported = time.Now()
 }
 
 func (stream *Stream) FullName() string {
-	return fmt.Sprintf("%s/%s", stream.Group.Name, stream.Name)
+	return fmt.Sprintf("%s/%s", stream.Group.key(), stream.Name)
 }
 
 // fills the buffer's contents into the event,
@@ -156,12 +345,101 @@ func (stream *Stream) publish(event *Event) {
 		return
 	}
 	event.Message = stream.buffer.String()
-	stream.Params.Publisher.Publish(event)
+	event.Truncated = stream.truncated
+	stream.send(event)
 	stream.buffer.Reset()
+	stream.bufferLines = 0
+	stream.truncated = false
+}
+
+// parses and publishes an event in the current batch (if any)
+func (stream *Stream) send(event *Event) {
+	if stream.Group.Prospector.Parser == LambdaParser {
+		event.Fields = parseLambdaEvent(stream.Group.Name, stream.Name, event.Message)
+	}
+	if stream.batch != nil {
+		event.batch = stream.batch
+		stream.batch.add()
+	}
+	stream.Params.Publisher.Publish(event)
 	stream.publishedEvents++
 }
 
+// publishes the contents of the multiline buffer (if any) as an event
+func (stream *Stream) flush() {
+	stream.publish(&Event{
+		Stream:    stream,
+		Timestamp: stream.LastEventTimestamp,
+	})
+}
+
+// publishes the contents of the multiline buffer (if any) as an
+// incomplete event
+func (stream *Stream) flushPartial() {
+	stream.publish(&Event{
+		Stream:    stream,
+		Timestamp: stream.LastEventTimestamp,
+		Partial:   true,
+	})
+}
+
+// Returns true if an incomplete event whose first line is at the start
+// time is older than the multiline timeout at the given time (both in
+// milliseconds since 1970)
+func (stream *Stream) expired(start int64, now int64) bool {
+	if stream.multiline == nil || stream.multiline.Timeout <= 0 {
+		return false
+	}
+	return now-start >= stream.multiline.Timeout.Nanoseconds()/1e6
+}
+
+// Returns true if any buffered incomplete event has timed out at the
+// given time
+func (stream *Stream) timedOut(now int64) bool {
+	if stream.buffer.Len() > 0 && stream.expired(stream.bufferStart, now) {
+		return true
+	}
+	for _, buffer := range stream.keyed {
+		if stream.expired(buffer.start, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Publishes the buffered incomplete events that have timed out at the
+// given time
+func (stream *Stream) flushTimedOut(now int64) {
+	if stream.buffer.Len() > 0 && stream.expired(stream.bufferStart, now) {
+		stream.flushPartial()
+	}
+	keyed := stream.keyed[:0]
+	for _, buffer := range stream.keyed {
+		if stream.expired(buffer.start, now) {
+			stream.publishKeyed(buffer, stream.LastEventTimestamp, true)
+		} else {
+			keyed = append(keyed, buffer)
+		}
+	}
+	stream.keyed = keyed
+}
+
+// Appends a line to the multiline buffer; the lines beyond max_lines and
+// the bytes beyond max_bytes are dropped and the event is truncated
+func (stream *Stream) buffered(message string, timestamp int64) {
+	if stream.buffer.Len() == 0 {
+		stream.bufferStart = timestamp
+	}
+	stream.bufferLines++
+	if !stream.multiline.append(&stream.buffer, stream.bufferLines, message) {
+		stream.truncated = true
+	}
+}
+
 func (stream *Stream) digest(streamEvent *cloudwatchlogs.OutputLogEvent) {
+	if stream.filter != nil && !stream.filter.Match(aws.StringValue(streamEvent.Message)) {
+		return
+	}
 	event := &Event{
 		Stream:    stream,
 		Timestamp: aws.Int64Value(streamEvent.Timestamp),
@@ -170,17 +448,50 @@ func (stream *Stream) digest(streamEvent *cloudwatchlogs.OutputLogEvent) {
 		stream.buffer.WriteString(*streamEvent.Message)
 		stream.publish(event)
 	} else {
-		switch stream.multiline.Match {
-		case "after":
-			if stream.multiRegex.MatchString(*streamEvent.Message) == stream.multiline.Negate {
+		// lines that come after the timeout do not belong to the
+		// buffered event
+		stream.flushTimedOut(event.Timestamp)
+		switch stream.multiline.Type {
+		case MultilineCount:
+			stream.buffered(*streamEvent.Message, event.Timestamp)
+			if stream.bufferLines >= stream.multiline.CountLines {
 				stream.publish(event)
 			}
-			stream.buffer.WriteString(*streamEvent.Message)
-		case "before":
-			stream.buffer.WriteString(*streamEvent.Message)
+		case MultilineKey:
+			stream.digestKey(event, *streamEvent.Message)
+		case MultilineWhilePattern:
+			// lines that do not match end the event and are events
+			// on their own
 			if stream.multiRegex.MatchString(*streamEvent.Message) == stream.multiline.Negate {
 				stream.publish(event)
+				stream.buffered(*streamEvent.Message, event.Timestamp)
+				stream.publish(&Event{Stream: stream, Timestamp: event.Timestamp})
+			} else {
+				stream.buffered(*streamEvent.Message, event.Timestamp)
 			}
+		default:
+			stream.digestPattern(event, *streamEvent.Message)
 		}
 	}
 }
+
+// Groups the lines by the multiline pattern and match settings; lines
+// that match the flush pattern end the event
+func (stream *Stream) digestPattern(event *Event, message string) {
+	switch stream.multiline.Match {
+	case "after":
+		if stream.multiRegex.MatchString(message) == stream.multiline.Negate {
+			stream.publish(event)
+		}
+		stream.buffered(message, event.Timestamp)
+	case "before":
+		stream.buffered(message, event.Timestamp)
+		if stream.multiRegex.MatchString(message) == stream.multiline.Negate {
+			stream.publish(event)
+			return
+		}
+	}
+	if stream.flushRegex != nil && stream.flushRegex.MatchString(message) {
+		stream.publish(&Event{Stream: stream, Timestamp: event.Timestamp})
+	}
+}
@@ -1,12 +1,14 @@
 package cwl
 
 import (
+	"context"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -29,7 +31,7 @@ func Test_Stream_Next_WillGenerateCorrectNumberOfEvents(t *testing.T) {
 	// stub the registry functions
 	registry := &MockRegistry{}
 	registry.On("ReadStreamInfo", mock.AnythingOfType("*cwl.Stream")).Return(nil)
-	registry.On("WriteStreamInfo", mock.AnythingOfType("*cwl.Stream")).Return(nil)
+	registry.On("WriteStreamInfo", mock.AnythingOfType("*cwl.Stream"), mock.AnythingOfType("*cwl.RegistryItem")).Return(nil)
 	// stub the client
 	client := &MockCWLClient{}
 	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).Return(
@@ -60,21 +62,21 @@ func Test_Stream_Next_WillGenerateCorrectNumberOfEvents(t *testing.T) {
 }
 
 // test stream cleanup (a message will be sent to the finished channel)
-func Test_Stream_ShouldSendACleanupEvent_OnError(t *testing.T) {
+func Test_Stream_ShouldSendACleanupEvent_OnResourceNotFound(t *testing.T) {
 	group := &Group{Name: "group", Prospector: &Prospector{}}
 
 	// stub GetLogEvents to return the error
 	client := &MockCWLClient{}
 	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).
-		Return(nil, awserr.New(cloudwatchlogs.ErrCodeInvalidOperationException, "Error", nil))
+		Return(nil, awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, "Error", nil))
 	// stub the log events
 	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).
-		Return(nil, awserr.New(cloudwatchlogs.ErrCodeInvalidOperationException, "Error", nil))
+		Return(nil, awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, "Error", nil))
 
 	// stub the registry functions
 	registry := &MockRegistry{}
 	registry.On("ReadStreamInfo", mock.AnythingOfType("*cwl.Stream")).Return(nil)
-	registry.On("WriteStreamInfo", mock.AnythingOfType("*cwl.Stream")).Return(nil)
+	registry.On("WriteStreamInfo", mock.AnythingOfType("*cwl.Stream"), mock.AnythingOfType("*cwl.RegistryItem")).Return(nil)
 	params := &Params{
 		Config:    &Config{ReportFrequency: 1 * time.Minute},
 		Registry:  registry,
@@ -86,11 +88,99 @@ func Test_Stream_ShouldSendACleanupEvent_OnError(t *testing.T) {
 	stream := NewStream("TestStream", group, group.Prospector.Multiline, finished, params)
 
 	// fire!
-	go stream.Monitor()
+	go stream.Monitor(context.Background())
 	// capture and assert the event
 	assert.True(t, <-finished)
 }
 
+// test the stream keeps polling after a transient error
+func Test_Stream_RetriesAfterThrottling(t *testing.T) {
+	group := &Group{Name: "group", Prospector: &Prospector{}}
+	client := &MockCWLClient{}
+	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).
+		Return(nil, awserr.New("ThrottlingException", "Rate exceeded", nil)).Once()
+	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).
+		Return(nil, awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, "Error", nil))
+	registry := &MockRegistry{}
+	registry.On("ReadStreamInfo", mock.AnythingOfType("*cwl.Stream")).Return(nil)
+	params := &Params{
+		Config: &Config{
+			ReportFrequency:     1 * time.Minute,
+			RetryInitialBackoff: 1 * time.Millisecond,
+			RetryMaxBackoff:     1 * time.Millisecond,
+		},
+		Registry:  registry,
+		AWSClient: client,
+		Publisher: &MockPublisher{},
+	}
+	finished := make(chan bool)
+	stream := NewStream("TestStream", group, group.Prospector.Multiline, finished, params)
+
+	// fire!
+	go stream.Monitor(context.Background())
+	// assert
+	assert.True(t, <-finished)
+	client.AssertNumberOfCalls(t, "GetLogEvents", 2)
+	assert.Equal(t, int64(1), stream.retries)
+}
+
+func Test_Stream_RetriesAfterARegistryError(t *testing.T) {
+	group := &Group{Name: "group", Prospector: &Prospector{}}
+	client := &MockCWLClient{}
+	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).Return(
+		&cloudwatchlogs.GetLogEventsOutput{}, nil)
+	registry := &MockRegistry{}
+	registry.On("ReadStreamInfo", mock.AnythingOfType("*cwl.Stream")).
+		Return(awserr.New("ProvisionedThroughputExceededException", "Rate exceeded", nil)).Once()
+	registry.On("ReadStreamInfo", mock.AnythingOfType("*cwl.Stream")).Return(nil)
+	params := &Params{
+		Config: &Config{
+			ReportFrequency:     1 * time.Minute,
+			StreamEventHorizon:  time.Hour,
+			RetryInitialBackoff: 1 * time.Second,
+			RetryMaxBackoff:     1 * time.Second,
+		},
+		Registry:  registry,
+		AWSClient: client,
+		Publisher: &MockPublisher{},
+	}
+	stream := NewStream("TestStream", group, nil, nil, params)
+
+	// fire!
+	delay, ok := stream.poll()
+	// assert
+	assert.True(t, ok)
+	assert.True(t, delay >= 500*time.Millisecond)
+	assert.Equal(t, int64(1), stream.retries)
+	client.AssertNumberOfCalls(t, "GetLogEvents", 0)
+	// the state is read again by the next poll
+	_, ok = stream.poll()
+	assert.True(t, ok)
+	registry.AssertNumberOfCalls(t, "ReadStreamInfo", 2)
+	client.AssertNumberOfCalls(t, "GetLogEvents", 1)
+}
+
+func Test_Stream_Stops_WhenAnotherInstanceWroteItsState(t *testing.T) {
+	group := &Group{Name: "group", Prospector: &Prospector{}}
+	registry := &MockRegistry{}
+	registry.On("WriteStreamInfo", mock.AnythingOfType("*cwl.Stream"), mock.AnythingOfType("*cwl.RegistryItem")).
+		Return(awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "Conflict", nil))
+	params := &Params{
+		Config:    &Config{ReportFrequency: 1 * time.Minute},
+		Registry:  registry,
+		AWSClient: &MockCWLClient{},
+		Publisher: &MockPublisher{},
+	}
+	stream := NewStream("TestStream", group, nil, nil, params)
+	stream.acks.seal(stream.acks.newBatch(), stream.checkpoint())
+
+	// fire!
+	_, ok := stream.poll()
+	// assert
+	assert.False(t, ok)
+	registry.AssertNotCalled(t, "ReadStreamInfo", mock.Anything)
+}
+
 // test the stream sends an event on the finished channel on expiration
 func Test_Stream_ShouldSendACleanupEvent_OnExpiring(t *testing.T) {
 	t.Skip("pending")
@@ -145,3 +235,142 @@ func Test_Stream_IsNotHot_When_HotStreamEventHorizon_IsZero(t *testing.T) {
 	// assert
 	assert.False(t, stream.IsHot(lastEventTimestamp))
 }
+
+// test the stream publishes its multiline buffer and commits its final
+// state when its context is cancelled
+func Test_Stream_Monitor_DrainsTheBuffer_WhenCancelled(t *testing.T) {
+	group := &Group{
+		Name:       "group",
+		Prospector: &Prospector{Multiline: &Multiline{Pattern: "^END", Negate: true, Match: "before"}},
+	}
+	client := &MockCWLClient{}
+	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).Return(
+		&cloudwatchlogs.GetLogEventsOutput{
+			Events:           []*cloudwatchlogs.OutputLogEvent{CreateOutputLogEventWithTimestamp("partial\n", TimeBeforeNowInMilliseconds(0))},
+			NextForwardToken: aws.String("token"),
+		}, nil).Once()
+	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).Return(
+		&cloudwatchlogs.GetLogEventsOutput{}, nil)
+	publisher, events := CreateCollectingPublisher(true)
+	registry := NewDummyRegistry()
+	params := &Params{
+		Config: &Config{
+			ReportFrequency:             1 * time.Minute,
+			StreamEventHorizon:          1 * time.Hour,
+			StreamEventRefreshFrequency: 1 * time.Hour,
+		},
+		Registry:  registry,
+		AWSClient: client,
+		Publisher: publisher,
+	}
+	finished := make(chan bool)
+	stream := NewStream("TestStream", group, group.Prospector.Multiline, finished, params)
+	ctx, cancel := context.WithCancel(context.Background())
+	// fire!
+	go stream.Monitor(ctx)
+	cancel()
+	// assert
+	assert.True(t, <-finished)
+	assert.Equal(t, 1, len(*events))
+	assert.Equal(t, "partial\n", (*events)[0].Message)
+	assert.True(t, (*events)[0].Partial)
+	restored := NewStream("TestStream", group, nil, nil, params)
+	registry.ReadStreamInfo(restored)
+	assert.Equal(t, "token", *restored.queryParams.NextToken)
+	assert.Equal(t, "", restored.buffer.String())
+}
+
+func Test_Stream_Stop_DeletesTheRegistryItem_OfRemovedGroups(t *testing.T) {
+	group := &Group{Name: "group", Prospector: &Prospector{}, removed: true}
+	publisher := &MockPublisher{}
+	publisher.On("Publish", mock.AnythingOfType("*cwl.Event")).Return()
+	registry := NewDummyRegistry()
+	params := &Params{
+		Config:    &Config{CleanupRegistry: true},
+		Registry:  registry,
+		Publisher: publisher,
+	}
+	stream := NewStream("TestStream", group, nil, nil, params)
+	registry.WriteStreamInfo(stream, &RegistryItem{NextToken: "token"})
+	// the last batch is still waiting for its acknowledgement
+	stream.batch = stream.acks.newBatch()
+	stream.buffer.WriteString("message\n")
+	stream.flush()
+	batch := stream.batch
+	stream.batch = nil
+	stream.acks.seal(batch, &RegistryItem{NextToken: "next"})
+
+	// fire!
+	stream.stop()
+	restored := NewStream("TestStream", group, nil, nil, params)
+	registry.ReadStreamInfo(restored)
+	assert.Equal(t, "token", *restored.queryParams.NextToken)
+	AckEvents(1, []interface{}{batch})
+	// assert
+	restored = NewStream("TestStream", group, nil, nil, params)
+	registry.ReadStreamInfo(restored)
+	assert.Nil(t, restored.queryParams.NextToken)
+}
+
+func Test_Stream_IsReadFromTheStartPosition_WithoutARegistryEntry(t *testing.T) {
+	group := &Group{Name: "group", Prospector: &Prospector{StartPosition: "beginning"}}
+	client := &MockCWLClient{}
+	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).Return(
+		&cloudwatchlogs.GetLogEventsOutput{}, nil)
+	registry := NewDummyRegistry()
+	params := &Params{
+		Config:    &Config{ReportFrequency: 1 * time.Minute, StreamEventHorizon: time.Hour},
+		Registry:  registry,
+		AWSClient: client,
+		Publisher: &MockPublisher{},
+	}
+	// the stream has no registry entry
+	stream := NewStream("TestStream", group, nil, nil, params)
+	stream.poll()
+	assert.Equal(t, int64(0), aws.Int64Value(stream.queryParams.StartTime))
+	// the stream continues from its registry entry
+	registry.WriteStreamInfo(stream, &RegistryItem{NextToken: "token"})
+	stream = NewStream("TestStream", group, nil, nil, params)
+	stream.poll()
+	assert.Equal(t, "token", aws.StringValue(stream.queryParams.NextToken))
+	assert.NotEqual(t, int64(0), aws.Int64Value(stream.queryParams.StartTime))
+}
+
+func Test_Stream_IsNotExpired_UntilItHasCaughtUp(t *testing.T) {
+	group := &Group{Name: "group", Prospector: &Prospector{StartPosition: "beginning"}}
+	client := &MockCWLClient{}
+	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).Return(
+		&cloudwatchlogs.GetLogEventsOutput{
+			Events:           []*cloudwatchlogs.OutputLogEvent{CreateOutputLogEventWithTimestamp("old\n", TimeBeforeNowInMilliseconds(48*time.Hour))},
+			NextForwardToken: aws.String("token"),
+		}, nil).Once()
+	client.On("GetLogEvents", mock.AnythingOfType("*cloudwatchlogs.GetLogEventsInput")).Return(
+		&cloudwatchlogs.GetLogEventsOutput{NextForwardToken: aws.String("token")}, nil)
+	publisher := &MockPublisher{}
+	publisher.On("Publish", mock.AnythingOfType("*cwl.Event")).Return()
+	params := &Params{
+		Config:    &Config{ReportFrequency: 1 * time.Minute, StreamEventHorizon: time.Hour},
+		Registry:  NewDummyRegistry(),
+		AWSClient: client,
+		Publisher: publisher,
+	}
+	stream := NewStream("TestStream", group, nil, nil, params)
+	// the first poll reads events from before the horizon
+	_, ok := stream.poll()
+	assert.True(t, ok)
+	// the second poll has caught up
+	_, ok = stream.poll()
+	assert.False(t, ok)
+}
+
+func Test_Stream_UsesTheProspectorOverrides(t *testing.T) {
+	horizon := 30 * time.Minute
+	config := &Config{HotStreamEventHorizon: 10 * time.Minute}
+	params := &Params{Config: config}
+	group := &Group{Name: "group", Prospector: &Prospector{HotStreamEventHorizon: &horizon}, Params: params}
+	// create the stream
+	stream := NewStream("TestStream", group, nil, nil, params)
+	lastEventTimestamp := TimeBeforeNowInMilliseconds(20 * time.Minute)
+	// assert
+	assert.True(t, stream.IsHot(lastEventTimestamp))
+}
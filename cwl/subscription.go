@@ -0,0 +1,77 @@
+package cwl
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// Message types of the CloudWatch Logs subscription payloads
+const (
+	SubscriptionDataMessage    = "DATA_MESSAGE"
+	SubscriptionControlMessage = "CONTROL_MESSAGE"
+)
+
+// The payload delivered by CloudWatch Logs subscription filters
+// to kinesis streams and firehose delivery streams
+type SubscriptionMessage struct {
+	MessageType         string                  `json:"messageType"`
+	Owner               string                  `json:"owner"`
+	LogGroup            string                  `json:"logGroup"`
+	LogStream           string                  `json:"logStream"`
+	SubscriptionFilters []string                `json:"subscriptionFilters"`
+	LogEvents           []*SubscriptionLogEvent `json:"logEvents"`
+}
+
+type SubscriptionLogEvent struct {
+	Id        string `json:"id"`
+	Timestamp int64  `json:"timestamp"`
+	Message   string `json:"message"`
+}
+
+// Decompresses and decodes a gzipped subscription payload
+func DecodeSubscriptionMessage(data []byte) (*SubscriptionMessage, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	var message SubscriptionMessage
+	if err = json.Unmarshal(body, &message); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// Digests the message's log events using the stream to which they belong
+// and returns the stream. Returns nil if the message is not a data message
+// or if its group is not matched by any prospector.
+func (manager *GroupManager) digestSubscriptionMessage(message *SubscriptionMessage, batch *eventBatch) *Stream {
+	if message.MessageType != SubscriptionDataMessage {
+		return nil
+	}
+	manager.dispatchLock.Lock()
+	defer manager.dispatchLock.Unlock()
+	stream := manager.dispatchStream(message.Owner, message.LogGroup, message.LogStream, true)
+	if stream == nil {
+		return nil
+	}
+	stream.batch = batch
+	for _, event := range message.LogEvents {
+		stream.digest(&cloudwatchlogs.OutputLogEvent{
+			Message:   aws.String(event.Message),
+			Timestamp: aws.Int64(event.Timestamp),
+		})
+		stream.LastEventTimestamp = event.Timestamp
+	}
+	stream.batch = nil
+	return stream
+}
@@ -0,0 +1,143 @@
+package cwl
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"testing"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// a beat client that collects the published events
+type collectingClient struct {
+	events []beat.Event
+}
+
+func (client *collectingClient) Publish(event beat.Event) {
+	client.events = append(client.events, event)
+}
+
+func (client *collectingClient) PublishAll(events []beat.Event) {
+	client.events = append(client.events, events...)
+}
+
+func (client *collectingClient) Close() error {
+	return nil
+}
+
+// helper function for creating gzipped subscription payloads
+func CreateSubscriptionPayload(message *SubscriptionMessage) []byte {
+	body, _ := json.Marshal(message)
+	buffer := &bytes.Buffer{}
+	writer := gzip.NewWriter(buffer)
+	writer.Write(body)
+	writer.Close()
+	return buffer.Bytes()
+}
+
+func CreateSubscriptionMessage(group string, stream string, messages ...string) *SubscriptionMessage {
+	message := &SubscriptionMessage{
+		MessageType: SubscriptionDataMessage,
+		Owner:       "123456789012",
+		LogGroup:    group,
+		LogStream:   stream,
+	}
+	for i, text := range messages {
+		message.LogEvents = append(message.LogEvents, &SubscriptionLogEvent{
+			Id:        string(rune('a' + i)),
+			Timestamp: TimeBeforeNowInMilliseconds(0),
+			Message:   text,
+		})
+	}
+	return message
+}
+
+func Test_DecodeSubscriptionMessage(t *testing.T) {
+	payload := CreateSubscriptionPayload(CreateSubscriptionMessage("group", "stream", "Event 1\n"))
+	message, err := DecodeSubscriptionMessage(payload)
+	assert.Nil(t, err)
+	assert.Equal(t, SubscriptionDataMessage, message.MessageType)
+	assert.Equal(t, "group", message.LogGroup)
+	assert.Equal(t, "stream", message.LogStream)
+	assert.Equal(t, "Event 1\n", message.LogEvents[0].Message)
+
+	_, err = DecodeSubscriptionMessage([]byte("not gzipped"))
+	assert.NotNil(t, err)
+}
+
+func Test_Manager_FindProspector(t *testing.T) {
+	params := &Params{
+		Config: &Config{Prospectors: []Prospector{
+			{Id: "exact", GroupNames: []string{"/aws/lambda/function"}},
+			{Id: "prefix", GroupNames: []string{"/aws/lambda/*"}},
+		}},
+	}
+	manager := NewGroupManager(params)
+	// assert
+	assert.Equal(t, "exact", manager.findProspector("/aws/lambda/function").Id)
+	assert.Equal(t, "prefix", manager.findProspector("/aws/lambda/other").Id)
+	assert.Nil(t, manager.findProspector("/aws/ecs/service"))
+}
+
+func Test_Manager_DigestSubscriptionMessage_PublishesUsingTheProspector(t *testing.T) {
+	publisher, events := CreateCollectingPublisher(false)
+	params := &Params{
+		Config:    &Config{Prospectors: []Prospector{{Id: "lambda", GroupNames: []string{"/aws/lambda/*"}}}},
+		Registry:  NewDummyRegistry(),
+		Publisher: publisher,
+	}
+	manager := NewGroupManager(params)
+	message := CreateSubscriptionMessage("/aws/lambda/function", "stream", "Event 1\n", "Event 2\n")
+	// go!
+	stream := manager.digestSubscriptionMessage(message, nil)
+	// assert
+	assert.NotNil(t, stream)
+	assert.Equal(t, 2, len(*events))
+	assert.Equal(t, "lambda", (*events)[0].Stream.Group.Prospector.Id)
+	assert.Equal(t, "/aws/lambda/function", (*events)[0].Stream.Group.Name)
+	assert.Equal(t, "stream", (*events)[1].Stream.Name)
+
+	// unmatched groups and control messages are ignored
+	assert.Nil(t, manager.digestSubscriptionMessage(CreateSubscriptionMessage("/aws/ecs/service", "stream", "Event\n"), nil))
+	control := CreateSubscriptionMessage("/aws/lambda/function", "stream", "CWL CONTROL MESSAGE")
+	control.MessageType = SubscriptionControlMessage
+	assert.Nil(t, manager.digestSubscriptionMessage(control, nil))
+	assert.Equal(t, 2, len(*events))
+}
+
+func Test_Manager_DigestSubscriptionMessage_UsesTheOwnerOfTheMessage(t *testing.T) {
+	publisher, events := CreateCollectingPublisher(false)
+	params := &Params{
+		Config: &Config{
+			AWSRegion:   "eu-west-1",
+			Prospectors: []Prospector{{Id: "lambda", GroupNames: []string{"/aws/lambda/*"}}},
+		},
+		AccountId: "111111111111",
+		Registry:  NewDummyRegistry(),
+		Publisher: publisher,
+	}
+	manager := NewGroupManager(params)
+	message := CreateSubscriptionMessage("/aws/lambda/function", "stream", "Event 1\n")
+	other := CreateSubscriptionMessage("/aws/lambda/function", "stream", "Event 2\n")
+	other.Owner = "210987654321"
+
+	// go!
+	manager.digestSubscriptionMessage(message, nil)
+	manager.digestSubscriptionMessage(other, nil)
+	// assert
+	assert.Equal(t, 2, len(manager.groups))
+	assert.Equal(t, "123456789012", manager.groups["123456789012:/aws/lambda/function"].Account)
+	assert.Equal(t, "210987654321", manager.groups["210987654321:/aws/lambda/function"].Account)
+	client := &collectingClient{}
+	for _, event := range *events {
+		Publisher{Client: client}.Publish(event)
+	}
+	assert.Equal(t, common.MapStr{"account_id": "123456789012"}, client.events[0].Fields["aws"])
+	assert.Equal(t, common.MapStr{"account_id": "210987654321"}, client.events[1].Fields["aws"])
+	// the region of subscription messages is unknown
+	_, ok := client.events[0].Fields["region"]
+	assert.False(t, ok)
+}
@@ -0,0 +1,79 @@
+package cwl
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+)
+
+// groupTagCache keeps the tags of the log groups that are selected by the
+// prospectors' group_tags, so that ListTagsLogGroup is called at most once
+// per group and refresh interval instead of on every refresh of the groups
+type groupTagCache struct {
+	client  cloudwatchlogsiface.CloudWatchLogsAPI
+	refresh time.Duration // how long the tags of a group are cached
+
+	mutex   sync.Mutex
+	entries map[string]*groupTags
+}
+
+type groupTags struct {
+	tags    map[string]string
+	fetched time.Time
+}
+
+func newGroupTagCache(client cloudwatchlogsiface.CloudWatchLogsAPI, refresh time.Duration) *groupTagCache {
+	return &groupTagCache{
+		client:  client,
+		refresh: refresh,
+		entries: make(map[string]*groupTags),
+	}
+}
+
+// Returns the tags of the group, fetching them if they are not cached or
+// their cache entry is older than the refresh interval
+func (cache *groupTagCache) get(groupName string) (map[string]string, error) {
+	cache.mutex.Lock()
+	entry, ok := cache.entries[groupName]
+	cache.mutex.Unlock()
+	if ok && time.Since(entry.fetched) < cache.refresh {
+		return entry.tags, nil
+	}
+	output, err := cache.client.ListTagsLogGroup(&cloudwatchlogs.ListTagsLogGroupInput{
+		LogGroupName: aws.String(groupName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	tags := aws.StringValueMap(output.Tags)
+	cache.mutex.Lock()
+	cache.entries[groupName] = &groupTags{tags: tags, fetched: time.Now()}
+	cache.mutex.Unlock()
+	return tags, nil
+}
+
+// Forgets the entries that are older than the refresh interval, i.e. those
+// of the groups that have not been looked up recently
+func (cache *groupTagCache) expire() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for groupName, entry := range cache.entries {
+		if time.Since(entry.fetched) >= cache.refresh {
+			delete(cache.entries, groupName)
+		}
+	}
+}
+
+// Returns true if the tags contain all the tags of the selector with the
+// same values
+func matchGroupTags(selector map[string]string, tags map[string]string) bool {
+	for key, value := range selector {
+		if tag, ok := tags[key]; !ok || tag != value {
+			return false
+		}
+	}
+	return true
+}
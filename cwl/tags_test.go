@@ -0,0 +1,56 @@
+package cwl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// stubs ListTagsLogGroup to return the tags of the named group
+func stubListTagsLogGroup(client *MockCWLClient, groupName string, tags map[string]string) {
+	client.On("ListTagsLogGroup", mock.MatchedBy(func(input *cloudwatchlogs.ListTagsLogGroupInput) bool {
+		return aws.StringValue(input.LogGroupName) == groupName
+	})).Return(&cloudwatchlogs.ListTagsLogGroupOutput{Tags: aws.StringMap(tags)}, nil)
+}
+
+func Test_MatchGroupTags(t *testing.T) {
+	testCases := []struct {
+		selector map[string]string
+		tags     map[string]string
+		match    bool
+	}{
+		{map[string]string{"team": "payments"}, map[string]string{"team": "payments", "env": "prod"}, true},
+		{map[string]string{"team": "payments", "env": "prod"}, map[string]string{"team": "payments", "env": "prod"}, true},
+		{map[string]string{"team": "payments", "env": "prod"}, map[string]string{"team": "payments"}, false},
+		{map[string]string{"team": "payments"}, map[string]string{"team": "search"}, false},
+		{map[string]string{"team": "payments"}, nil, false},
+	}
+
+	for _, testCase := range testCases {
+		assert.Equal(t, testCase.match, matchGroupTags(testCase.selector, testCase.tags), testCase.selector)
+	}
+}
+
+func Test_GroupTagCache_CachesTheTags_ForTheRefreshInterval(t *testing.T) {
+	client := &MockCWLClient{}
+	stubListTagsLogGroup(client, "group", map[string]string{"team": "payments"})
+	cache := newGroupTagCache(client, time.Hour)
+
+	// go!
+	tags, err := cache.get("group")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"team": "payments"}, tags)
+	cache.get("group")
+	client.AssertNumberOfCalls(t, "ListTagsLogGroup", 1)
+	// stale entries are fetched again and expired
+	cache.entries["group"].fetched = time.Now().Add(-time.Hour)
+	cache.get("group")
+	client.AssertNumberOfCalls(t, "ListTagsLogGroup", 2)
+	cache.entries["group"].fetched = time.Now().Add(-time.Hour)
+	cache.expire()
+	assert.Equal(t, 0, len(cache.entries))
+}